@@ -2,129 +2,267 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
-	"text/template"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 
-	"github.com/go-redis/redis"
-
 	x "github.com/drax2gma/nodelocker/internal"
 )
 
-func jsonStatHandler(w http.ResponseWriter, r *http.Request) {
+// Returns: the status of the entities selected by the query parameters, the
+// whole collected by the store without them, `false` if the answer is sent
+// already because of a wrong parameter
+func queryStats(w http.ResponseWriter, r *http.Request) (*x.Stats, bool) {
 
-	stats := new(x.Stats)
-	x.RFillJsonStats(stats)
+	params := r.URL.Query()
+	params.Del("format")
 
-	w.Header().Set("Content-Type", x.C_RespHeader)
-	w.WriteHeader(http.StatusOK)
+	if len(params) == 0 {
+		stats := new(x.Stats)
+		x.DB.FillJsonStats(stats)
+		return stats, true
+	}
+
+	q, errMsg := x.ParseStatusQuery(params)
+	if errMsg != "" {
+		returnWebResponse(w, http.StatusBadRequest, &x.WebResponse{Messages: []string{errMsg}})
+		return nil, false
+	}
+
+	st := x.QueryStatus(q)
+	w.Header().Set("X-Total-Count", strconv.Itoa(st.Total))
+
+	return x.StatsOf(st), true
+}
+
+// Returns: the handler of the status in the given format, the empty one
+// negotiates it by the 'format' parameter or the Accept header
+func statusHandler(format string) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		f, ok := format, true
+		if f == "" {
+			f, ok = x.NegotiateFormat(r.URL.Query().Get("format"), r.Header.Get("Accept"))
+		}
+		if !ok {
+			returnWebResponse(w, http.StatusBadRequest, &x.WebResponse{Messages: []string{x.ERR_InvalidFormat}})
+			return
+		}
+
+		var body bytes.Buffer
+		var err error
+
+		switch f {
+		case x.C_FORMAT_JSON, x.C_FORMAT_YAML:
+			stats, ok := queryStats(w, r)
+			if !ok {
+				return
+			}
+			if f == x.C_FORMAT_YAML {
+				err = x.WriteStatsYAML(&body, stats)
+			} else {
+				var byteData []byte
+				byteData, err = json.MarshalIndent(stats, "", "    ")
+				body.Write(byteData)
+			}
+		default:
+			q, errMsg := x.ParseStatusQuery(r.URL.Query())
+			if errMsg != "" {
+				returnWebResponse(w, http.StatusBadRequest, &x.WebResponse{Messages: []string{errMsg}})
+				return
+			}
+			st := x.QueryStatus(q)
+			w.Header().Set("X-Total-Count", strconv.Itoa(st.Total))
+			switch f {
+			case x.C_FORMAT_CSV:
+				err = x.WriteStatusCSV(&body, st)
+			case x.C_FORMAT_TEXT:
+				err = x.WriteStatusText(&body, st)
+			default:
+				err = x.WriteStatusPrometheus(&body, st)
+			}
+		}
+
+		if err != nil {
+			http.Error(w, "Error rendering the status", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", x.FormatContentType(f))
+		w.Header().Set("Vary", "Accept")
+		w.WriteHeader(http.StatusOK)
+
+		if _, err := w.Write(body.Bytes()); err != nil {
+			http.Error(w, "Error writing response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func jsonStatusV2Handler(w http.ResponseWriter, r *http.Request) {
+
+	q, errMsg := x.ParseStatusQuery(r.URL.Query())
+	if errMsg != "" {
+		returnWebResponse(w, http.StatusBadRequest, &x.WebResponse{Messages: []string{errMsg}})
+		return
+	}
 
-	byteData, err := json.MarshalIndent(stats, "", "    ")
+	st := x.QueryStatus(q)
+	w.Header().Set("X-Total-Count", strconv.Itoa(st.Total))
+
+	byteData, err := json.MarshalIndent(st, "", "    ")
 	if err != nil {
 		http.Error(w, x.ERR_JsonConvertData, http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set("Content-Type", x.C_RespHeader)
+	w.WriteHeader(http.StatusOK)
+
 	if _, err := w.Write(byteData); err != nil {
 		http.Error(w, "Error writing response", http.StatusInternalServerError)
 		return
 	}
 }
 
-func webStatHandler(w http.ResponseWriter, r *http.Request) {
+// Serves one entity, the type and name come from the query or the path.
+func entityHandler(w http.ResponseWriter, r *http.Request) {
 
-	stats := new(x.Stats)
-	x.RFillJsonStats(stats)
-
-	tmpl := template.Must(template.New("index").Parse(`
-	<!DOCTYPE html>
-	<html lang="en">
-	<head>
-		<meta charset="UTF-8">
-		<meta name="viewport" content="width=device-width, initial-scale=1.5">
-		<title>Nodelocker overview</title>
-		<style>
-			body {
-				font-family: Arial, sans-serif;
-				background-color: #f4f4f4;
-				margin: 0;
-				padding: 0;
-			}
-			.container {
-				max-width: 800px;
-				margin: 20px auto;
-				padding: 20px;
-				background-color: #fff;
-				border-radius: 8px;
-				box-shadow: 0 0 10px rgba(0, 0, 0, 0.1);
-			}
-			h1 {
-				text-align: center;
-			}
-			ul {
-				list-style: none;
-				padding: 0;
-			}
-			li {
-				margin-bottom: 5px;
+	res := new(x.WebResponse)
+	c := new(x.LockData)
+
+	c.Type = r.URL.Query().Get("type")
+	c.Name = r.URL.Query().Get("name")
+
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/hosts/"):
+		c.Type = x.C_TYPE_HOST
+		c.Name = chi.URLParam(r, "name")
+	case strings.HasPrefix(r.URL.Path, "/envs/"):
+		c.Type = x.C_TYPE_ENV
+		c.Name = chi.URLParam(r, "name")
+	}
+
+	// check 'type' defined in GET request
+	t := x.ValidateType(c.Type)
+	if t.IsError {
+
+		c.HttpErr = http.StatusBadRequest
+		res.Messages = append(res.Messages, x.ERR_WrongTypeSpecified)
+	}
+
+	// Check for missing entity name
+	if c.Name == "" {
+
+		c.HttpErr = http.StatusBadRequest
+		res.Messages = append(res.Messages, x.ERR_NoNameSpecified)
+	}
+
+	res.Type = c.Type
+	res.Name = c.Name
+
+	// on C_HTTP_OK look it up, public like the status pages
+	if c.HttpErr == x.C_HTTP_OK {
+
+		e, ok := x.EntityLookup(c.Type, c.Name)
+		if !ok {
+
+			c.HttpErr = http.StatusNotFound
+			res.Messages = append(res.Messages, x.ERR_NoSuchEntity)
+		} else {
+
+			byteData, err := json.MarshalIndent(e, "", "    ")
+			if err != nil {
+				http.Error(w, x.ERR_JsonConvertData, http.StatusInternalServerError)
+				return
 			}
-			.label {
-				font-weight: bold;
+
+			w.Header().Set("Content-Type", x.C_RespHeader)
+			w.WriteHeader(http.StatusOK)
+
+			if _, err := w.Write(byteData); err != nil {
+				http.Error(w, "Error writing response", http.StatusInternalServerError)
 			}
-		</style>
-	</head>
-	<body>
-		<div class="container">
-			<h1>🏗️ Environment and host overview 🏗️</h1>
-			<br><hr><br>
-			<div id="stats">
-				<ul>
-					<li><span class="label">Valid environments:</span>
-						<ul>{{range .ValidEnvs}}
-							<li><span class="value">✅ {{.}}</span></li>
-						{{end}}</ul>
-					</li>
-					<br>
-					<li><span class="label">Locked environments:</span>
-						<ul>{{range .LockedEnvs}}
-							<li><span class="value">🔒 {{.}}</span></li>
-						{{end}}</ul>
-					</li>
-					<br>
-					<li><span class="label">Environments in maintenance mode:</span>
-						<ul>{{range .MaintEnvs}}
-							<li><span class="value">🚧 {{.}}</span></li>
-						{{end}}</ul>
-					</li>
-					<br>
-					<li><span class="label">Terminated, unusable environments:</span>
-						<ul>{{range .TermdEnvs}}
-							<li><span class="value">❌ {{.}}</span></li>
-						{{end}}</ul>
-					</li>
-					<br><hr><br>
-					<li><span class="label"> Locked hosts:</span>
-						<ul>{{range .LockedHosts}}
-							<li><span class="value">🔒 {{.}}</span></li>
-						{{end}}</ul>
-					</li>
-				</ul>
-			</div>
-		</div>
-	</body>
-	</html>
-	`))
-
-	if err := tmpl.Execute(w, stats); err != nil {
+			return
+		}
+	}
+
+	returnWebResponse(w, c.HttpErr, res)
+}
+
+// Serves the dashboard, it loads /v2/status with the same query parameters.
+func webStatHandler(w http.ResponseWriter, r *http.Request) {
+
+	if _, errMsg := x.ParseStatusQuery(r.URL.Query()); errMsg != "" {
+		returnWebResponse(w, http.StatusBadRequest, &x.WebResponse{Messages: []string{errMsg}})
+		return
+	}
+
+	if err := x.ServeDashboard(w); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
+// Returns: the handler of the certificate of the local CA, for the clients to
+// trust
+func caHandler(cfg *x.Config) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		ca, ok := x.ReadCA(cfg)
+		if !ok {
+			returnWebResponse(w, http.StatusNotFound, &x.WebResponse{Messages: []string{x.ERR_NoLocalCA}})
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		w.Header().Set("Content-Disposition", `attachment; filename="nodelocker-ca.pem"`)
+		w.WriteHeader(http.StatusOK)
+
+		if _, err := w.Write(ca); err != nil {
+			http.Error(w, "Error writing response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// Checks the user and token of the dashboard.
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+
+	res := new(x.WebResponse)
+	c := new(x.LockData)
+
+	c.User, c.Token = x.RequestUser(r)
+
+	if !x.IsValidRequestUser(r, c.User, c.Token) {
+
+		c.HttpErr = http.StatusForbidden
+		res.Messages = append(res.Messages, x.ERR_IllegalUser)
+	}
+
+	res.User = c.User
+
+	if c.HttpErr == x.C_HTTP_OK {
+
+		res.Messages = append(res.Messages, x.OK_LoggedIn)
+	}
+
+	returnWebResponse(w, c.HttpErr, res)
+}
+
 func lockHandler(w http.ResponseWriter, r *http.Request) {
 
 	res := new(x.WebResponse)
@@ -132,9 +270,14 @@ func lockHandler(w http.ResponseWriter, r *http.Request) {
 
 	c.Type = r.URL.Query().Get("type")
 	c.Name = r.URL.Query().Get("name")
+	c.FirstDay = r.URL.Query().Get("firstday")
 	c.LastDay = r.URL.Query().Get("lastday")
-	c.User = r.URL.Query().Get("user")
-	c.Token = r.URL.Query().Get("token")
+	c.User, c.Token = x.RequestUser(r)
+	c.IP = x.GetRealIP(r)
+	c.For = r.URL.Query().Get("for")
+	forDuration := c.For
+	tz := r.URL.Query().Get("tz")
+	wait := r.URL.Query().Get("wait") == "true"
 
 	// Check if init sequence has been made when starting anything as normal user
 	if c.User != x.C_ADMIN {
@@ -160,43 +303,213 @@ func lockHandler(w http.ResponseWriter, r *http.Request) {
 		res.Messages = append(res.Messages, x.ERR_NoNameSpecified)
 	}
 
-	// trying to lock an env that contain locked host(s)
-	if c.Type == x.C_TYPE_ENV && x.IsEnvContainsHosts(c.Name) {
+	// TZ of the request, else of the user, sets the midnight of LASTDAY
+	loc, ok := x.ResolveTZ(c.User, tz)
+	if !ok {
 
-		c.HttpErr = http.StatusForbidden
-		res.Messages = append(res.Messages, x.ERR_LockedHostsInEnv)
+		c.HttpErr = http.StatusBadRequest
+		res.Messages = append(res.Messages, x.ERR_InvalidTZSpecified)
+		loc = x.DefaultTZ
+	} else {
+
+		res.TZ = loc.String()
 	}
 
-	// Is given LASTDAY is a valid date?
-	if !x.IsValidDate(c.LastDay) {
+	// Is given LASTDAY a valid date or timestamp, or FOR a valid duration?
+	if expire, ok := x.ParseExpiry(c.LastDay, forDuration, loc); ok {
+
+		x.SetExpiry(c, expire)
+	} else if forDuration != "" {
+
+		c.HttpErr = http.StatusBadRequest
+		res.Messages = append(res.Messages, x.ERR_InvalidForSpecified)
+	} else {
 
 		c.HttpErr = http.StatusBadRequest
 		res.Messages = append(res.Messages, x.ERR_InvalidDateSpecified)
 	}
 
+	// FIRSTDAY is optional, a future one books a reservation
+	if c.FirstDay != "" && !x.IsValidFirstDay(c.FirstDay, c.LastDay) {
+
+		c.HttpErr = http.StatusBadRequest
+		res.Messages = append(res.Messages, x.ERR_InvalidFirstDay)
+	}
+
 	// Is given user valid against DB user? Pwd checking too.
-	if !x.IsValidUser(c.User, c.Token) {
+	if !x.IsValidRequestUser(r, c.User, c.Token) {
 
 		c.HttpErr = http.StatusForbidden
 		res.Messages = append(res.Messages, x.ERR_IllegalUser)
 	}
 
-	// on C_HTTP_OK lock
+	// on C_HTTP_OK lock or book, or queue up for a busy entity on 'wait=true'
 	if c.HttpErr == x.C_HTTP_OK {
 
-		switch c.Type {
-		case x.C_TYPE_ENV:
+		switch {
+		case c.FirstDay > x.Today():
+			x.EntityReserve(c, res)
+		case wait:
+			x.LockOrQueue(c, res)
+		case c.Type == x.C_TYPE_ENV:
 			x.EnvLock(c, res)
-		case x.C_TYPE_HOST:
+		case c.Type == x.C_TYPE_HOST:
 			x.HostLock(c, res)
 		}
+	}
+
+	returnWebResponse(w, c.HttpErr, res)
+}
+
+func extendHandler(w http.ResponseWriter, r *http.Request) {
+
+	res := new(x.WebResponse)
+	c := new(x.LockData)
+
+	c.Type = r.URL.Query().Get("type")
+	c.Name = r.URL.Query().Get("name")
+	c.LastDay = r.URL.Query().Get("lastday")
+	c.User, c.Token = x.RequestUser(r)
+	c.IP = x.GetRealIP(r)
+	forDuration := r.URL.Query().Get("for")
+	tz := r.URL.Query().Get("tz")
+
+	// check 'type' defined in GET request
+	t := x.ValidateType(c.Type)
+	if t.IsError {
+
+		c.HttpErr = t.HttpErrCode
+		res.Messages = append(res.Messages, t.ErrorMessage)
+	}
+
+	// no 'name' defined in GET request
+	if c.Name == "" {
+
+		c.HttpErr = http.StatusBadRequest
+		res.Messages = append(res.Messages, x.ERR_NoNameSpecified)
+	}
+
+	// TZ of the request, else of the user, sets the midnight of LASTDAY
+	loc, ok := x.ResolveTZ(c.User, tz)
+	if !ok {
+
+		c.HttpErr = http.StatusBadRequest
+		res.Messages = append(res.Messages, x.ERR_InvalidTZSpecified)
+		loc = x.DefaultTZ
+	} else {
+
+		res.TZ = loc.String()
+	}
+
+	// Is the new LASTDAY a valid date or timestamp, or FOR a valid duration?
+	if expire, ok := x.ParseExpiry(c.LastDay, forDuration, loc); ok {
+
+		x.SetExpiry(c, expire)
+	} else if forDuration != "" {
+
+		c.HttpErr = http.StatusBadRequest
+		res.Messages = append(res.Messages, x.ERR_InvalidForSpecified)
+	} else {
+
+		c.HttpErr = http.StatusBadRequest
+		res.Messages = append(res.Messages, x.ERR_InvalidDateSpecified)
+	}
+
+	// Is given user valid against DB user? Pwd checking too.
+	if !x.IsValidRequestUser(r, c.User, c.Token) {
+
+		c.HttpErr = http.StatusForbidden
+		res.Messages = append(res.Messages, x.ERR_IllegalUser)
+	}
+
+	res.Type = c.Type
+	res.Name = c.Name
+	res.User = c.User
+
+	// on C_HTTP_OK push the expiry of the owner's lock forward
+	if c.HttpErr == x.C_HTTP_OK {
+
+		x.EntityExtend(c, res)
+	}
+
+	returnWebResponse(w, c.HttpErr, res)
+}
+
+func queueHandler(w http.ResponseWriter, r *http.Request) {
+
+	res := new(x.WebResponse)
+	c := new(x.LockData)
+
+	action := r.URL.Query().Get("action")
+	c.Type = r.URL.Query().Get("type")
+	c.Name = r.URL.Query().Get("name")
+	c.LastDay = r.URL.Query().Get("lastday")
+	c.User, c.Token = x.RequestUser(r)
+	c.IP = x.GetRealIP(r)
+	c.For = r.URL.Query().Get("for")
+	forDuration := c.For
+	tz := r.URL.Query().Get("tz")
+
+	// check 'type' defined in GET request
+	t := x.ValidateType(c.Type)
+	if t.IsError {
+
+		c.HttpErr = t.HttpErrCode
+		res.Messages = append(res.Messages, t.ErrorMessage)
+	}
+
+	// no 'name' defined in GET request
+	if c.Name == "" {
+
+		c.HttpErr = http.StatusBadRequest
+		res.Messages = append(res.Messages, x.ERR_NoNameSpecified)
+	}
+
+	// Is given LASTDAY or FOR valid? Only needed for joining.
+	if action == "join" {
+
+		loc, ok := x.ResolveTZ(c.User, tz)
+		if !ok {
+
+			c.HttpErr = http.StatusBadRequest
+			res.Messages = append(res.Messages, x.ERR_InvalidTZSpecified)
+		} else if expire, ok := x.ParseExpiry(c.LastDay, forDuration, loc); ok {
+
+			x.SetExpiry(c, expire)
+		} else {
 
-		if !x.ExpireEntity(c.Type+":"+c.Name, c.LastDay) {
 			c.HttpErr = http.StatusBadRequest
 			res.Messages = append(res.Messages, x.ERR_InvalidDateSpecified)
 		}
 	}
 
+	// Is given user valid against DB user? Pwd checking too.
+	if !x.IsValidRequestUser(r, c.User, c.Token) {
+
+		c.HttpErr = http.StatusForbidden
+		res.Messages = append(res.Messages, x.ERR_IllegalUser)
+	}
+
+	res.Type = c.Type
+	res.Name = c.Name
+	res.User = c.User
+
+	// on C_HTTP_OK do the action
+	if c.HttpErr == x.C_HTTP_OK {
+
+		switch action {
+		case "join": // Wait in line for the entity
+			x.EntityQueueJoin(c, res)
+		case "leave": // Give up waiting
+			x.EntityQueueLeave(c, res)
+		case "", "position": // Show the queue and the user's place in it
+			x.EntityQueueStatus(c, res)
+		default:
+			c.HttpErr = http.StatusBadRequest
+			res.Messages = append(res.Messages, x.ERR_IllegalAction)
+		}
+	}
+
 	returnWebResponse(w, c.HttpErr, res)
 }
 
@@ -207,8 +520,9 @@ func unlockHandler(w http.ResponseWriter, r *http.Request) {
 
 	c.Type = r.URL.Query().Get("type")
 	c.Name = r.URL.Query().Get("name")
-	c.User = r.URL.Query().Get("user")
-	c.Token = r.URL.Query().Get("token")
+	c.FirstDay = r.URL.Query().Get("firstday")
+	c.User, c.Token = x.RequestUser(r)
+	c.IP = x.GetRealIP(r)
 
 	// Check if init sequence has been made when starting anything as normal user
 	if c.User != x.C_ADMIN {
@@ -234,21 +548,21 @@ func unlockHandler(w http.ResponseWriter, r *http.Request) {
 		res.Messages = append(res.Messages, x.ERR_NoNameSpecified)
 	}
 
-	if !x.IsValidUser(c.User, c.Token) {
+	if !x.IsValidRequestUser(r, c.User, c.Token) {
 
 		c.HttpErr = http.StatusForbidden
 		res.Messages = append(res.Messages, x.ERR_IllegalUser)
 	}
 
-	if !x.REntityDelete(c.Type, c.Name) {
-
-		c.HttpErr = http.StatusForbidden
-		res.Messages = append(res.Messages, "ERR: EntityDelete failed !!!")
-
-	} else {
+	// on C_HTTP_OK unlock, locked hosts of the env are kept in sync, or
+	// cancel the reservation starting on FIRSTDAY
+	if c.HttpErr == x.C_HTTP_OK {
 
-		c.HttpErr = http.StatusOK
-		res.Messages = append(res.Messages, "")
+		if c.FirstDay != "" {
+			x.EntityCancelReservation(c, res)
+		} else {
+			x.EntityUnlock(c, res)
+		}
 	}
 
 	returnWebResponse(w, c.HttpErr, res)
@@ -276,6 +590,10 @@ func regHandler(w http.ResponseWriter, r *http.Request) {
 
 		c.HttpErr = http.StatusBadRequest
 		res.Messages = append(res.Messages, x.ERR_NoUserSpecified)
+	} else if !x.IsValidUserName(c.User) {
+
+		c.HttpErr = http.StatusBadRequest
+		res.Messages = append(res.Messages, x.ERR_InvalidUserName)
 	} else {
 		res.User = c.User
 	}
@@ -303,7 +621,7 @@ func regHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if !x.RSetSingle("user", c.User, hashedPassword, 0) {
+		if !x.DB.SetSingle("user", c.User, hashedPassword) {
 
 			c.HttpErr = http.StatusInternalServerError
 			res.Messages = append(res.Messages, x.ERR_UserSetupFailed)
@@ -317,6 +635,115 @@ func regHandler(w http.ResponseWriter, r *http.Request) {
 	returnWebResponse(w, c.HttpErr, res)
 }
 
+func tzHandler(w http.ResponseWriter, r *http.Request) {
+
+	res := new(x.WebResponse)
+	c := new(x.LockData)
+
+	c.User, c.Token = x.RequestUser(r)
+	tz := r.URL.Query().Get("tz")
+
+	// Is given user valid against DB user? Pwd checking too.
+	if !x.IsValidRequestUser(r, c.User, c.Token) {
+
+		c.HttpErr = http.StatusForbidden
+		res.Messages = append(res.Messages, x.ERR_IllegalUser)
+	}
+
+	res.User = c.User
+
+	// on C_HTTP_OK set the user's own timezone, empty 'tz' resets it
+	if c.HttpErr == x.C_HTTP_OK {
+
+		x.UserSetTZ(c, tz, res)
+	}
+
+	returnWebResponse(w, c.HttpErr, res)
+}
+
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+
+	res := new(x.WebResponse)
+	c := new(x.LockData)
+
+	c.Type = r.URL.Query().Get("type")
+	c.Name = r.URL.Query().Get("name")
+	c.User = r.URL.Query().Get("user")
+
+	// check 'type' if defined in GET request
+	if c.Type != "" && c.Type != x.C_TYPE_USER && x.ValidateType(c.Type).IsError {
+
+		c.HttpErr = http.StatusBadRequest
+		res.Messages = append(res.Messages, x.ERR_WrongTypeSpecified)
+	}
+
+	// Is given SINCE valid?
+	since, ok := x.ParseSince(r.URL.Query().Get("since"))
+	if !ok {
+
+		c.HttpErr = http.StatusBadRequest
+		res.Messages = append(res.Messages, x.ERR_InvalidSince)
+	}
+
+	res.Type = c.Type
+	res.Name = c.Name
+	res.User = c.User
+
+	// on C_HTTP_OK list the events, public like the status pages
+	if c.HttpErr == x.C_HTTP_OK {
+
+		x.EntityHistory(c.Type, c.Name, c.User, since, res)
+	}
+
+	returnWebResponse(w, c.HttpErr, res)
+}
+
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+
+	res := new(x.WebResponse)
+	c := new(x.LockData)
+
+	f := x.EventFilter{
+		Events: x.SplitList(r.URL.Query().Get("events")),
+		Envs:   x.SplitList(r.URL.Query().Get("env")),
+		Hosts:  x.SplitList(r.URL.Query().Get("host")),
+		Users:  x.SplitList(r.URL.Query().Get("user")),
+	}
+
+	// reconnecting EventSource sends the header, others may use 'lastid'
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("lastid")
+	}
+
+	if !x.IsValidActions(f.Events) {
+
+		c.HttpErr = http.StatusBadRequest
+		res.Messages = append(res.Messages, x.ERR_InvalidEvents)
+	}
+
+	// Is given LASTID valid?
+	lastID := int64(0)
+	if lastEventID != "" {
+		id, err := strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil || id < 0 {
+
+			c.HttpErr = http.StatusBadRequest
+			res.Messages = append(res.Messages, x.ERR_InvalidLastEventID)
+		}
+		lastID = id
+	}
+
+	// on C_HTTP_OK stream the events, public like the status pages
+	if c.HttpErr == x.C_HTTP_OK {
+
+		x.StreamEvents(w, r, f, lastID)
+		return
+	}
+
+	returnWebResponse(w, c.HttpErr, res)
+}
+
 func adminHandler(w http.ResponseWriter, r *http.Request) {
 
 	res := new(x.WebResponse)
@@ -326,13 +753,29 @@ func adminHandler(w http.ResponseWriter, r *http.Request) {
 	c.Name = r.URL.Query().Get("name")
 	adminToken := r.URL.Query().Get("token")
 
-	if adminToken == "" || !x.IsValidUser(x.C_ADMIN, adminToken) {
+	switch action {
+	case "host-unlock":
+		c.Type = x.C_TYPE_HOST
+	case "user-purge":
+		c.Type = x.C_TYPE_USER
+	default:
+		c.Type = x.C_TYPE_ENV
+	}
+	c.User = x.C_ADMIN
+	c.IP = x.GetRealIP(r)
+
+	// the entity before the action, for the history, as the store operation
+	// found it, nil for the actions leaving the lock state alone
+	var prev *x.LockData
+	var ok bool
+
+	if !x.IsAdminRequest(r, adminToken) {
 		c.HttpErr = http.StatusForbidden
 		res.Messages = append(res.Messages, x.ERR_IllegalUser)
 
 	} else if action == "user-purge" { // Purge a user which probably forgot their password
 
-		if x.REntityDelete("user", c.Name) {
+		if x.DB.EntityDelete("user", c.Name) && x.DB.EntityDelete(x.C_USER_TZ, c.Name) {
 			c.HttpErr = http.StatusOK
 			res.Messages = append(res.Messages, x.OK_UserPurged)
 		} else {
@@ -342,7 +785,7 @@ func adminHandler(w http.ResponseWriter, r *http.Request) {
 
 	} else if action == "env-create" { // Add a new environment
 
-		if x.EnvCreate(c.Name) {
+		if ok, prev = x.EnvCreate(c.Name); ok {
 			c.HttpErr = http.StatusOK
 			res.Messages = append(res.Messages, x.OK_EnvCreated)
 		} else {
@@ -350,9 +793,23 @@ func adminHandler(w http.ResponseWriter, r *http.Request) {
 			res.Messages = append(res.Messages, x.ERR_EnvCreationFail)
 		}
 
+	} else if action == "env-maxlock" { // Limit the total duration of locks in an env
+
+		max, err := time.ParseDuration(r.URL.Query().Get("max"))
+		if err != nil || max < 0 {
+			c.HttpErr = http.StatusBadRequest
+			res.Messages = append(res.Messages, x.ERR_InvalidMaxLock)
+		} else if x.EnvSetMaxLock(c.Name, max) {
+			c.HttpErr = http.StatusOK
+			res.Messages = append(res.Messages, x.OK_EnvSetMaxLock)
+		} else {
+			c.HttpErr = http.StatusForbidden
+			res.Messages = append(res.Messages, x.ERR_EnvSetMaxLockFail)
+		}
+
 	} else if action == "env-unlock" { // Unlock an env from maintenance or terminate state
 
-		if x.EnvUnlock(c.Name) {
+		if ok, prev = x.EnvUnlock(c.Name); ok {
 			c.HttpErr = http.StatusOK
 			res.Messages = append(res.Messages, x.OK_EnvUnlocked)
 		} else {
@@ -362,7 +819,7 @@ func adminHandler(w http.ResponseWriter, r *http.Request) {
 
 	} else if action == "env-maintenance" { // Setup an env for maintenance
 
-		if x.EnvMaintenance(c.Name) {
+		if ok, prev = x.EnvMaintenance(c.Name); ok {
 			c.HttpErr = http.StatusOK
 			c.State = x.C_STATE_MAINTENANCE
 			res.Messages = append(res.Messages, x.OK_EnvSetToMaintenance)
@@ -373,7 +830,7 @@ func adminHandler(w http.ResponseWriter, r *http.Request) {
 
 	} else if action == "env-terminate" { // Lock an env indefinately
 
-		if x.EnvTerminate(c.Name) {
+		if ok, prev = x.EnvTerminate(c.Name); ok {
 			c.HttpErr = http.StatusOK
 			c.State = x.C_STATE_TERMINATED
 			res.Messages = append(res.Messages, x.OK_EnvSetToTerminate)
@@ -384,7 +841,7 @@ func adminHandler(w http.ResponseWriter, r *http.Request) {
 
 	} else if action == "host-unlock" { // Unlock a stuck, locked host
 
-		if x.HostUnlock(c.Name) {
+		if ok, prev = x.HostUnlock(c.Name); ok {
 			c.HttpErr = http.StatusOK
 			res.Messages = append(res.Messages, x.OK_HostUnlocked)
 		} else {
@@ -392,9 +849,71 @@ func adminHandler(w http.ResponseWriter, r *http.Request) {
 			res.Messages = append(res.Messages, x.ERR_HostUnlockFail)
 		}
 
+	} else if action == "webhook-set" { // Add or replace an outgoing webhook
+
+		h := x.Webhook{
+			Name:   c.Name,
+			URL:    r.URL.Query().Get("url"),
+			Secret: r.URL.Query().Get("secret"),
+			EventFilter: x.EventFilter{
+				Events: x.SplitList(r.URL.Query().Get("events")),
+				Envs:   x.SplitList(r.URL.Query().Get("envs")),
+				Hosts:  x.SplitList(r.URL.Query().Get("hosts")),
+				Users:  x.SplitList(r.URL.Query().Get("users")),
+			},
+		}
+
+		if h.Name == "" {
+			c.HttpErr = http.StatusBadRequest
+			res.Messages = append(res.Messages, x.ERR_NoNameSpecified)
+		} else if !x.IsValidWebhookURL(h.URL) {
+			c.HttpErr = http.StatusBadRequest
+			res.Messages = append(res.Messages, x.ERR_InvalidWebhookURL)
+		} else if !x.IsValidActions(h.Events) {
+			c.HttpErr = http.StatusBadRequest
+			res.Messages = append(res.Messages, x.ERR_InvalidEvents)
+		} else if x.WebhookSet(h) {
+			c.HttpErr = http.StatusOK
+			res.Messages = append(res.Messages, x.OK_WebhookSet)
+		} else {
+			c.HttpErr = http.StatusInternalServerError
+			res.Messages = append(res.Messages, x.ERR_WebhookFail)
+		}
+
+	} else if action == "webhook-delete" { // Remove an outgoing webhook
+
+		if x.WebhookDelete(c.Name) {
+			c.HttpErr = http.StatusOK
+			res.Messages = append(res.Messages, x.OK_WebhookDeleted)
+		} else {
+			c.HttpErr = http.StatusNotFound
+			res.Messages = append(res.Messages, x.ERR_NoSuchWebhook)
+		}
+
+	} else if action == "webhook-list" { // Show the outgoing webhooks without their secrets
+
+		res.Webhooks = x.WebhookList()
+		for i := range res.Webhooks {
+			res.Webhooks[i].Secret = ""
+		}
+		c.HttpErr = http.StatusOK
+		res.Messages = append(res.Messages, x.OK_Webhooks)
+
 	} else {
 		c.HttpErr = http.StatusInternalServerError
-		res.Messages = append(res.Messages, "ERR: Illegal 'action' parameter")
+		res.Messages = append(res.Messages, x.ERR_IllegalAction)
+	}
+
+	// record the entity actions, then hand the released entity over to its
+	// queue, or drop the queue of an env taken away
+	if c.HttpErr == http.StatusOK && !strings.HasPrefix(action, "webhook-") {
+
+		x.RecordChange(action, c, prev)
+
+		switch action {
+		case "env-unlock", "host-unlock", "env-maintenance", "env-terminate":
+			x.PromoteQueue(c.Type, c.Name)
+		}
 	}
 
 	returnWebResponse(w, c.HttpErr, res)
@@ -431,40 +950,147 @@ func returnWebResponse(w http.ResponseWriter, httpErr int, retData *x.WebRespons
 
 func main() {
 
-	x.RConn = redis.NewClient(&redis.Options{
-		Addr:     "localhost:6379",
-		Password: "",
-		DB:       0,
-	})
+	cfg, err := x.LoadConfig(os.Args[1:], os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	} else if err != nil {
+		fmt.Printf("%s Wrong configuration, exitting...\n", x.C_FAILED)
+		log.Fatal(err.Error())
+	}
+
+	if cfg.PrintConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			log.Fatal(err.Error())
+		}
+		return
+	}
 
-	errDb := x.RConn.Ping().Err()
+	if cfg.ExportCA {
+		ca, err := x.ExportCA(cfg)
+		if err != nil {
+			fmt.Printf("%s Cannot export the local CA, exitting...\n", x.C_FAILED)
+			log.Fatal(err.Error())
+		}
+		if _, err := os.Stdout.Write(ca); err != nil {
+			log.Fatal(err.Error())
+		}
+		return
+	}
+
+	if err := cfg.Apply(); err != nil {
+		fmt.Printf("%s Cannot apply the configuration, exitting...\n", x.C_FAILED)
+		log.Fatal(err.Error())
+	}
+
+	// checked by LoadConfig already
+	remindWindows, _ := x.ParseRemindWindows(cfg.Remind)
+	notifier, _ := x.NewNotifier(cfg.Notifier)
+
+	var errDb error
+	x.DB, errDb = x.NewStore(cfg)
+	if errDb != nil {
+		log.Fatal(errDb.Error())
+	}
+
+	errDb = x.DB.Ping()
 	if errDb == nil {
-		fmt.Println(x.C_SUCCESS + " Redis check OK")
+		fmt.Printf("%s Store check OK (%s)\n", x.C_SUCCESS, cfg.Store)
 	} else {
-		fmt.Println(x.C_FAILED + " Redis is not available, exitting...")
+		fmt.Printf("%s Store '%s' is not available, exitting...\n", x.C_FAILED, cfg.Store)
+		log.Fatal(errDb.Error())
+	}
+
+	// indexes are built once for data written by older versions
+	rebuilt, errDb := x.MigrateIndexes(cfg.RebuildIndexes)
+	if errDb != nil {
+		fmt.Printf("%s Cannot build the indexes\n", x.C_FAILED)
 		log.Fatal(errDb.Error())
+	} else if rebuilt {
+		fmt.Println(x.C_SUCCESS + " Indexes have been rebuilt")
 	}
 
+	// the webhooks are notified of the recorded events
+	x.OnEvent(x.QueueWebhooks)
+	// and the clients of /events
+	x.OnEvent(x.PublishEvent)
+
+	// the background runners stop with the server
+	stop := make(chan struct{})
+	var runners sync.WaitGroup
+	run := func(runner func()) {
+		runners.Add(1)
+		go func() {
+			defer runners.Done()
+			runner()
+		}()
+	}
+
+	// hands over the queued entities whose lock ran out
+	run(func() { x.RunQueuePromoter(x.C_QUEUE_INTERVAL, stop) })
+	// turns the reservations into locks on their first day
+	run(func() { x.RunReservationScheduler(x.C_RESERVATION_INTERVAL, stop) })
+	// records the locks which ran out
+	run(func() { x.RunExpiryWatcher(x.C_SWEEP_PERIOD, stop) })
+	// drops the events out of the retention of the history
+	run(func() { x.RunHistoryPruner(x.C_PRUNE_PERIOD, cfg.HistoryMaxAge, stop) })
+	// sends the webhook deliveries
+	run(func() { x.RunWebhookDispatcher(x.C_WEBHOOK_INTERVAL, stop) })
+	// reminds the owners of the locks running out
+	run(func() { x.RunReminderScheduler(x.C_REMIND_INTERVAL, notifier, cfg.PublicURL, remindWindows, stop) })
+
 	r := chi.NewRouter()
 
 	r.Use(middleware.Logger)
 	r.Use(x.RateLimitMiddleware) // Add rate limiting middleware
-
-	r.Get("/status/json", jsonStatHandler)
+	r.Use(x.ClientCertMiddleware(cfg))
+
+	r.Get("/status", statusHandler(""))
+	r.Get("/status/json", statusHandler(x.C_FORMAT_JSON))
+	r.Get("/status/yaml", statusHandler(x.C_FORMAT_YAML))
+	r.Get("/status/csv", statusHandler(x.C_FORMAT_CSV))
+	r.Get("/status/text", statusHandler(x.C_FORMAT_TEXT))
+	r.Get("/metrics", statusHandler(x.C_FORMAT_PROMETHEUS))
 	r.Get("/status/web", webStatHandler)
+	r.Handle("/ui/*", http.StripPrefix("/ui/", x.WebAssets()))
+	r.Get("/login", loginHandler)
+	r.Get("/ca.pem", caHandler(cfg))
+	r.Get("/v2/status", jsonStatusV2Handler)
+	r.Get("/entity", entityHandler)
+	r.Get("/hosts/{name}", entityHandler)
+	r.Get("/envs/{name}", entityHandler)
 	r.Get("/lock", lockHandler)
 	r.Get("/unlock", unlockHandler)
+	r.Get("/extend", extendHandler)
+	r.Get("/queue", queueHandler)
 	r.Get("/register", regHandler)
+	r.Get("/timezone", tzHandler)
+	r.Get("/history", historyHandler)
+	r.Get("/events", eventsHandler)
 	r.Get("/admin", adminHandler)
 
 	http.Handle("/", r)
 
-	if x.C_TLS_ENABLED {
-		x.ServeTLS(r)
-	} else {
-		err := http.ListenAndServe("0.0.0.0:3000", r)
+	server := x.NewServer(r, cfg)
+	if cfg.TLS {
+		server, err = x.NewTLSServer(r, cfg, stop, &runners)
 		if err != nil {
-			log.Fatal("ListenAndServe: ", err)
+			fmt.Printf("%s Cannot set up TLS, exitting...\n", x.C_FAILED)
+			log.Fatal(err.Error())
 		}
 	}
+
+	errServe := x.Serve(server, cfg)
+
+	close(stop)
+	runners.Wait()
+
+	if err := x.DB.Close(); err != nil {
+		fmt.Printf("%s Cannot close the store: %s\n", x.C_FAILED, err)
+	}
+
+	if errServe != nil {
+		fmt.Printf("%s Server error, exitting...\n", x.C_FAILED)
+		log.Fatal(errServe.Error())
+	}
+	fmt.Printf("%s Server stopped\n", x.C_SUCCESS)
 }
@@ -4,7 +4,14 @@ go 1.21.6
 
 require github.com/go-redis/redis v6.15.9+incompatible
 
-require golang.org/x/crypto v0.0.0-20220622213112-05595931fe9d
+require (
+	github.com/BurntSushi/toml v1.5.0
+	go.etcd.io/bbolt v1.3.10
+	golang.org/x/crypto v0.0.0-20220622213112-05595931fe9d
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require golang.org/x/sys v0.15.0 // indirect
 
 require (
 	github.com/go-chi/chi/v5 v5.0.11
@@ -0,0 +1,273 @@
+// Dashboard of nodelocker: the status from /v2/status, refreshed by the
+// events of /events, the actions through /lock, /unlock and /extend.
+"use strict";
+
+// the actions of the history, see eventActions
+const EVENTS = [
+	"lock", "unlock", "extend", "expire", "user-purge",
+	"env-create", "env-maxlock", "env-unlock", "env-maintenance",
+	"env-terminate", "host-unlock",
+];
+const REFRESH_MS = 60000; // reservations starting and ending don't send events
+const SOON_SECONDS = 3600; // countdowns turn red below this
+
+const $ = (id) => document.getElementById(id);
+
+let status = { envs: [], hosts: [] };
+let refreshTimer = null;
+
+// the user and token are kept for the tab only
+function session() {
+	const user = sessionStorage.getItem("user");
+	const token = sessionStorage.getItem("token");
+	return user && token ? { user, token } : null;
+}
+
+function showMessage(text, isError) {
+	const m = $("message");
+	m.textContent = text;
+	m.classList.toggle("error", isError);
+	m.hidden = false;
+}
+
+async function call(path, params) {
+	const resp = await fetch(path + "?" + new URLSearchParams(params));
+	const body = await resp.json().catch(() => ({ success: false, messages: [resp.statusText] }));
+	return { ok: resp.ok && body.success, messages: body.messages || [] };
+}
+
+function showSession() {
+	const s = session();
+	$("login").hidden = !!s;
+	$("session").hidden = !s;
+	$("lock-host").hidden = !s;
+	$("session-user").textContent = s ? s.user : "";
+	render();
+}
+
+async function login(ev) {
+	ev.preventDefault();
+	const user = $("login-user").value.trim();
+	const token = $("login-token").value;
+	const res = await call("/login", { user, token });
+	if (!res.ok) {
+		showMessage(res.messages.join(" "), true);
+		return;
+	}
+	sessionStorage.setItem("user", user);
+	sessionStorage.setItem("token", token);
+	$("login-token").value = "";
+	$("message").hidden = true;
+	showSession();
+}
+
+function logout() {
+	sessionStorage.removeItem("user");
+	sessionStorage.removeItem("token");
+	showSession();
+}
+
+async function act(action, type, name) {
+	const s = session();
+	if (!s) {
+		return;
+	}
+	const params = { type, name, user: s.user, token: s.token };
+	if (action !== "unlock") {
+		params.for = $("duration").value.trim();
+	}
+	const res = await call("/" + action, params);
+	showMessage(res.messages.join(" "), !res.ok);
+	scheduleLoad(0);
+}
+
+async function load() {
+	try {
+		const resp = await fetch("/v2/status" + location.search);
+		const body = await resp.json();
+		if (!resp.ok) {
+			showMessage((body.messages || [resp.statusText]).join(" "), true);
+			return;
+		}
+		body.received = Date.now();
+		status = body;
+		render();
+	} catch (err) {
+		showMessage("Cannot load the status: " + err, true);
+	}
+}
+
+// several events in a row load the status once
+function scheduleLoad(delay) {
+	clearTimeout(refreshTimer);
+	refreshTimer = setTimeout(() => {
+		load();
+		scheduleLoad(REFRESH_MS);
+	}, delay);
+}
+
+function formatLeft(seconds) {
+	if (seconds <= 0) {
+		return "expired";
+	}
+	const d = Math.floor(seconds / 86400);
+	const h = Math.floor((seconds % 86400) / 3600);
+	const m = Math.floor((seconds % 3600) / 60);
+	const s = Math.floor(seconds % 60);
+	if (d > 0) {
+		return `${d}d ${h}h`;
+	}
+	if (h > 0) {
+		return `${h}h ${m}m`;
+	}
+	return `${m}m ${s}s`;
+}
+
+function updateCountdowns() {
+	for (const el of document.querySelectorAll(".countdown")) {
+		const left = (Number(el.dataset.expireAt) - Date.now()) / 1000;
+		el.textContent = formatLeft(left);
+		el.classList.toggle("soon", left < SOON_SECONDS);
+	}
+}
+
+function cell(row, content) {
+	const td = document.createElement("td");
+	if (content instanceof Node) {
+		td.appendChild(content);
+	} else if (content !== undefined) {
+		td.textContent = content;
+	}
+	row.appendChild(td);
+	return td;
+}
+
+function button(label, onClick) {
+	const b = document.createElement("button");
+	b.type = "button";
+	b.textContent = label;
+	b.addEventListener("click", onClick);
+	return b;
+}
+
+function entityRow(e) {
+	const tr = document.createElement("tr");
+	tr.className = e.type;
+
+	cell(tr, e.name);
+
+	const badge = document.createElement("span");
+	if (e.state) {
+		badge.className = "badge " + e.state;
+		badge.textContent = e.state;
+	}
+	cell(tr, badge);
+
+	cell(tr, e.owner || "");
+
+	const left = document.createElement("span");
+	if (e.state === "locked") {
+		left.className = "countdown";
+		left.dataset.expireAt = status.received + e.ttl * 1000;
+		left.title = e.expire;
+	}
+	cell(tr, left);
+
+	const reservations = document.createElement("span");
+	for (const r of e.reservations || []) {
+		const item = document.createElement("span");
+		item.className = "reservation";
+		item.textContent = `🗓️ ${r.user}: ${r.firstday} – ${r.lastday}`;
+		reservations.appendChild(item);
+	}
+	cell(tr, reservations);
+
+	const actions = cell(tr);
+	actions.className = "actions";
+	const s = session();
+	if (s && e.state === "valid") {
+		actions.appendChild(button("Lock", () => act("lock", e.type, e.name)));
+	}
+	if (s && e.state === "locked" && e.owner === s.user) {
+		actions.appendChild(button("Extend", () => act("extend", e.type, e.name)));
+		actions.appendChild(button("Unlock", () => act("unlock", e.type, e.name)));
+	}
+
+	return tr;
+}
+
+function matches(e, search, state) {
+	const text = (e.name + " " + (e.owner || "")).toLowerCase();
+	return text.includes(search) && (!state || e.state === state);
+}
+
+function render() {
+	const search = $("search").value.trim().toLowerCase();
+	const state = $("state").value;
+
+	// the hosts grouped under their envs, those of the envs not listed
+	// under a bare env row
+	const groups = new Map();
+	for (const env of status.envs || []) {
+		groups.set(env.name, { env, hosts: [] });
+	}
+	for (const host of status.hosts || []) {
+		if (!groups.has(host.parent)) {
+			groups.set(host.parent, { env: { name: host.parent, type: "env" }, hosts: [] });
+		}
+		groups.get(host.parent).hosts.push(host);
+	}
+
+	const tbody = document.querySelector("#entities tbody");
+	tbody.replaceChildren();
+
+	const names = [...groups.keys()].sort();
+	for (const name of names) {
+		const { env, hosts } = groups.get(name);
+		const envMatches = matches(env, search, state);
+		const shown = hosts.filter((h) => matches(h, search, state) ||
+			(envMatches && !state));
+		if (!envMatches && shown.length === 0) {
+			continue;
+		}
+		tbody.appendChild(entityRow(env));
+		for (const host of shown) {
+			tbody.appendChild(entityRow(host));
+		}
+	}
+
+	$("empty").hidden = tbody.children.length > 0;
+	updateCountdowns();
+}
+
+function listen() {
+	const live = $("live");
+	const source = new EventSource("/events");
+	source.onopen = () => {
+		live.textContent = "● live";
+		live.classList.add("on");
+	};
+	source.onerror = () => {
+		live.textContent = "○ reconnecting";
+		live.classList.remove("on");
+	};
+	for (const action of EVENTS) {
+		source.addEventListener(action, () => scheduleLoad(300));
+	}
+}
+
+document.addEventListener("DOMContentLoaded", () => {
+	$("login").addEventListener("submit", login);
+	$("logout").addEventListener("click", logout);
+	$("lock-host").addEventListener("submit", (ev) => {
+		ev.preventDefault();
+		act("lock", "host", $("lock-host-name").value.trim());
+	});
+	$("search").addEventListener("input", render);
+	$("state").addEventListener("change", render);
+
+	showSession();
+	scheduleLoad(0);
+	listen();
+	setInterval(updateCountdowns, 1000);
+});
@@ -1,10 +1,12 @@
 package x
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"regexp"
+	"strconv"
 	"time"
 )
 
@@ -62,11 +64,12 @@ import (
 
 // Wants: a string containing a date in YYYYMMDD format
 //
-// Returns: time from now till the last second of YYYYMMMDD specified date
+// Returns: time from now till the last second of YYYYMMMDD specified date,
+// in the server's default timezone
 func GetTimeFromNow(yyyymmdd string) time.Duration {
 
 	// Parse the YYYYMMDD formatted datetime string into a time.Time object
-	date, err := time.Parse("20060102", yyyymmdd)
+	date, err := time.ParseInLocation("20060102", yyyymmdd, DefaultTZ)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -81,6 +84,90 @@ func GetTimeFromNow(yyyymmdd string) time.Duration {
 	return duration
 }
 
+// Wants: a lastday in YYYYMMDD or RFC 3339 format, or a duration like
+// 2h30m in forDuration, which wins if both are given, the timezone whose
+// midnight a YYYYMMDD lastday refers to
+//
+// Returns: the exact instant of the expiry in `loc`, `false` if it's not
+// valid or not in the future
+func ParseExpiry(lastDay string, forDuration string, loc *time.Location) (time.Time, bool) {
+
+	var expire time.Time
+
+	if forDuration != "" {
+		d, err := time.ParseDuration(forDuration)
+		if err != nil {
+			return time.Time{}, false
+		}
+		expire = time.Now().Add(d).Truncate(time.Second).In(loc)
+	} else if t, ok := parseLastDay(lastDay, loc); ok {
+		expire = t
+	} else {
+		return time.Time{}, false
+	}
+
+	if !expire.After(time.Now()) {
+		return time.Time{}, false
+	}
+
+	return expire, true
+}
+
+// Wants: a lastday in YYYYMMDD or RFC 3339 format, the timezone whose
+// midnight a YYYYMMDD lastday refers to
+//
+// Returns: the exact instant of the expiry in `loc`, past ones too, `false`
+// if it's not valid
+func parseLastDay(lastDay string, loc *time.Location) (time.Time, bool) {
+
+	// legacy format, expires at the first second of the next day
+	if IsValidDate(lastDay) {
+		date, _ := time.ParseInLocation("20060102", lastDay, loc)
+		return date.AddDate(0, 0, 1), true
+	}
+
+	t, err := time.Parse(time.RFC3339, lastDay)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return t.Truncate(time.Second).In(loc), true
+}
+
+// Wants: LockData to fill, exact instant of the expiry
+//
+// Sets Expire and the LastDay the expiry falls on, both in the timezone of
+// `expire`.
+func SetExpiry(c *LockData, expire time.Time) {
+
+	c.Expire = expire.Format(time.RFC3339)
+	c.LastDay = expire.Add(-time.Second).Format("20060102")
+}
+
+// Wants: LockData with Expire or a LastDay
+//
+// Returns: the exact instant of the expiry, now if there is none
+func GetExpiry(c *LockData) time.Time {
+
+	if t, err := time.Parse(time.RFC3339, c.Expire); err == nil {
+		return t
+	}
+
+	if t, ok := parseLastDay(c.LastDay, DefaultTZ); ok {
+		return t
+	}
+
+	return time.Now()
+}
+
+// Wants: n/a
+//
+// Returns: today's date in YYYYMMDD format, in the server's default timezone
+func Today() string {
+
+	return time.Now().In(DefaultTZ).Format("20060102")
+}
+
 // Wants: a string with YYYYMMDD date
 //
 // Returns: `true` if that date is a valid date
@@ -118,20 +205,32 @@ func IsValidDate(dateParam string) bool {
 	return true
 }
 
-// Wants: `env|host:name` key in Redis, expire date in YYYYMMDD
+// Wants: YYYYMMDD first and last day of a reservation
 //
-// Returns: `true` on success
-func ExpireEntity(entity string, expireAt string) bool {
+// Returns: `true` if the first day is a valid date not after the last day
+func IsValidFirstDay(firstDay string, lastDay string) bool {
 
-	if !IsValidDate(expireAt) { //
-		return false
+	return IsValidDate(firstDay) && firstDay <= lastDay
+}
+
+// Wants: `true` to rebuild the indexes even if they are up to date
+//
+// Returns: `true` if the indexes have been rebuilt
+func MigrateIndexes(force bool) (bool, error) {
+
+	if !force && DB.GetSingle(C_META, "indexversion") == C_INDEX_VERSION {
+		return false, nil
 	}
 
-	if !RSetExpire(entity, GetTimeFromNow(expireAt)) {
-		return false
+	if err := DB.RebuildIndexes(); err != nil {
+		return false, err
 	}
 
-	return true
+	if !DB.SetSingle(C_META, "indexversion", C_INDEX_VERSION) {
+		return false, errors.New("cannot save the index version")
+	}
+
+	return true, nil
 }
 
 // Wants: a string which should be C_TYPE_ENV or C_TYPE_HOST
@@ -160,6 +259,18 @@ func ValidateType(t string) *RichErrorStatus {
 	}
 }
 
+// userNameRegex matches the names of the new users, they end up in mail
+// addresses and headers
+var userNameRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// Wants: username
+//
+// Returns: `true` if a new user can be registered with this name
+func IsValidUserName(userName string) bool {
+
+	return userNameRegex.MatchString(userName)
+}
+
 // Wants: username
 //
 // Returns: `true` if user exists
@@ -169,9 +280,7 @@ func IsExistingUser(userName string) bool {
 		fmt.Println("IsExistingUser <<", userName)
 	}
 
-	_, err := RConn.HGet("user", userName).Result()
-
-	if err == nil {
+	if DB.GetSingle("user", userName) != nil {
 		if DEBUG {
 			fmt.Println("IsExistingUser >>", true)
 		}
@@ -192,15 +301,15 @@ func IsValidUser(userName string, userToken string) bool {
 		fmt.Println("IsValidUser <<", userName)
 	}
 
-	redisPwd, err := RConn.HGet("user", userName).Result()
+	redisPwd, _ := DB.GetSingle("user", userName).(string)
 
-	if err == nil && len(redisPwd) > 0 {
+	if len(redisPwd) > 0 {
 		// found user & password
 		if CheckPassword(userToken, redisPwd) {
 			// If using old hash format, upgrade to bcrypt
 			if NeedsUpgrade(redisPwd) {
 				if newHash, err := HashPassword(userToken); err == nil {
-					RSetSingle("user", userName, newHash, 0)
+					DB.SetSingle("user", userName, newHash)
 				}
 			}
 			if DEBUG {
@@ -250,33 +359,55 @@ func GetEnvFromHost(hostName string) string {
 	return ret
 }
 
-func EnvCreate(envName string) bool {
+// Wants: environment name
+//
+// Returns: `true` if the env was written, the env as it was before
+func EnvCreate(envName string) (bool, *LockData) {
+
+	c := new(LockData)
+	c.Type = C_TYPE_ENV
+	c.Name = envName
+	c.State = C_STATE_VALID
+	return DB.LockSetter(c)
+}
+
+// Wants: environment name
+//
+// Returns: `true` if the env was missing and got created, an env written
+// meanwhile, e.g. locked or terminated, is left alone
+func EnvRestore(envName string) bool {
 
 	c := new(LockData)
 	c.Type = C_TYPE_ENV
 	c.Name = envName
 	c.State = C_STATE_VALID
-	return RLockSetter(c)
+	return DB.LockSetterIfAbsent(c)
 }
 
-func EnvMaintenance(envName string) bool {
+// Wants: environment name
+//
+// Returns: `true` if the env was written, the env as it was before
+func EnvMaintenance(envName string) (bool, *LockData) {
 
 	c := new(LockData)
 	c.Type = C_TYPE_ENV
 	c.Name = envName
 	c.State = C_STATE_MAINTENANCE
-	return RLockSetter(c)
+	return DB.LockSetter(c)
 }
 
-func EnvTerminate(envName string) bool {
+// Wants: environment name
+//
+// Returns: `true` if the env was written, the env as it was before
+func EnvTerminate(envName string) (bool, *LockData) {
 
-	c := RLockGetter(C_TYPE_ENV + ":" + envName)
+	c := DB.LockGetter(C_TYPE_ENV + ":" + envName)
 	c.Type = C_TYPE_ENV
 	c.Name = envName
 	c.State = C_STATE_TERMINATED
 	c.Parent = "n/a"
 	c.User = C_ADMIN
-	return RLockSetter(c)
+	return DB.LockSetter(c)
 }
 
 // Wants: environment name
@@ -285,7 +416,7 @@ func EnvTerminate(envName string) bool {
 func EnvLockStatus(envName string) *RichErrorStatus {
 
 	r := new(RichErrorStatus)
-	ld := RLockGetter(C_TYPE_ENV + ":" + envName)
+	ld := DB.LockGetter(C_TYPE_ENV + ":" + envName)
 
 	switch {
 	case ld.HttpErr == http.StatusNoContent:
@@ -313,49 +444,78 @@ func EnvLockStatus(envName string) *RichErrorStatus {
 	return r
 }
 
-// Wants: filled LockData
+// Wants: filled LockData with a valid LastDay
 //
 // Returns: `true` if everything went fine
 func EnvLock(c *LockData, res *WebResponse) bool {
 
-	db := RLockGetter(C_TYPE_ENV + ":" + c.Name)
-
-	// normal users can modify only their own records
-	if c.User != C_ADMIN {
-		if c.User != db.User && len(db.User) > 0 {
-			res.Messages = append(res.Messages, ERR_LockedByAnotherUser)
-			c.HttpErr = http.StatusForbidden
-			return false
-		}
-	}
-
 	c.Parent = "n/a"
 	c.State = C_STATE_LOCKED
-	res.Messages = append(res.Messages, OK_EnvLocked)
 
-	if RLockSetter(c) { // OK
-		c.HttpErr = http.StatusOK
-		return true
+	expire := GetExpiry(c)
+	SetExpiry(c, expire)
 
-	} else { // ERROR
-		res.Messages = append(res.Messages, ERR_EnvLockFail)
-		c.HttpErr = http.StatusForbidden
+	// owner check, write and expiry in one go
+	r, prev := DB.LockAcquire(c, time.Until(expire))
+	c.HttpErr = r.HttpErrCode
+
+	if r.IsError {
+		res.Messages = append(res.Messages, r.ErrorMessage)
 		return false
 	}
+
+	RecordChange(C_EV_LOCK, c, prev)
+
+	res.LastDay = c.LastDay
+	res.Expire = c.Expire
+	res.Messages = append(res.Messages, OK_EnvLocked)
+	return true
 }
 
-func EnvUnlock(envName string) bool {
+// Wants: environment name
+//
+// Returns: `true` if the env was written, the env as it was before
+func EnvUnlock(envName string) (bool, *LockData) {
 
 	c := new(LockData)
 	c.Type = C_TYPE_ENV
 	c.Name = envName
 	c.State = C_STATE_VALID
-	return RLockSetter(c)
+
+	return DB.LockSetter(c)
+}
+
+// Wants: environment name, maximum duration of its locks, 0 for no limit
+//
+// Returns: `true` if the env exists and got the maximum set
+func EnvSetMaxLock(envName string, max time.Duration) bool {
+
+	key := C_TYPE_ENV + ":" + envName
+	if DB.LockGetter(key).HttpErr == http.StatusNoContent {
+		return false
+	}
+
+	return DB.SetSingle(C_MAX_LOCK, envName, strconv.FormatInt(int64(max.Seconds()), 10))
+}
+
+// Wants: environment name
+//
+// Returns: maximum duration of the locks in the env, 0 for no limit
+func EnvMaxLock(envName string) time.Duration {
+
+	maxLock, _ := DB.GetSingle(C_MAX_LOCK, envName).(string)
+
+	max, err := strconv.ParseInt(maxLock, 10, 64)
+	if err != nil || max <= 0 {
+		return 0
+	}
+
+	return time.Duration(max) * time.Second
 }
 
 func IsEnvContainsHosts(envName string) bool {
 
-	if len(RGetHostsInEnv(envName)) > 0 {
+	if len(DB.GetHostsInEnv(envName)) > 0 {
 		return true
 	} else {
 		return false
@@ -364,7 +524,7 @@ func IsEnvContainsHosts(envName string) bool {
 
 func IsHostLocked(hostName string) bool {
 
-	c := RLockGetter(C_TYPE_HOST + ":" + hostName)
+	c := DB.LockGetter(C_TYPE_HOST + ":" + hostName)
 	if c.State == C_STATE_LOCKED {
 		return false
 	} else {
@@ -372,57 +532,100 @@ func IsHostLocked(hostName string) bool {
 	}
 }
 
-// Wants: filled LockData
+// Wants: filled LockData with a valid LastDay
 //
 // Returns: `true` if everything went fine
 func HostLock(c *LockData, res *WebResponse) bool {
 
-	c.Parent = GetEnvFromHost(c.Name)             // parent env
-	pl := EnvLockStatus(c.Parent)                 // parent locking status
-	db := RLockGetter(C_TYPE_HOST + ":" + c.Name) // host locking status
+	c.Parent = GetEnvFromHost(c.Name) // parent env
+	c.State = C_STATE_LOCKED
 
-	if pl.HttpErrCode == http.StatusLocked { // parent env has been locked
-		res.Messages = append(res.Messages, ERR_ParentEnvLockFail)
-		c.HttpErr = http.StatusForbidden
-		return false
-	}
+	expire := GetExpiry(c)
+	SetExpiry(c, expire)
+
+	// parent env check, owner check, write and expiry in one go
+	r, prev := DB.LockAcquire(c, time.Until(expire))
+	c.HttpErr = r.HttpErrCode
 
-	if pl.HttpErrCode == http.StatusNoContent { // parent env not defined
-		res.Messages = append(res.Messages, ERR_ParentEnvNil)
-		c.HttpErr = http.StatusForbidden
+	if r.IsError {
+		res.Messages = append(res.Messages, r.ErrorMessage)
 		return false
 	}
 
-	if c.State == C_STATE_LOCKED {
-		res.Messages = append(res.Messages, ERR_HostLockFail)
-		c.HttpErr = http.StatusForbidden
+	RecordChange(C_EV_LOCK, c, prev)
+
+	res.LastDay = c.LastDay
+	res.Expire = c.Expire
+	res.Messages = append(res.Messages, OK_HostLocked)
+	return true
+}
+
+// Wants: host name
+//
+// Returns: `true` if the host was unlocked, the host as it was before
+func HostUnlock(hostName string) (bool, *LockData) {
+
+	c := new(LockData)
+	c.Type = C_TYPE_HOST
+	c.Name = hostName
+	c.User = C_ADMIN
+
+	r, prev := DB.LockRelease(c)
+	return !r.IsError, prev
+}
+
+// Wants: filled LockData of the extend request with the new expiry
+//
+// Returns: `true` if everything went fine
+func EntityExtend(c *LockData, res *WebResponse) bool {
+
+	expire := GetExpiry(c)
+	SetExpiry(c, expire)
+
+	// owner check, reservations, maximum duration and the new expiry in one go
+	r, prev := DB.LockExtend(c, time.Until(expire))
+	c.HttpErr = r.HttpErrCode
+
+	if r.IsError {
+		res.Messages = append(res.Messages, r.ErrorMessage)
 		return false
 	}
 
-	// normal users can modify only their own records
-	if c.User != C_ADMIN {
-		if c.User != db.User && len(db.User) > 0 {
-			res.Messages = append(res.Messages, ERR_LockedByAnotherUser)
-			c.HttpErr = http.StatusForbidden
-			return false
-		}
+	RecordChange(C_EV_EXTEND, c, prev)
+
+	if c.Type == C_TYPE_ENV {
+		res.Messages = append(res.Messages, OK_EnvExtended)
+	} else {
+		res.Messages = append(res.Messages, OK_HostExtended)
 	}
 
-	c.State = C_STATE_LOCKED
+	res.LastDay = c.LastDay
+	res.Expire = c.Expire
+	res.PrevExpire = prev.Expire
+	return true
+}
 
-	if RLockSetter(c) { // OK
-		res.Messages = append(res.Messages, OK_HostLocked)
-		c.HttpErr = http.StatusOK
-		return true
+// Wants: filled LockData of the unlock request
+//
+// Returns: `true` if everything went fine
+func EntityUnlock(c *LockData, res *WebResponse) bool {
 
-	} else { // ERROR
-		res.Messages = append(res.Messages, ERR_HostLockFail)
-		c.HttpErr = http.StatusForbidden
+	r, prev := DB.LockRelease(c)
+	c.HttpErr = r.HttpErrCode
+
+	if r.IsError {
+		res.Messages = append(res.Messages, r.ErrorMessage)
 		return false
 	}
-}
 
-func HostUnlock(hostName string) bool {
+	RecordChange(C_EV_UNLOCK, c, prev)
 
-	return REntityDelete(C_TYPE_HOST, hostName)
+	if c.Type == C_TYPE_ENV {
+		res.Messages = append(res.Messages, OK_EnvUnlocked)
+	} else {
+		res.Messages = append(res.Messages, OK_HostUnlocked)
+	}
+
+	PromoteQueue(c.Type, c.Name)
+	return true
 }
@@ -0,0 +1,155 @@
+package x
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsValidUserName(t *testing.T) {
+
+	for name, want := range map[string]bool{
+		"user1":                 true,
+		"ci-agent.42":           true,
+		"first_last":            true,
+		"":                      false,
+		"-user":                 false,
+		"user one":              false,
+		"user\r\nBcc: x@y":      false,
+		"user@example.com":      false,
+		strings.Repeat("u", 64): true,
+		strings.Repeat("u", 65): false,
+	} {
+		if got := IsValidUserName(name); got != want {
+			t.Errorf("IsValidUserName(%q) = %t, want %t", name, got, want)
+		}
+	}
+}
+
+func TestParseExpiry(t *testing.T) {
+
+	now := time.Now()
+	future := now.Add(48 * time.Hour)
+
+	for _, tc := range []struct {
+		lastDay, forDuration string
+		ok                   bool
+	}{
+		{future.Format("20060102"), "", true},
+		{future.Format(time.RFC3339), "", true},
+		{"", "2h", true},
+		{"20200101", "", false},
+		{now.Add(-time.Minute).Format(time.RFC3339), "", false},
+		{now.Format("20060102"), "", true}, // till midnight
+		{now.AddDate(0, 0, -1).Format("20060102"), "", false},
+		{"", "0s", false},
+		{"", "-1h", false},
+		{"", "2days", false},
+		{"tomorrow", "", false},
+	} {
+		expire, ok := ParseExpiry(tc.lastDay, tc.forDuration, time.Local)
+		if ok != tc.ok {
+			t.Errorf("ParseExpiry(%q, %q) = %s, %t, want %t", tc.lastDay, tc.forDuration, expire, ok, tc.ok)
+		}
+		if ok && !expire.After(now) {
+			t.Errorf("ParseExpiry(%q, %q) = %s, not in the future", tc.lastDay, tc.forDuration, expire)
+		}
+	}
+}
+
+// seedRaw writes hashes and sets straight into the store, bypassing the
+// indexes, like the versions before them did.
+func seedRaw(t *testing.T, hashes map[string]map[string]string, sets map[string][]string) {
+
+	t.Helper()
+
+	switch s := DB.(type) {
+	case *LocalStore:
+		err := s.engine.update(func(tx localTx) error {
+			for key, fields := range hashes {
+				if err := tx.put(key, &localEntry{Fields: fields}); err != nil {
+					return err
+				}
+			}
+			for key, members := range sets {
+				set := &localEntry{Fields: make(map[string]string)}
+				for _, m := range members {
+					set.Fields[m] = ""
+				}
+				if err := tx.put(key, set); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *RedisStore:
+		for key, fields := range hashes {
+			values := make(map[string]any)
+			for f, v := range fields {
+				values[f] = v
+			}
+			if err := s.Conn.HMSet(key, values).Err(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for key, members := range sets {
+			for _, m := range members {
+				if err := s.Conn.SAdd(key, m).Err(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+}
+
+func TestMigrateIndexes(t *testing.T) {
+
+	forEachStore(t, func(t *testing.T) {
+		expire := time.Now().Add(time.Hour).Truncate(time.Second).Format(time.RFC3339)
+		locked := func(parent string, user string) map[string]string {
+			return map[string]string{"state": C_STATE_LOCKED, C_PARENT: parent, "user": user, "lastday": day(0), "expire": expire}
+		}
+
+		seedRaw(t, map[string]map[string]string{
+			"env:env1":        {"state": C_STATE_VALID},
+			"env:env2":        locked("n/a", "user2"),
+			"env:env3":        {"state": C_STATE_MAINTENANCE},
+			"host:env1-host1": locked("env1", "user1"),
+			"host:env1-host2": locked("env1", "user2"),
+		}, map[string][]string{
+			// left over by an older version, must be dropped
+			C_IDX_STATE + ":" + C_STATE_LOCKED: {"host:env1-host9"},
+			C_IDX_USER + ":user9":              {"host:env1-host9"},
+			C_ENV_HOSTS + ":env3":              {"env3-host1"},
+		})
+
+		if rebuilt, err := MigrateIndexes(false); err != nil || !rebuilt {
+			t.Fatalf("MigrateIndexes() = %t, %v, want a rebuild", rebuilt, err)
+		}
+
+		check := func(what string, got []string, want ...string) {
+			t.Helper()
+			slices.Sort(got)
+			if !slices.Equal(got, want) {
+				t.Errorf("%s: %v, want %v", what, got, want)
+			}
+		}
+		check("envhosts:env1", DB.GetHostsInEnv("env1"), "host:env1-host1", "host:env1-host2")
+		check("envhosts:env3", DB.GetHostsInEnv("env3"))
+		check("bystate:locked", DB.EntitiesInState(C_STATE_LOCKED), "env:env2", "host:env1-host1", "host:env1-host2")
+		check("bystate:valid", DB.EntitiesInState(C_STATE_VALID), "env:env1")
+		check("bystate:maint", DB.EntitiesInState(C_STATE_MAINTENANCE), "env:env3")
+		check("byuser:user1", DB.EntitiesOfUser("user1"), "host:env1-host1")
+		check("byuser:user2", DB.EntitiesOfUser("user2"), "env:env2", "host:env1-host2")
+		check("byuser:user9", DB.EntitiesOfUser("user9"))
+
+		// once per index version
+		if rebuilt, err := MigrateIndexes(false); err != nil || rebuilt {
+			t.Errorf("second MigrateIndexes() = %t, %v, want no rebuild", rebuilt, err)
+		}
+	})
+}
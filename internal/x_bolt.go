@@ -0,0 +1,179 @@
+package x
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	C_BOLT_PATH   string = "/var/lib/nodelocker/nodelocker.db"
+	C_BOLT_BUCKET string = "nodelocker"
+)
+
+// Wants: path of the database file, created if missing
+//
+// Returns: a Store persisted in a single bbolt file
+func NewBoltStore(path string) (*LocalStore, error) {
+
+	engine, err := newBoltEngine(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LocalStore{
+		engine:   engine,
+		volatile: newMemEngine(),
+	}, nil
+}
+
+// boltEngine keeps the entries JSON encoded in one bucket of a bbolt file.
+type boltEngine struct {
+	db *bolt.DB
+}
+
+func newBoltEngine(path string) (*boltEngine, error) {
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create database directory: %w", err)
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open '%s': %w", path, err)
+	}
+
+	b := &boltEngine{db: db}
+
+	// Create the bucket and drop what expired while nodelocker was down
+	err = b.update(func(tx localTx) error {
+		for _, key := range tx.(*boltTx).allKeys() {
+			tx.get(key)
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// boltTx is a bbolt transaction on the nodelocker bucket.
+type boltTx struct {
+	b *bolt.Bucket
+}
+
+func (b *boltEngine) view(fn func(tx localTx) error) error {
+
+	return b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(C_BOLT_BUCKET))
+		if bucket == nil { // nothing written yet
+			return fn(&boltTx{})
+		}
+		return fn(&boltTx{b: bucket})
+	})
+}
+
+func (b *boltEngine) update(fn func(tx localTx) error) error {
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(C_BOLT_BUCKET))
+		if err != nil {
+			return err
+		}
+		return fn(&boltTx{b: bucket})
+	})
+}
+
+func (b *boltEngine) close() error {
+
+	return b.db.Close()
+}
+
+func (t *boltTx) get(key string) (*localEntry, bool) {
+
+	if t.b == nil {
+		return nil, false
+	}
+
+	raw := t.b.Get([]byte(key))
+	if raw == nil {
+		return nil, false
+	}
+
+	e := new(localEntry)
+	if err := json.Unmarshal(raw, e); err != nil {
+		fmt.Printf("%s Skipping unreadable entry '%s': %s\n", C_FAILED, key, err)
+		return nil, false
+	}
+
+	if e.expired(time.Now()) {
+		if t.b.Writable() {
+			_ = t.b.Delete([]byte(key))
+		}
+		return nil, false
+	}
+
+	return e, true
+}
+
+func (t *boltTx) put(key string, e *localEntry) error {
+
+	raw, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	return t.b.Put([]byte(key), raw)
+}
+
+func (t *boltTx) del(key string) error {
+
+	return t.b.Delete([]byte(key))
+}
+
+func (t *boltTx) keys(prefix string) []string {
+
+	return t.keysFrom(prefix, prefix)
+}
+
+// bbolt keeps keys sorted bytewise, so a prefix is one cursor run from the
+// first key wanted.
+func (t *boltTx) keysFrom(prefix string, from string) []string {
+
+	keys := make([]string, 0)
+	if t.b == nil {
+		return keys
+	}
+
+	now := time.Now()
+	c := t.b.Cursor()
+	p := []byte(prefix)
+
+	for k, v := c.Seek([]byte(max(prefix, from))); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+		e := new(localEntry)
+		if json.Unmarshal(v, e) == nil && !e.expired(now) {
+			keys = append(keys, string(k))
+		}
+	}
+
+	return keys
+}
+
+func (t *boltTx) allKeys() []string {
+
+	keys := make([]string, 0)
+	_ = t.b.ForEach(func(k, v []byte) error {
+		keys = append(keys, string(k))
+		return nil
+	})
+
+	return keys
+}
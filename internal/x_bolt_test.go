@@ -0,0 +1,54 @@
+package x
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBoltKeepsLocksOverRestart(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "nodelocker.db")
+
+	s, err := NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useStore(t, s)
+
+	EnvCreate("env1")
+	if r, _ := DB.LockAcquire(lockRequest(C_TYPE_HOST, "env1-host1", "user1"), time.Hour); r.IsError {
+		t.Fatal(r.ErrorMessage)
+	}
+	if r, _ := DB.LockAcquire(lockRequest(C_TYPE_HOST, "env1-host2", "user1"), 1500*time.Millisecond); r.IsError {
+		t.Fatal(r.ErrorMessage)
+	}
+
+	// restarted
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useStore(t, s)
+
+	for _, name := range []string{"env1-host1", "env1-host2"} {
+		if l := DB.LockGetter(C_TYPE_HOST + ":" + name); l.State != C_STATE_LOCKED || l.User != "user1" {
+			t.Errorf("%s after the restart: %+v, want locked by user1", name, l)
+		}
+	}
+
+	time.Sleep(2 * time.Second)
+
+	if l := DB.LockGetter(C_TYPE_HOST + ":env1-host1"); l.State != C_STATE_LOCKED {
+		t.Errorf("env1-host1 is %+v, want locked", l)
+	}
+	if l := DB.LockGetter(C_TYPE_HOST + ":env1-host2"); l.State == C_STATE_LOCKED {
+		t.Errorf("env1-host2 is %+v, want expired", l)
+	}
+	if hosts := DB.GetHostsInEnv("env1"); len(hosts) != 1 {
+		t.Errorf("locked hosts of env1 %v, want env1-host1 only", hosts)
+	}
+}
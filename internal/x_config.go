@@ -0,0 +1,397 @@
+package x
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	C_LISTEN_ADDR      string        = "0.0.0.0:3000"
+	C_REDIS_ADDR       string        = "localhost:6379"
+	C_READ_TIMEOUT     time.Duration = 5 * time.Second
+	C_WRITE_TIMEOUT    time.Duration = 5 * time.Second
+	C_SHUTDOWN_TIMEOUT time.Duration = 30 * time.Second // to finish the requests in flight
+
+	C_ENV_PREFIX string = "NODELOCKER_" // of the environment variables of the settings
+	C_REDACTED   string = "<redacted>"
+)
+
+// secretSettings are never printed, see Print.
+var secretSettings = []string{"redis-password", "notify-secret"}
+
+// actionSettings are flags only, not settings of the config file.
+var actionSettings = []string{"config", "print-config", "export-ca"}
+
+// Config is the effective configuration, see LoadConfig.
+type Config struct {
+	File        string // the config file, YAML or TOML
+	PrintConfig bool   // print the effective configuration and exit
+	ExportCA    bool   // print the certificate of the local CA and exit
+
+	Listen          string
+	TLS             bool
+	TLSCert         string // certificate, may be followed by its chain
+	TLSKey          string
+	TLSChain        string // intermediate certificates, if not in TLSCert
+	TLSSANs         string // DNS names and IPs of the certificate of the local CA
+	TLSClientCA     string // CAs of the client certificates, none without it
+	TLSClientAuth   string // C_CLIENT_AUTH_OPTIONAL or C_CLIENT_AUTH_REQUIRE
+	TLSClientUser   string // field of the client certificate holding the user, C_CLIENT_USER_*
+	TLSClientAdmins string // users or subjects of the client certificates with admin rights
+	CertDir         string
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	ShutdownTimeout time.Duration
+	Debug           bool
+
+	Store          string
+	BoltPath       string
+	RebuildIndexes bool
+	RedisAddr      string
+	RedisPassword  string
+	RedisDB        int
+	HistoryMaxAge  time.Duration // 0 keeps the whole history
+
+	RateLimit  int
+	RateWindow time.Duration
+	BcryptCost int
+
+	TZ        string
+	PublicURL string
+	Remind    string
+	Notifier  NotifierConfig
+}
+
+// Returns: the configuration of the settings not given
+func DefaultConfig() *Config {
+
+	return &Config{
+		Listen:          C_LISTEN_ADDR,
+		TLS:             true,
+		TLSSANs:         DefaultSANs(),
+		TLSClientAuth:   C_CLIENT_AUTH_OPTIONAL,
+		TLSClientUser:   C_CLIENT_USER_CN,
+		CertDir:         C_CERT_DIR,
+		ReadTimeout:     C_READ_TIMEOUT,
+		WriteTimeout:    C_WRITE_TIMEOUT,
+		ShutdownTimeout: C_SHUTDOWN_TIMEOUT,
+		Store:           C_STORE_REDIS,
+		BoltPath:        C_BOLT_PATH,
+		RedisAddr:       C_REDIS_ADDR,
+		HistoryMaxAge:   C_HISTORY_MAX_AGE,
+		RateLimit:       C_RATE_LIMIT,
+		RateWindow:      C_RATE_WINDOW,
+		BcryptCost:      C_BCRYPT_COST,
+		TZ:              C_DEFAULT_TZ,
+		PublicURL:       C_PUBLIC_URL,
+		Remind:          C_REMIND_WINDOWS,
+		Notifier: NotifierConfig{
+			Kind:     C_NOTIFIER_LOG,
+			SMTPAddr: C_SMTP_ADDR,
+			SMTPFrom: C_SMTP_FROM,
+		},
+	}
+}
+
+// Binds the settings to their flags, the names of the flags are the keys of
+// the config file and, upper case with '_' for '-', the names of the
+// environment variables after C_ENV_PREFIX.
+func (c *Config) bind(fs *flag.FlagSet) {
+
+	fs.StringVar(&c.File, "config", c.File, "config file, YAML (.yaml, .yml) or TOML (.toml)")
+	fs.BoolVar(&c.PrintConfig, "print-config", c.PrintConfig, "print the effective configuration, secrets redacted, and exit")
+	fs.BoolVar(&c.ExportCA, "export-ca", c.ExportCA, "print the certificate of the local CA, created if missing, and exit")
+
+	fs.StringVar(&c.Listen, "listen", c.Listen, "host:port the server listens on")
+	fs.BoolVar(&c.TLS, "tls", c.TLS, "serve HTTPS, plain HTTP if false")
+	fs.StringVar(&c.TLSCert, "tls-cert", c.TLSCert, "PEM certificate file, may hold the chain too, a self-signed certificate is used if not set")
+	fs.StringVar(&c.TLSKey, "tls-key", c.TLSKey, "PEM private key file of tls-cert")
+	fs.StringVar(&c.TLSChain, "tls-chain", c.TLSChain, "PEM file of the intermediate certificates of tls-cert")
+	fs.StringVar(&c.TLSSANs, "tls-sans", c.TLSSANs, "DNS names and IP addresses of the certificate issued by the local CA, comma separated")
+	fs.StringVar(&c.TLSClientCA, "tls-client-ca", c.TLSClientCA, "PEM file of the CAs of the client certificates, enables them instead of the tokens")
+	fs.StringVar(&c.TLSClientAuth, "tls-client-auth", c.TLSClientAuth, "client certificates: 'optional' or 'require'")
+	fs.StringVar(&c.TLSClientUser, "tls-client-user", c.TLSClientUser, "user of a client certificate: its 'cn', first 'dns' SAN or the name of its first 'email' SAN")
+	fs.StringVar(&c.TLSClientAdmins, "tls-client-admins", c.TLSClientAdmins, "users or subjects, like CN=ci-admin,O=CI, of the client certificates with admin rights, ';' separated")
+	fs.StringVar(&c.CertDir, "cert-dir", c.CertDir, "directory of the local CA and the certificate issued by it")
+	fs.DurationVar(&c.ReadTimeout, "read-timeout", c.ReadTimeout, "time to read a request, 0 for no limit")
+	fs.DurationVar(&c.WriteTimeout, "write-timeout", c.WriteTimeout, "time to write a response, 0 for no limit")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "time to finish the requests in flight on SIGTERM or SIGINT, 0 for no limit")
+	fs.BoolVar(&c.Debug, "debug", c.Debug, "print the checks of the users")
+
+	fs.StringVar(&c.Store, "store", c.Store, "storage backend: 'redis', 'bolt' or 'memory'")
+	fs.StringVar(&c.BoltPath, "bolt-path", c.BoltPath, "database file of the 'bolt' storage backend")
+	fs.BoolVar(&c.RebuildIndexes, "rebuild-indexes", c.RebuildIndexes, "rebuild the indexes from the stored entities on start")
+	fs.StringVar(&c.RedisAddr, "redis-addr", c.RedisAddr, "host:port of the 'redis' storage backend")
+	fs.StringVar(&c.RedisPassword, "redis-password", c.RedisPassword, "password of the 'redis' storage backend")
+	fs.IntVar(&c.RedisDB, "redis-db", c.RedisDB, "database number of the 'redis' storage backend")
+	fs.DurationVar(&c.HistoryMaxAge, "history-max-age", c.HistoryMaxAge, "age of the oldest events kept in the history, 0 to keep them all")
+
+	fs.IntVar(&c.RateLimit, "rate-limit", c.RateLimit, "requests of a client allowed per rate window")
+	fs.DurationVar(&c.RateWindow, "rate-window", c.RateWindow, "window of the rate limit")
+	fs.IntVar(&c.BcryptCost, "bcrypt-cost", c.BcryptCost, "bcrypt cost of the new tokens")
+
+	fs.StringVar(&c.TZ, "tz", c.TZ, "default timezone whose midnight a 'lastday' refers to")
+	fs.StringVar(&c.PublicURL, "public-url", c.PublicURL, "base URL of the server in the URLs sent out")
+	fs.StringVar(&c.Remind, "remind", c.Remind, "remind the owners this long before their locks expire, comma separated, '' to disable")
+	fs.StringVar(&c.Notifier.Kind, "notifier", c.Notifier.Kind, "notifier of the reminders: 'log', 'webhook' or 'smtp'")
+	fs.StringVar(&c.Notifier.URL, "notify-url", c.Notifier.URL, "URL the 'webhook' notifier posts to")
+	fs.StringVar(&c.Notifier.Secret, "notify-secret", c.Notifier.Secret, "HMAC key of the 'webhook' notifier")
+	fs.StringVar(&c.Notifier.SMTPAddr, "smtp-addr", c.Notifier.SMTPAddr, "SMTP relay of the 'smtp' notifier")
+	fs.StringVar(&c.Notifier.SMTPFrom, "smtp-from", c.Notifier.SMTPFrom, "sender address of the 'smtp' notifier")
+	fs.StringVar(&c.Notifier.MailDomain, "mail-domain", c.Notifier.MailDomain, "users get mail as <user>@<mail-domain> from the 'smtp' notifier")
+}
+
+// Returns: name of the environment variable of a setting
+func envName(setting string) string {
+
+	return C_ENV_PREFIX + strings.ToUpper(strings.ReplaceAll(setting, "-", "_"))
+}
+
+// Wants: path of a YAML or TOML file
+//
+// Returns: the settings of the file as text, error on a nested value
+func readConfigFile(path string) (map[string]string, error) {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make(map[string]any)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	case ".toml":
+		err = toml.Unmarshal(data, &raw)
+	default:
+		return nil, fmt.Errorf("%s: unknown config file type, must be .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	values := make(map[string]string, len(raw))
+	for name, v := range raw {
+		switch v.(type) {
+		case map[string]any, []any:
+			return nil, fmt.Errorf("%s: '%s' must be a single value", path, name)
+		}
+		values[name] = fmt.Sprint(v)
+	}
+
+	return values, nil
+}
+
+// Wants: command line arguments without the program name, lookup of the
+// environment variables, e.g. os.LookupEnv
+//
+// Returns: the configuration, the defaults overridden by the config file,
+// those by the environment variables and those by the flags, error on a
+// wrong or unknown setting, flag.ErrHelp for -h
+func LoadConfig(args []string, lookupEnv func(string) (string, bool)) (*Config, error) {
+
+	c := DefaultConfig()
+
+	fs := flag.NewFlagSet("nodelocker", flag.ContinueOnError)
+	c.bind(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument '%s'", fs.Arg(0))
+	}
+
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	if v, ok := lookupEnv(envName("config")); ok && !given["config"] {
+		c.File = v
+	}
+
+	errs := make([]error, 0)
+
+	if c.File != "" {
+		values, err := readConfigFile(c.File)
+		if err != nil {
+			return nil, err
+		}
+		names := make([]string, 0, len(values))
+		for name := range values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			v := values[name]
+			f := fs.Lookup(name)
+			if f == nil || slices.Contains(actionSettings, name) {
+				errs = append(errs, fmt.Errorf("%s: unknown setting '%s'", c.File, name))
+				continue
+			}
+			if given[name] {
+				continue
+			}
+			if err := f.Value.Set(v); err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid %s '%s': %w", c.File, name, v, err))
+			}
+		}
+	}
+
+	fs.VisitAll(func(f *flag.Flag) {
+		v, ok := lookupEnv(envName(f.Name))
+		if !ok || given[f.Name] || f.Name == "config" {
+			return
+		}
+		if err := f.Value.Set(v); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s '%s': %w", envName(f.Name), v, err))
+		}
+	})
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return c, c.Validate()
+}
+
+// Returns: error listing every wrong setting, nil if all fine
+func (c *Config) Validate() error {
+
+	errs := make([]error, 0)
+	wrong := func(format string, a ...any) {
+		errs = append(errs, fmt.Errorf(format, a...))
+	}
+
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		wrong("invalid listen '%s', must be host:port", c.Listen)
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		wrong("tls-cert and tls-key must be set together")
+	}
+	if c.TLSChain != "" && c.TLSCert == "" {
+		wrong("tls-chain needs tls-cert")
+	}
+	if c.TLS && c.TLSCert == "" && c.CertDir == "" {
+		wrong("cert-dir must be set for tls without tls-cert")
+	}
+	if names, ips := splitSANs(c.TLSSANs); c.TLS && c.TLSCert == "" && len(names)+len(ips) == 0 {
+		wrong("tls-sans must be set for tls without tls-cert")
+	} else {
+		for _, name := range names {
+			if strings.ContainsAny(name, " /:@") {
+				wrong("invalid DNS name '%s' in tls-sans", name)
+			}
+		}
+	}
+	if c.TLSClientCA != "" && !c.TLS {
+		wrong("tls-client-ca needs tls")
+	}
+	if c.TLSClientAuth != C_CLIENT_AUTH_OPTIONAL && c.TLSClientAuth != C_CLIENT_AUTH_REQUIRE {
+		wrong("unknown tls-client-auth '%s', must be optional or require", c.TLSClientAuth)
+	}
+	if !slices.Contains([]string{C_CLIENT_USER_CN, C_CLIENT_USER_DNS, C_CLIENT_USER_EMAIL}, c.TLSClientUser) {
+		wrong("unknown tls-client-user '%s', must be cn, dns or email", c.TLSClientUser)
+	}
+	if c.ReadTimeout < 0 || c.WriteTimeout < 0 {
+		wrong("read-timeout and write-timeout cannot be negative")
+	}
+	if c.ShutdownTimeout < 0 {
+		wrong("shutdown-timeout cannot be negative")
+	}
+	if c.HistoryMaxAge < 0 {
+		wrong("history-max-age cannot be negative")
+	}
+
+	if !slices.Contains([]string{C_STORE_REDIS, C_STORE_BOLT, C_STORE_MEMORY}, c.Store) {
+		wrong("unknown store '%s', must be redis, bolt or memory", c.Store)
+	}
+	if c.Store == C_STORE_BOLT && c.BoltPath == "" {
+		wrong("bolt-path must be set for the bolt store")
+	}
+	if _, _, err := net.SplitHostPort(c.RedisAddr); c.Store == C_STORE_REDIS && err != nil {
+		wrong("invalid redis-addr '%s', must be host:port", c.RedisAddr)
+	}
+	if c.RedisDB < 0 {
+		wrong("redis-db cannot be negative")
+	}
+
+	if c.RateLimit <= 0 {
+		wrong("rate-limit must be positive")
+	}
+	if c.RateWindow <= 0 {
+		wrong("rate-window must be positive")
+	}
+	if c.BcryptCost < bcrypt.MinCost || c.BcryptCost > bcrypt.MaxCost {
+		wrong("bcrypt-cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+
+	if _, err := time.LoadLocation(c.TZ); err != nil {
+		wrong("unknown timezone '%s'", c.TZ)
+	}
+	if !IsValidWebhookURL(c.PublicURL) {
+		wrong("invalid public-url '%s', must be an http or https URL", c.PublicURL)
+	}
+	if _, err := ParseRemindWindows(c.Remind); err != nil {
+		wrong("%s", err)
+	}
+	if _, err := NewNotifier(c.Notifier); err != nil {
+		wrong("%s", err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// Sets the package wide settings, the debug output, the rate limit, the
+// bcrypt cost and the default timezone.
+func (c *Config) Apply() error {
+
+	DEBUG = c.Debug
+	MaxRequests = c.RateLimit
+	RateWindow = c.RateWindow
+	BcryptCost = c.BcryptCost
+
+	return SetDefaultTZ(c.TZ)
+}
+
+// Wants: writer
+//
+// Writes the effective configuration as a YAML config file, the secrets
+// redacted.
+func (c *Config) Print(w io.Writer) error {
+
+	fs := flag.NewFlagSet("nodelocker", flag.ContinueOnError)
+	c.bind(fs)
+
+	values := make(map[string]any)
+	fs.VisitAll(func(f *flag.Flag) {
+		if slices.Contains(actionSettings, f.Name) {
+			return
+		}
+		v := f.Value.(flag.Getter).Get()
+		if slices.Contains(secretSettings, f.Name) && v != "" {
+			v = C_REDACTED
+		}
+		values[f.Name] = v
+	})
+
+	if c.File != "" {
+		if _, err := fmt.Fprintf(w, "# %s\n", c.File); err != nil {
+			return err
+		}
+	}
+
+	return yaml.NewEncoder(w).Encode(values)
+}
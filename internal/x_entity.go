@@ -0,0 +1,43 @@
+package x
+
+import (
+	"sort"
+	"time"
+)
+
+// Wants: entity type and name
+//
+// Returns: the entity as in the v2 status, an env with its locked hosts,
+// `false` if it's unknown. Hosts are stored while locked only, the others
+// of an existing env are valid.
+func EntityLookup(enType string, enName string) (*EntityStatus, bool) {
+
+	now := time.Now()
+	key := enType + ":" + enName
+
+	fields := DB.GetAll(key)
+	calendar := DB.ReserveList(enType, enName)
+
+	if len(fields) == 0 {
+		envExists := len(DB.GetAll(C_TYPE_ENV+":"+envOf(enType, enName))) > 0
+		if enType == C_TYPE_ENV || (!envExists && len(calendar) == 0) {
+			return nil, false
+		}
+		fields = map[string]string{"state": C_STATE_VALID, C_PARENT: envOf(enType, enName)}
+	}
+
+	e := newEntityStatus(enType, enName, fields, now)
+	e.Reservations = calendar
+
+	if enType == C_TYPE_ENV {
+		for _, hostKey := range DB.GetHostsInEnv(enName) {
+			hostType, hostName := splitKey(hostKey)
+			if hostFields := DB.GetAll(hostKey); len(hostFields) > 0 {
+				e.Hosts = append(e.Hosts, newEntityStatus(hostType, hostName, hostFields, now))
+			}
+		}
+		sort.Slice(e.Hosts, func(i, j int) bool { return e.Hosts[i].Name < e.Hosts[j].Name })
+	}
+
+	return &e, true
+}
@@ -0,0 +1,183 @@
+package x
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	C_STREAM_BUFFER int           = 64               // events a slow client can lag behind
+	C_STREAM_PING   time.Duration = 15 * time.Second // keeps the idle streams open
+	C_STREAM_RETRY  time.Duration = 3 * time.Second  // reconnection delay asked from the clients
+)
+
+// eventStream is a client of /events with its filter.
+type eventStream struct {
+	filter EventFilter
+	events chan Event
+}
+
+var (
+	streamsMu     sync.Mutex
+	streams       = make(map[*eventStream]struct{})
+	streamsClosed bool // the server is shutting down
+)
+
+// Wants: recorded event, see OnEvent
+//
+// Passes the event to the matching streams, a stream lagging behind gets
+// closed, its client resumes from its last event.
+func PublishEvent(e Event) {
+
+	streamsMu.Lock()
+	defer streamsMu.Unlock()
+
+	for s := range streams {
+		if !s.filter.Matches(e) {
+			continue
+		}
+		select {
+		case s.events <- e:
+		default:
+			delete(streams, s)
+			close(s.events)
+		}
+	}
+}
+
+func subscribeEvents(f EventFilter) *eventStream {
+
+	s := &eventStream{filter: f, events: make(chan Event, C_STREAM_BUFFER)}
+
+	streamsMu.Lock()
+	defer streamsMu.Unlock()
+
+	if streamsClosed {
+		close(s.events)
+	} else {
+		streams[s] = struct{}{}
+	}
+
+	return s
+}
+
+func unsubscribeEvents(s *eventStream) {
+
+	streamsMu.Lock()
+	defer streamsMu.Unlock()
+
+	if _, ok := streams[s]; ok {
+		delete(streams, s)
+		close(s.events)
+	}
+}
+
+// Ends the event streams, they would hold up the shutdown of the server
+// forever. Their clients reconnect to the next one.
+func CloseEventStreams() {
+
+	streamsMu.Lock()
+	defer streamsMu.Unlock()
+
+	streamsClosed = true
+	for s := range streams {
+		delete(streams, s)
+		close(s.events)
+	}
+}
+
+func writeEvent(w http.ResponseWriter, e Event) error {
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	// an event not recorded in the history can't be resumed from
+	if e.ID != 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", e.ID); err != nil {
+			return err
+		}
+	}
+
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Action, data)
+	return err
+}
+
+// Wants: the request of the client, the events it wants, ID of the last
+// event it got, 0 for the new ones only
+//
+// Streams the events as Server-Sent Events until the client goes away, the
+// missed ones first from the history.
+func StreamEvents(w http.ResponseWriter, r *http.Request, f EventFilter, lastID int64) {
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// subscribed before the replay, nothing gets lost in between
+	s := subscribeEvents(f)
+	defer unsubscribeEvents(s)
+
+	// the streams outlive the write timeout of the server
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := fmt.Fprintf(w, "retry: %d\n\n", C_STREAM_RETRY.Milliseconds()); err != nil {
+		return
+	}
+
+	// the live events are passed on as they come, those up to the end of the
+	// replay were sent already
+	replayed := lastID
+	if lastID > 0 {
+		for _, e := range DB.HistoryList(time.Time{}) {
+			if e.ID <= lastID || !f.Matches(e) {
+				continue
+			}
+			if writeEvent(w, e) != nil {
+				return
+			}
+			replayed = max(replayed, e.ID)
+		}
+	}
+	flusher.Flush()
+
+	ping := time.NewTicker(C_STREAM_PING)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-s.events:
+			if !ok { // lagged behind, or shutting down
+				return
+			}
+			if e.ID != 0 && e.ID <= replayed { // replayed already
+				continue
+			}
+			if writeEvent(w, e) != nil {
+				return
+			}
+		case <-ping.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
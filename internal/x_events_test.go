@@ -0,0 +1,87 @@
+package x
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// streamEvents runs StreamEvents from lastID, publishes the live events once
+// it has subscribed, and returns what the client got.
+func streamEvents(t *testing.T, lastID int64, live []Event) string {
+
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest(http.MethodGet, "/events", nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		StreamEvents(w, r, EventFilter{}, lastID)
+	}()
+
+	for subscribed := false; !subscribed; time.Sleep(time.Millisecond) {
+		streamsMu.Lock()
+		subscribed = len(streams) > 0
+		streamsMu.Unlock()
+	}
+	for _, e := range live {
+		PublishEvent(e)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-done
+
+	return w.Body.String()
+}
+
+// ids are the IDs of the streamed events in order, 0 for the ones without.
+func ids(body string) []string {
+
+	var ids []string
+	for _, event := range strings.Split(body, "\n\n") {
+		if !strings.Contains(event, "event: ") {
+			continue
+		}
+		id := "0"
+		for _, line := range strings.Split(event, "\n") {
+			if after, ok := strings.CutPrefix(line, "id: "); ok {
+				id = after
+			}
+		}
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
+func TestStreamEventsPassesLiveEventsThrough(t *testing.T) {
+
+	useMemStore(t)
+	for i := 0; i < 3; i++ {
+		Emit(&Event{Action: C_EV_LOCK, Type: C_TYPE_HOST, Name: "env1-host1"})
+	}
+
+	// 2 and 3 are replayed, the live 3 is a duplicate, 5 is published
+	// before 4, 0 wasn't recorded
+	live := []Event{{ID: 3}, {ID: 5}, {ID: 4}, {ID: 0}}
+	for i := range live {
+		live[i].Action = C_EV_UNLOCK
+	}
+
+	got := strings.Join(ids(streamEvents(t, 1, live)), " ")
+	if want := "2 3 5 4 0"; got != want {
+		t.Errorf("streamed IDs %s, want %s", got, want)
+	}
+
+	got = strings.Join(ids(streamEvents(t, 0, live)), " ")
+	if want := "3 5 4 0"; got != want {
+		t.Errorf("streamed IDs without replay %s, want %s", got, want)
+	}
+}
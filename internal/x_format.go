@@ -0,0 +1,199 @@
+package x
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	C_FORMAT_JSON       string = "json"
+	C_FORMAT_YAML       string = "yaml"
+	C_FORMAT_CSV        string = "csv"
+	C_FORMAT_TEXT       string = "text"
+	C_FORMAT_PROMETHEUS string = "prometheus"
+)
+
+// formatTypes are the content types of the formats.
+var formatTypes = map[string]string{
+	C_FORMAT_JSON:       "application/json",
+	C_FORMAT_YAML:       "application/yaml",
+	C_FORMAT_CSV:        "text/csv; charset=utf-8",
+	C_FORMAT_TEXT:       "text/plain; charset=utf-8",
+	C_FORMAT_PROMETHEUS: "text/plain; version=0.0.4; charset=utf-8",
+}
+
+// acceptFormats are the formats by the media types clients ask for.
+var acceptFormats = map[string]string{
+	"application/json":   C_FORMAT_JSON,
+	"application/yaml":   C_FORMAT_YAML,
+	"application/x-yaml": C_FORMAT_YAML,
+	"text/yaml":          C_FORMAT_YAML,
+	"text/csv":           C_FORMAT_CSV,
+	"text/plain":         C_FORMAT_TEXT,
+}
+
+// Wants: 'format' parameter, Accept header
+//
+// Returns: the format, the parameter first, then the first known type of
+// the header, JSON by default, `false` for an unknown parameter
+func NegotiateFormat(format string, accept string) (string, bool) {
+
+	if format != "" {
+		_, ok := formatTypes[format]
+		return format, ok
+	}
+
+	for _, item := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(item))
+		if err != nil {
+			continue
+		}
+		// the Prometheus exposition format is text/plain with a version
+		if mediaType == "text/plain" && params["version"] != "" {
+			return C_FORMAT_PROMETHEUS, true
+		}
+		if f, ok := acceptFormats[mediaType]; ok {
+			return f, true
+		}
+	}
+
+	return C_FORMAT_JSON, true
+}
+
+// Returns: the content type of the format
+func FormatContentType(format string) string {
+
+	return formatTypes[format]
+}
+
+// Wants: writer, the stats
+//
+// Writes the stats as YAML, the same fields as the JSON.
+func WriteStatsYAML(w io.Writer, stats *Stats) error {
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(stats); err != nil {
+		return err
+	}
+
+	return enc.Close()
+}
+
+// the columns of the CSV and text formats
+var statusColumns = []string{"type", "name", "state", "parent", "owner", "lastday", "expire", "ttl", "reservations"}
+
+// Returns: the row of an entity in the CSV and text formats, the
+// reservations as user:firstday-lastday items
+func statusRow(e EntityStatus) []string {
+
+	reservations := make([]string, 0, len(e.Reservations))
+	for _, r := range e.Reservations {
+		reservations = append(reservations, r.User+":"+r.FirstDay+"-"+r.LastDay)
+	}
+
+	ttl := ""
+	if e.State == C_STATE_LOCKED {
+		ttl = strconv.FormatInt(e.TTL, 10)
+	}
+
+	return []string{e.Type, e.Name, e.State, e.Parent, e.Owner, e.LastDay, e.Expire, ttl, strings.Join(reservations, " ")}
+}
+
+// Wants: writer, the v2 overview
+//
+// Writes one CSV row per entity after a header row.
+func WriteStatusCSV(w io.Writer, st *StatusV2) error {
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(statusColumns); err != nil {
+		return err
+	}
+
+	for _, e := range append(st.Envs, st.Hosts...) {
+		if err := cw.Write(statusRow(e)); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+
+	return cw.Error()
+}
+
+// Wants: writer, the v2 overview
+//
+// Writes an aligned table of the entities, '-' for the empty cells.
+func WriteStatusText(w io.Writer, st *StatusV2) error {
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.ToUpper(strings.Join(statusColumns, "\t")))
+
+	for _, e := range append(st.Envs, st.Hosts...) {
+		row := statusRow(e)
+		for i := range row {
+			if row[i] == "" {
+				row[i] = "-"
+			}
+		}
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+
+	return tw.Flush()
+}
+
+// Returns: the value escaped as a Prometheus label value
+func promLabel(value string) string {
+
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// Wants: writer, the v2 overview
+//
+// Writes the number of entities per type and state, the seconds left of the
+// locks and the number of reservations as Prometheus gauges.
+func WriteStatusPrometheus(w io.Writer, st *StatusV2) error {
+
+	var b strings.Builder
+
+	b.WriteString("# HELP nodelocker_entities Envs and hosts per state, hosts are known while locked or reserved.\n")
+	b.WriteString("# TYPE nodelocker_entities gauge\n")
+	for _, enType := range []string{C_TYPE_ENV, C_TYPE_HOST} {
+		list := st.Envs
+		if enType == C_TYPE_HOST {
+			list = st.Hosts
+		}
+		counts := make(map[string]int)
+		for _, e := range list {
+			counts[e.State]++
+		}
+		for _, state := range entityStates {
+			fmt.Fprintf(&b, "nodelocker_entities{type=\"%s\",state=\"%s\"} %d\n", enType, state, counts[state])
+		}
+	}
+
+	b.WriteString("# HELP nodelocker_lock_ttl_seconds Seconds left of the locks.\n")
+	b.WriteString("# TYPE nodelocker_lock_ttl_seconds gauge\n")
+	for _, e := range append(st.Envs, st.Hosts...) {
+		if e.State == C_STATE_LOCKED {
+			fmt.Fprintf(&b, "nodelocker_lock_ttl_seconds{type=\"%s\",name=\"%s\",owner=\"%s\"} %d\n", e.Type, promLabel(e.Name), promLabel(e.Owner), e.TTL)
+		}
+	}
+
+	b.WriteString("# HELP nodelocker_reservations Reservations of the entities.\n")
+	b.WriteString("# TYPE nodelocker_reservations gauge\n")
+	for _, e := range append(st.Envs, st.Hosts...) {
+		if len(e.Reservations) > 0 {
+			fmt.Fprintf(&b, "nodelocker_reservations{type=\"%s\",name=\"%s\"} %d\n", e.Type, promLabel(e.Name), len(e.Reservations))
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,266 @@
+package x
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+)
+
+const (
+	C_HISTORY_MAX     int           = 1000                // events returned by one query at most
+	C_HISTORY_MAX_AGE time.Duration = 90 * 24 * time.Hour // events older are pruned
+	C_SWEEP_PERIOD    time.Duration = 30 * time.Second    // expiry sweeper period
+	C_PRUNE_PERIOD    time.Duration = time.Hour           // history pruner period
+)
+
+// eventActions are the actions of the history, what an EventFilter can
+// select.
+var eventActions = []string{
+	C_EV_LOCK, C_EV_UNLOCK, C_EV_EXTEND, C_EV_EXPIRE, C_EV_USER_PURGE,
+	C_EV_ENV_CREATE, C_EV_ENV_MAXLOCK, C_EV_ENV_UNLOCK, C_EV_ENV_MAINT,
+	C_EV_ENV_TERM, C_EV_HOST_UNLOCK,
+}
+
+// eventHooks are called with every recorded event, see OnEvent.
+var eventHooks []func(e Event)
+
+// Wants: function to call with every recorded event, registered before
+// serving, it's called concurrently
+func OnEvent(hook func(e Event)) {
+
+	eventHooks = append(eventHooks, hook)
+}
+
+// Wants: event without ID, Time is set to now if empty
+//
+// Appends the event to the history and passes it to the hooks.
+func Emit(e *Event) {
+
+	if e.Time == "" {
+		e.Time = time.Now().UTC().Format(time.RFC3339)
+	}
+
+	if err := DB.HistoryAdd(e); err != nil {
+		fmt.Printf("%s Cannot record '%s' of %s:%s: %s\n", C_FAILED, e.Action, e.Type, e.Name, err)
+		e.ID = 0 // not recorded, its ID may be given again
+	}
+
+	for _, hook := range eventHooks {
+		hook(*e)
+	}
+}
+
+// Wants: action, the request (User is the actor), the entity as it was
+// before the change, nil if the action leaves its lock state alone, e.g.
+// user-purge or env-maxlock
+//
+// Records the change with the current state of the entity.
+func RecordChange(action string, c *LockData, prev *LockData) {
+
+	e := &Event{
+		Action: action,
+		Type:   c.Type,
+		Name:   c.Name,
+		Actor:  c.User,
+		IP:     c.IP,
+	}
+
+	if prev != nil {
+		cur := DB.LockGetter(c.Type + ":" + c.Name)
+
+		// the owner, the previous one if the lock has gone
+		e.User = cur.User
+		if e.User == "" {
+			e.User = prev.User
+		}
+		e.PrevState = prev.State
+		e.NewState = cur.State
+		e.Expire = cur.Expire
+		e.PrevExpire = prev.Expire
+	}
+
+	Emit(e)
+}
+
+// Wants: the lease of an expired lock
+//
+// Records the expiry, recreates the env if its lock took it away and hands
+// the entity over to its queue.
+func EntityExpired(l Lease) {
+
+	enType, enName := splitKey(l.Key)
+
+	cur := DB.LockGetter(l.Key)
+	if cur.HttpErr != http.StatusNoContent && (cur.State != C_STATE_LOCKED || cur.User != l.User || cur.Expire != l.Expire) {
+		return // extended, unlocked or terminated meanwhile, not expired
+	}
+
+	// an env is a single key, it's gone with the expiry of its lock, unless
+	// written again since
+	if enType == C_TYPE_ENV && cur.HttpErr == http.StatusNoContent {
+		EnvRestore(enName)
+	}
+
+	Emit(&Event{
+		Action:     C_EV_EXPIRE,
+		Type:       enType,
+		Name:       enName,
+		User:       l.User,
+		PrevState:  C_STATE_LOCKED,
+		NewState:   DB.LockGetter(l.Key).State,
+		PrevExpire: l.Expire,
+	})
+	fmt.Printf("%s %s lock of '%s' expired at %s\n", C_SUCCESS, l.Key, l.User, l.Expire)
+
+	PromoteQueue(enType, enName)
+}
+
+// Wants: time between two sweeps, channel closed to stop
+//
+// Records the locks as the store expires them, and sweeps the expired leases
+// periodically for those it couldn't tell about, e.g. while disconnected or
+// without notifications.
+func RunExpiryWatcher(interval time.Duration, stop <-chan struct{}) {
+
+	expired, err := DB.WatchExpired(stop)
+	if err != nil {
+		fmt.Printf("%s No expiry notifications (%s), sweeping every %s\n", C_FAILED, err, interval)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case key, ok := <-expired:
+			if !ok { // the subscription has ended, the sweeps go on
+				expired = nil
+				continue
+			}
+			if l, ok := DB.LeaseTake(key, time.Now()); ok {
+				EntityExpired(l)
+			}
+		case <-ticker.C:
+			for _, l := range DB.LeasesExpired(time.Now()) {
+				EntityExpired(l)
+			}
+		}
+	}
+}
+
+// Wants: time between two runs, age of the oldest events kept, 0 to keep
+// them all, channel closed to stop
+//
+// Prunes the history on start and periodically.
+func RunHistoryPruner(interval time.Duration, maxAge time.Duration, stop <-chan struct{}) {
+
+	if maxAge == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if pruned, err := DB.HistoryPrune(time.Now().Add(-maxAge)); err != nil {
+			fmt.Printf("%s Cannot prune the history: %s\n", C_FAILED, err)
+		} else if pruned > 0 {
+			fmt.Printf("%s %d events older than %s pruned from the history\n", C_SUCCESS, pruned, maxAge)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Wants: YYYYMMDD date (midnight in the server's default timezone) or
+// RFC 3339 timestamp, "" for the beginning
+//
+// Returns: the instant, `false` if it's not valid
+func ParseSince(since string) (time.Time, bool) {
+
+	if since == "" {
+		return time.Time{}, true
+	}
+
+	if IsValidDate(since) {
+		t, _ := time.ParseInLocation("20060102", since, DefaultTZ)
+		return t, true
+	}
+
+	t, err := time.Parse(time.RFC3339, since)
+	return t, err == nil
+}
+
+// Wants: filters: entity type and name, user as actor or owner, "" for any,
+// start of the period
+//
+// Returns: fills the matching events, the latest C_HISTORY_MAX of them
+func EntityHistory(enType string, enName string, user string, since time.Time, res *WebResponse) {
+
+	res.History = make([]Event, 0)
+
+	for _, e := range DB.HistoryList(since) {
+		if enType != "" && e.Type != enType {
+			continue
+		}
+		if enName != "" && e.Name != enName {
+			continue
+		}
+		if user != "" && e.Actor != user && e.User != user {
+			continue
+		}
+		res.History = append(res.History, e)
+	}
+
+	if len(res.History) > C_HISTORY_MAX {
+		res.History = res.History[len(res.History)-C_HISTORY_MAX:]
+	}
+
+	res.Messages = append(res.Messages, OK_History)
+}
+
+// Wants: actions of an event filter
+//
+// Returns: `true` if every item is an action of the history
+func IsValidActions(events []string) bool {
+
+	for _, e := range events {
+		if !slices.Contains(eventActions, e) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Wants: recorded event
+//
+// Returns: `true` if the event passes the filter, the env of a host is the
+// env it belongs to, the user is the actor or the owner
+func (f EventFilter) Matches(e Event) bool {
+
+	if len(f.Events) > 0 && !slices.Contains(f.Events, e.Action) {
+		return false
+	}
+
+	if len(f.Envs) > 0 && (e.Type == C_TYPE_USER || !slices.Contains(f.Envs, envOf(e.Type, e.Name))) {
+		return false
+	}
+
+	if len(f.Hosts) > 0 && (e.Type != C_TYPE_HOST || !slices.Contains(f.Hosts, e.Name)) {
+		return false
+	}
+
+	if len(f.Users) > 0 && !slices.Contains(f.Users, e.Actor) && !slices.Contains(f.Users, e.User) {
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,197 @@
+package x
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordEvents collects the events emitted during the test.
+func recordEvents(t *testing.T) func() []Event {
+
+	var mu sync.Mutex
+	var events []Event
+
+	prev := eventHooks
+	eventHooks = append(eventHooks[:len(eventHooks):len(eventHooks)], func(e Event) {
+		mu.Lock()
+		events = append(events, e)
+		mu.Unlock()
+	})
+	t.Cleanup(func() { eventHooks = prev })
+
+	return func() []Event {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]Event(nil), events...)
+	}
+}
+
+func TestExpiryRecordedOnce(t *testing.T) {
+
+	forEachStore(t, func(t *testing.T) {
+		events := recordEvents(t)
+		EnvCreate("env1")
+
+		c := &LockData{Type: C_TYPE_HOST, Name: "env1-host1", User: "user1"}
+		expire, ok := ParseExpiry("", "2s", DefaultTZ)
+		if !ok {
+			t.Fatal("invalid for=2s")
+		}
+		SetExpiry(c, expire)
+		if res := new(WebResponse); !HostLock(c, res) {
+			t.Fatal(res.Messages)
+		}
+
+		// terminated by the admin while locked, it stays terminated
+		EnvCreate("env2")
+		env := &LockData{Type: C_TYPE_ENV, Name: "env2", User: "user2"}
+		SetExpiry(env, expire)
+		if res := new(WebResponse); !EnvLock(env, res) {
+			t.Fatal(res.Messages)
+		}
+		EnvTerminate("env2")
+		// the lease taken by a sweep just before the termination
+		EntityExpired(Lease{Key: C_TYPE_ENV + ":env2", User: "user2", Expire: env.Expire})
+		if EnvRestore("env2") {
+			t.Error("terminated env2 restored")
+		}
+
+		// two instances watch and sweep the same store
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				RunExpiryWatcher(50*time.Millisecond, stop)
+			}()
+		}
+		time.Sleep(time.Until(expire) + time.Second)
+		close(stop)
+		wg.Wait()
+
+		expired := 0
+		for _, e := range events() {
+			if e.Action == C_EV_EXPIRE {
+				expired++
+				if e.Name != "env1-host1" || e.User != "user1" || e.PrevExpire != c.Expire {
+					t.Errorf("expire event %+v", e)
+				}
+			}
+		}
+		if expired != 1 {
+			t.Errorf("%d expire events, want 1", expired)
+		}
+
+		recorded := 0
+		for _, e := range DB.HistoryList(time.Time{}) {
+			if e.Action == C_EV_EXPIRE {
+				recorded++
+			}
+		}
+		if recorded != 1 {
+			t.Errorf("%d expiries in the history, want 1", recorded)
+		}
+
+		if l := DB.LockGetter(C_TYPE_HOST + ":env1-host1"); l.State == C_STATE_LOCKED {
+			t.Errorf("env1-host1 is %+v, want expired", l)
+		}
+		if l := DB.LockGetter(C_TYPE_ENV + ":env2"); l.State != C_STATE_TERMINATED {
+			t.Errorf("env2 is %+v, want terminated", l)
+		}
+	})
+}
+
+// The previous state comes from the store operation that made the change.
+func TestChangesRecordPreviousState(t *testing.T) {
+
+	forEachStore(t, func(t *testing.T) {
+		events := recordEvents(t)
+		EnvCreate("env1")
+
+		c := lockRequest(C_TYPE_HOST, "env1-host1", "user1")
+		if res := new(WebResponse); !HostLock(c, res) {
+			t.Fatal(res.Messages)
+		}
+		locked := c.Expire
+
+		ext := &LockData{Type: C_TYPE_HOST, Name: "env1-host1", User: "user1"}
+		SetExpiry(ext, time.Now().Add(2*time.Hour).Truncate(time.Second))
+		res := new(WebResponse)
+		if !EntityExtend(ext, res) {
+			t.Fatal(res.Messages)
+		}
+		if res.PrevExpire != locked {
+			t.Errorf("extend: previous expiry %q, want %q", res.PrevExpire, locked)
+		}
+
+		if res := new(WebResponse); !EntityUnlock(&LockData{Type: C_TYPE_HOST, Name: "env1-host1", User: "user1"}, res) {
+			t.Fatal(res.Messages)
+		}
+
+		if _, prev := EnvMaintenance("env1"); prev.State != C_STATE_VALID {
+			t.Errorf("maintenance: previous state %q, want %q", prev.State, C_STATE_VALID)
+		}
+		if _, prev := EnvUnlock("env1"); prev.State != C_STATE_MAINTENANCE {
+			t.Errorf("env unlock: previous state %q, want %q", prev.State, C_STATE_MAINTENANCE)
+		}
+
+		// a user has no lock state, before or after
+		addUser(t, "user1", "pass1")
+		DB.EntityDelete("user", "user1")
+		RecordChange(C_EV_USER_PURGE, &LockData{Type: C_TYPE_USER, Name: "user1", User: C_ADMIN}, nil)
+
+		want := []Event{
+			{Action: C_EV_LOCK, User: "user1", NewState: C_STATE_LOCKED, Expire: locked},
+			{Action: C_EV_EXTEND, User: "user1", PrevState: C_STATE_LOCKED, NewState: C_STATE_LOCKED, Expire: ext.Expire, PrevExpire: locked},
+			{Action: C_EV_UNLOCK, User: "user1", PrevState: C_STATE_LOCKED, PrevExpire: ext.Expire},
+			{Action: C_EV_USER_PURGE},
+		}
+		got := events()
+		if len(got) != len(want) {
+			t.Fatalf("%d events, want %d: %+v", len(got), len(want), got)
+		}
+		for i, e := range got {
+			w := want[i]
+			if e.Action != w.Action || e.User != w.User || e.PrevState != w.PrevState || e.NewState != w.NewState ||
+				e.Expire != w.Expire || e.PrevExpire != w.PrevExpire {
+				t.Errorf("event %d: %+v, want %+v", i, e, w)
+			}
+		}
+	})
+}
+
+func TestHistoryPruneAndSince(t *testing.T) {
+
+	forEachStore(t, func(t *testing.T) {
+		now := time.Now().Truncate(time.Second)
+		for _, days := range []int{100, 30, 2, 0} {
+			Emit(&Event{
+				Action: C_EV_LOCK, Type: C_TYPE_ENV, Name: fmt.Sprintf("env%d", days),
+				Time: now.Add(-time.Duration(days) * 24 * time.Hour).UTC().Format(time.RFC3339),
+			})
+		}
+
+		names := func(since time.Time) []string {
+			names := make([]string, 0)
+			for _, e := range DB.HistoryList(since) {
+				names = append(names, e.Name)
+			}
+			return names
+		}
+
+		if got := names(now.Add(-3 * 24 * time.Hour)); !slices.Equal(got, []string{"env2", "env0"}) {
+			t.Errorf("since 3 days: %v, want env2 env0", got)
+		}
+
+		if pruned, err := DB.HistoryPrune(now.Add(-C_HISTORY_MAX_AGE)); err != nil || pruned != 1 {
+			t.Errorf("pruned %d (%v), want 1", pruned, err)
+		}
+		if got := names(time.Time{}); !slices.Equal(got, []string{"env30", "env2", "env0"}) {
+			t.Errorf("after pruning: %v, want env30 env2 env0", got)
+		}
+	})
+}
@@ -0,0 +1,1204 @@
+package x
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// localEntry is a hash with its optional expiry instant, the unit the
+// local engines store under a key.
+type localEntry struct {
+	Fields   map[string]string `json:"fields"`
+	ExpireAt time.Time         `json:"expireat,omitempty"`
+}
+
+func (e *localEntry) expired(now time.Time) bool {
+
+	return !e.ExpireAt.IsZero() && !now.Before(e.ExpireAt)
+}
+
+// localTx is a transaction of a local engine. Expired entries are not
+// returned by it.
+type localTx interface {
+	get(key string) (*localEntry, bool)
+	put(key string, e *localEntry) error
+	del(key string) error
+	keys(prefix string) []string // sorted
+	// sorted, from the first key not before `from` on
+	keysFrom(prefix string, from string) []string
+}
+
+// localEngine is a key space with transactions, LocalStore builds on it.
+type localEngine interface {
+	view(fn func(tx localTx) error) error
+	update(fn func(tx localTx) error) error
+	close() error
+}
+
+// LocalStore implements Store on top of a local engine, it mimics the
+// Redis hashes and key expiry nodelocker relies on.
+type LocalStore struct {
+	engine   localEngine
+	volatile localEngine // rate limit counters, never persisted
+}
+
+// Wants: n/a
+//
+// Returns: a process-local, non-persistent Store, e.g. for CI
+func NewMemStore() *LocalStore {
+
+	return &LocalStore{
+		engine:   newMemEngine(),
+		volatile: newMemEngine(),
+	}
+}
+
+func (s *LocalStore) Ping() error {
+
+	return s.engine.view(func(tx localTx) error { return nil })
+}
+
+func (s *LocalStore) Close() error {
+
+	return s.engine.close()
+}
+
+func (s *LocalStore) GetSingle(key string, field string) any {
+
+	var value string
+
+	_ = s.engine.view(func(tx localTx) error {
+		if e, ok := tx.get(key); ok {
+			value = e.Fields[field]
+		}
+		return nil
+	})
+
+	if value == "" {
+		return nil
+	}
+
+	return value
+}
+
+func (s *LocalStore) SetSingle(key string, field string, value any) bool {
+
+	err := s.engine.update(func(tx localTx) error {
+		e, ok := tx.get(key)
+		if !ok {
+			e = &localEntry{Fields: make(map[string]string)}
+		}
+		e.Fields[field] = fmt.Sprint(value)
+		return tx.put(key, e)
+	})
+
+	return err == nil
+}
+
+func (s *LocalStore) GetAll(key string) map[string]string {
+
+	fields := make(map[string]string)
+
+	_ = s.engine.view(func(tx localTx) error {
+		if e, ok := tx.get(key); ok {
+			for field, value := range e.Fields {
+				fields[field] = value
+			}
+		}
+		return nil
+	})
+
+	return fields
+}
+
+func (s *LocalStore) LockGetter(key string) *LockData {
+
+	var fields map[string]string
+
+	_ = s.engine.view(func(tx localTx) error {
+		if e, ok := tx.get(key); ok {
+			fields = e.Fields
+		}
+		return nil
+	})
+
+	return lockDataFrom(fields)
+}
+
+// Wants: fields of an entity, nil if it's missing
+//
+// Returns: LockData of the entity, StatusNoContent if there is no record
+func lockDataFrom(fields map[string]string) *LockData {
+
+	c := new(LockData)
+
+	if _, ok := fields["parent"]; !ok { // no record found
+		c.HttpErr = http.StatusNoContent
+		return c
+	}
+
+	c.Parent = fields["parent"]
+	c.State = fields["state"]
+	c.User = fields["user"]
+	c.LastDay = fields["lastday"]
+	c.Expire = fields["expire"]
+	c.HttpErr = http.StatusOK
+
+	return c
+}
+
+func (s *LocalStore) LockSetter(c *LockData) (bool, *LockData) {
+
+	written, prev := s.lockSet(c, false)
+	return written, prev
+}
+
+func (s *LocalStore) LockSetterIfAbsent(c *LockData) bool {
+
+	written, _ := s.lockSet(c, true)
+	return written
+}
+
+func (s *LocalStore) lockSet(c *LockData, ifAbsent bool) (bool, *LockData) {
+
+	key := c.Type + ":" + c.Name
+	var prev *LockData
+	written := false
+
+	err := s.engine.update(func(tx localTx) error {
+		e, ok := tx.get(key)
+		if !ok {
+			e = &localEntry{Fields: make(map[string]string)}
+		}
+		prev = lockDataFrom(e.Fields)
+		if ok && ifAbsent {
+			return nil
+		}
+		oldState, oldUser := e.Fields["state"], e.Fields["user"]
+
+		e.Fields["state"] = c.State
+		e.Fields["parent"] = c.Parent
+		e.Fields["user"] = c.User
+		e.Fields["lastday"] = c.LastDay
+		e.Fields["expire"] = ""
+		e.Fields["since"] = ""
+		e.ExpireAt = time.Time{}
+		if err := tx.put(key, e); err != nil {
+			return err
+		}
+		if err := putLease(tx, key, ""); err != nil {
+			return err
+		}
+		written = true
+		return reindex(tx, key, oldState, oldUser, c.State, c.User)
+	})
+
+	return err == nil && written, prev
+}
+
+// Moves an entity between the state and user indexes, same as the Lua
+// helper in x_redis.go.
+func reindex(tx localTx, key string, oldState string, oldUser string, newState string, newUser string) error {
+
+	change := []struct {
+		index string
+		value string
+		add   bool
+	}{
+		{C_IDX_STATE, oldState, false},
+		{C_IDX_USER, oldUser, false},
+		{C_IDX_STATE, newState, true},
+		{C_IDX_USER, newUser, true},
+	}
+
+	for _, ch := range change {
+		if ch.value == "" {
+			continue
+		}
+
+		setKey := ch.index + ":" + ch.value
+		set, ok := tx.get(setKey)
+		if !ok {
+			set = &localEntry{Fields: make(map[string]string)}
+		}
+
+		if ch.add {
+			set.Fields[key] = ""
+		} else {
+			delete(set.Fields, key)
+		}
+		if err := putSet(tx, setKey, set); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Sets are stored as entries with the members as fields.
+func (s *LocalStore) lockedHosts(tx localTx, envName string) *localEntry {
+
+	set, ok := tx.get(C_ENV_HOSTS + ":" + envName)
+	if !ok {
+		return &localEntry{Fields: make(map[string]string)}
+	}
+
+	// drop the hosts whose lock has expired since
+	for host := range set.Fields {
+		if _, ok := tx.get(C_TYPE_HOST + ":" + host); !ok {
+			delete(set.Fields, host)
+		}
+	}
+
+	return set
+}
+
+func putSet(tx localTx, key string, set *localEntry) error {
+
+	if len(set.Fields) == 0 {
+		return tx.del(key)
+	}
+
+	return tx.put(key, set)
+}
+
+func (s *LocalStore) LockAcquire(c *LockData, expire time.Duration) (*RichErrorStatus, *LockData) {
+
+	if expire <= 0 {
+		return acqStatus(acqExpired, ""), lockDataFrom(nil)
+	}
+
+	key := c.Type + ":" + c.Name
+	env := envOf(c.Type, c.Name)
+	var result string
+	prev := lockDataFrom(nil)
+
+	err := s.engine.update(func(tx localTx) error {
+		e, ok := tx.get(key)
+		if !ok {
+			e = &localEntry{Fields: make(map[string]string)}
+		}
+		prev = lockDataFrom(e.Fields)
+
+		var envState string
+		envEntry, envExists := tx.get(C_TYPE_ENV + ":" + env)
+		if envExists {
+			envState, envExists = envEntry.Fields["state"]
+		}
+		maxLock := getMaxLock(tx, env)
+		set := s.lockedHosts(tx, env)
+
+		queue := getQueue(tx, key)
+		var queueHead string
+		if len(queue) > 0 {
+			queueHead = queue[0].User
+		}
+
+		oldState, oldUser := e.Fields["state"], e.Fields["user"]
+
+		// a lock renewed by its owner is counted from its start
+		now := time.Now()
+		since, err := strconv.ParseInt(e.Fields["since"], 10, 64)
+		if oldState != C_STATE_LOCKED || oldUser != c.User || err != nil {
+			since = now.Unix()
+		}
+		tooLong := overMaxLock(since, now.Add(expire).Unix(), maxLock)
+
+		result = lockDecision(c, oldUser, envState, envExists, len(set.Fields), queueHead, getCalendar(tx, key), tooLong)
+		if result != acqOK {
+			return nil
+		}
+
+		e.Fields["state"] = c.State
+		e.Fields["parent"] = c.Parent
+		e.Fields["user"] = c.User
+		e.Fields["lastday"] = c.LastDay
+		e.Fields["expire"] = c.Expire
+		e.Fields["since"] = strconv.FormatInt(since, 10)
+		e.ExpireAt = now.Add(expire)
+		if err := tx.put(key, e); err != nil {
+			return err
+		}
+		if err := reindex(tx, key, oldState, oldUser, c.State, c.User); err != nil {
+			return err
+		}
+		if l, ok := leaseOf(key, c.State, c.User, c.Expire); ok {
+			if err := putLease(tx, key, l); err != nil {
+				return err
+			}
+		}
+
+		if queueHead == c.User {
+			if err := putQueue(tx, key, queue[1:]); err != nil {
+				return err
+			}
+		}
+
+		if c.Type == C_TYPE_HOST {
+			set.Fields[c.Name] = ""
+		}
+		return putSet(tx, C_ENV_HOSTS+":"+env, set)
+	})
+	if err != nil {
+		fmt.Printf("%s Lock failed on '%s': %s\n", C_FAILED, key, err)
+		result = ""
+	}
+
+	failMessage := ERR_HostLockFail
+	if c.Type == C_TYPE_ENV {
+		failMessage = ERR_EnvLockFail
+	}
+
+	return acqStatus(result, failMessage), prev
+}
+
+func (s *LocalStore) LockRelease(c *LockData) (*RichErrorStatus, *LockData) {
+
+	key := c.Type + ":" + c.Name
+	env := envOf(c.Type, c.Name)
+	var result string
+	prev := lockDataFrom(nil)
+
+	err := s.engine.update(func(tx localTx) error {
+		e, ok := tx.get(key)
+		if !ok {
+			e = &localEntry{Fields: make(map[string]string)}
+		}
+		prev = lockDataFrom(e.Fields)
+
+		oldState, oldUser := e.Fields["state"], e.Fields["user"]
+
+		result = releaseDecision(c, oldState, oldUser)
+		if result != acqOK {
+			return nil
+		}
+
+		if err := putLease(tx, key, ""); err != nil {
+			return err
+		}
+
+		if c.Type == C_TYPE_HOST {
+			if err := tx.del(key); err != nil {
+				return err
+			}
+			if err := reindex(tx, key, oldState, oldUser, "", ""); err != nil {
+				return err
+			}
+			set := s.lockedHosts(tx, env)
+			delete(set.Fields, c.Name)
+			return putSet(tx, C_ENV_HOSTS+":"+env, set)
+		}
+
+		e.Fields["state"] = C_STATE_VALID
+		e.Fields["parent"] = ""
+		e.Fields["user"] = ""
+		e.Fields["lastday"] = ""
+		e.Fields["expire"] = ""
+		e.Fields["since"] = ""
+		e.ExpireAt = time.Time{}
+		if err := tx.put(key, e); err != nil {
+			return err
+		}
+		return reindex(tx, key, oldState, oldUser, C_STATE_VALID, "")
+	})
+	if err != nil {
+		fmt.Printf("%s Unlock failed on '%s': %s\n", C_FAILED, key, err)
+		result = ""
+	}
+
+	failMessage := ERR_HostUnlockFail
+	if c.Type == C_TYPE_ENV {
+		failMessage = ERR_EnvUnlockFail
+	}
+
+	return acqStatus(result, failMessage), prev
+}
+
+func (s *LocalStore) LockExtend(c *LockData, expire time.Duration) (*RichErrorStatus, *LockData) {
+
+	key := c.Type + ":" + c.Name
+	env := envOf(c.Type, c.Name)
+	var result string
+	prev := lockDataFrom(nil)
+
+	err := s.engine.update(func(tx localTx) error {
+		e, ok := tx.get(key)
+		if !ok {
+			e = &localEntry{Fields: make(map[string]string)}
+		}
+		prev = lockDataFrom(e.Fields)
+
+		maxLock := getMaxLock(tx, env)
+
+		now := time.Now()
+		since, err := strconv.ParseInt(e.Fields["since"], 10, 64)
+		if err != nil {
+			since = now.Unix()
+		}
+		notLater := !now.Add(expire).After(e.ExpireAt)
+		tooLong := overMaxLock(since, now.Add(expire).Unix(), maxLock)
+
+		result = extendDecision(c, e.Fields["state"], e.Fields["user"], notLater, getCalendar(tx, key), tooLong)
+		if result != acqOK {
+			return nil
+		}
+
+		e.Fields["lastday"] = c.LastDay
+		e.Fields["expire"] = c.Expire
+		e.Fields["since"] = strconv.FormatInt(since, 10)
+		e.ExpireAt = now.Add(expire)
+		if err := tx.put(key, e); err != nil {
+			return err
+		}
+		l, _ := leaseOf(key, e.Fields["state"], e.Fields["user"], c.Expire)
+		return putLease(tx, key, l)
+	})
+	if err != nil {
+		fmt.Printf("%s Extend failed on '%s': %s\n", C_FAILED, key, err)
+		result = ""
+	}
+
+	return acqStatus(result, ERR_ExtendFail), prev
+}
+
+func (s *LocalStore) EntityDelete(enType string, enName string) bool {
+
+	err := s.engine.update(func(tx localTx) error {
+		e, ok := tx.get(enType)
+		if !ok {
+			return nil
+		}
+		delete(e.Fields, enName)
+		if len(e.Fields) == 0 {
+			return tx.del(enType)
+		}
+		return tx.put(enType, e)
+	})
+
+	return err == nil
+}
+
+func (s *LocalStore) GetHostsInEnv(envName string) []string {
+
+	var resultList []string
+
+	_ = s.engine.view(func(tx localTx) error {
+		for host := range s.lockedHosts(tx, envName).Fields {
+			resultList = append(resultList, C_TYPE_HOST+":"+host)
+		}
+		return nil
+	})
+	sort.Strings(resultList)
+
+	return resultList
+}
+
+// Wants: index set, the entity field the index is built on, its value
+//
+// Returns: sorted entity keys of the index, without the stale members
+func liveMembers(tx localTx, index string, field string, value string) []string {
+
+	resultList := make([]string, 0)
+
+	set, ok := tx.get(index)
+	if !ok {
+		return resultList
+	}
+
+	// expired entries leave their members behind
+	for key := range set.Fields {
+		if e, ok := tx.get(key); ok && e.Fields[field] == value {
+			resultList = append(resultList, key)
+		}
+	}
+	sort.Strings(resultList)
+
+	return resultList
+}
+
+func (s *LocalStore) EntitiesInState(state string) []string {
+
+	var resultList []string
+
+	_ = s.engine.view(func(tx localTx) error {
+		resultList = liveMembers(tx, C_IDX_STATE+":"+state, "state", state)
+		return nil
+	})
+
+	return resultList
+}
+
+func (s *LocalStore) EntitiesOfUser(user string) []string {
+
+	var resultList []string
+
+	_ = s.engine.view(func(tx localTx) error {
+		resultList = liveMembers(tx, C_IDX_USER+":"+user, "user", user)
+		return nil
+	})
+
+	return resultList
+}
+
+func (s *LocalStore) RebuildIndexes() error {
+
+	return s.engine.update(func(tx localTx) error {
+		for _, index := range []string{C_ENV_HOSTS, C_IDX_STATE, C_IDX_USER} {
+			for _, key := range tx.keys(index + ":") {
+				if err := tx.del(key); err != nil {
+					return err
+				}
+			}
+		}
+
+		sets := make(map[string]*localEntry)
+		add := func(setKey string, member string) {
+			if sets[setKey] == nil {
+				sets[setKey] = &localEntry{Fields: make(map[string]string)}
+			}
+			sets[setKey].Fields[member] = ""
+		}
+
+		for _, enType := range []string{C_TYPE_ENV, C_TYPE_HOST} {
+
+			prefixLen := len(enType) + 1
+
+			for _, key := range tx.keys(enType + ":") {
+				e, ok := tx.get(key)
+				if !ok {
+					continue
+				}
+				if state := e.Fields["state"]; state != "" {
+					add(C_IDX_STATE+":"+state, key)
+				}
+				if user := e.Fields["user"]; user != "" {
+					add(C_IDX_USER+":"+user, key)
+				}
+				if enType == C_TYPE_HOST && e.Fields["state"] == C_STATE_LOCKED {
+					add(C_ENV_HOSTS+":"+e.Fields[C_PARENT], key[prefixLen:])
+				}
+				if l, ok := leaseOf(key, e.Fields["state"], e.Fields["user"], e.Fields["expire"]); ok {
+					leases, _ := tx.get(C_LEASES)
+					if leases == nil || leases.Fields[key] == "" {
+						if err := putLease(tx, key, l); err != nil {
+							return err
+						}
+					}
+				}
+			}
+		}
+
+		for setKey, set := range sets {
+			if err := putSet(tx, setKey, set); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *LocalStore) ScanKeys(matchPattern string) []string {
+
+	var keys []string
+
+	_ = s.engine.view(func(tx localTx) error {
+		keys = tx.keys(matchPattern + ":")
+		return nil
+	})
+
+	return keys
+}
+
+func (s *LocalStore) FillJsonStats(r *Stats) {
+
+	_ = s.engine.view(func(tx localTx) error {
+		for _, state := range []string{C_STATE_VALID, C_STATE_LOCKED, C_STATE_MAINTENANCE, C_STATE_TERMINATED} {
+			for _, key := range liveMembers(tx, C_IDX_STATE+":"+state, "state", state) {
+				if e, ok := tx.get(key); ok {
+					enType, enName := splitKey(key)
+					fillStatsEntry(r, enType, enName, e.Fields)
+				}
+			}
+		}
+		if calendars, ok := tx.get(C_CALENDARS); ok {
+			keys := make([]string, 0, len(calendars.Fields))
+			for key := range calendars.Fields {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				enType, enName := splitKey(key)
+				fillReservationStats(r, enType, enName, getCalendar(tx, key))
+			}
+		}
+		return nil
+	})
+}
+
+func (s *LocalStore) FillStatus(r *StatusV2, keys []string, now time.Time) {
+
+	_ = s.engine.view(func(tx localTx) error {
+		for _, key := range keys {
+			if e, ok := tx.get(key); ok {
+				enType, enName := splitKey(key)
+				fillStatusEntry(r, enType, enName, e.Fields, now)
+			}
+		}
+		if calendars, ok := tx.get(C_CALENDARS); ok {
+			for key := range calendars.Fields {
+				enType, enName := splitKey(key)
+				fillStatusReservations(r, enType, enName, getCalendar(tx, key))
+			}
+		}
+		return nil
+	})
+}
+
+// Queues are stored as entries with the JSON encoded items in one field.
+func getQueue(tx localTx, enKey string) []QueueEntry {
+
+	queue := make([]QueueEntry, 0)
+
+	if e, ok := tx.get(C_QUEUE + ":" + enKey); ok {
+		_ = json.Unmarshal([]byte(e.Fields["items"]), &queue)
+	}
+
+	return queue
+}
+
+func putQueue(tx localTx, enKey string, queue []QueueEntry) error {
+
+	queues, ok := tx.get(C_QUEUES)
+	if !ok {
+		queues = &localEntry{Fields: make(map[string]string)}
+	}
+
+	if len(queue) == 0 {
+		delete(queues.Fields, enKey)
+		if err := tx.del(C_QUEUE + ":" + enKey); err != nil {
+			return err
+		}
+		return putSet(tx, C_QUEUES, queues)
+	}
+
+	items, err := json.Marshal(queue)
+	if err != nil {
+		return err
+	}
+
+	queues.Fields[enKey] = ""
+	if err := tx.put(C_QUEUE+":"+enKey, &localEntry{Fields: map[string]string{"items": string(items)}}); err != nil {
+		return err
+	}
+	return putSet(tx, C_QUEUES, queues)
+}
+
+func (s *LocalStore) QueueJoin(c *LockData) (int, error) {
+
+	key := c.Type + ":" + c.Name
+	var pos int
+
+	err := s.engine.update(func(tx localTx) error {
+		queue := getQueue(tx, key)
+
+		for i, q := range queue {
+			if q.User == c.User {
+				queue[i].LastDay = c.LastDay
+				queue[i].Expire = c.Expire
+				queue[i].For = c.For
+				pos = i + 1
+				return putQueue(tx, key, queue)
+			}
+		}
+
+		queue = append(queue, QueueEntry{User: c.User, LastDay: c.LastDay, Expire: c.Expire, For: c.For})
+		pos = len(queue)
+		return putQueue(tx, key, queue)
+	})
+
+	return pos, err
+}
+
+func (s *LocalStore) QueueLeave(c *LockData) (bool, error) {
+
+	key := c.Type + ":" + c.Name
+	var left bool
+
+	err := s.engine.update(func(tx localTx) error {
+		queue := getQueue(tx, key)
+
+		for i, q := range queue {
+			if q.User == c.User {
+				left = true
+				return putQueue(tx, key, append(queue[:i], queue[i+1:]...))
+			}
+		}
+		return nil
+	})
+
+	return left, err
+}
+
+func (s *LocalStore) QueueList(enType string, enName string) []QueueEntry {
+
+	var queue []QueueEntry
+
+	_ = s.engine.view(func(tx localTx) error {
+		queue = getQueue(tx, enType+":"+enName)
+		return nil
+	})
+
+	return queue
+}
+
+func (s *LocalStore) QueuedEntities() []string {
+
+	keys := make([]string, 0)
+
+	_ = s.engine.view(func(tx localTx) error {
+		if queues, ok := tx.get(C_QUEUES); ok {
+			for key := range queues.Fields {
+				keys = append(keys, key)
+			}
+		}
+		return nil
+	})
+	sort.Strings(keys)
+
+	return keys
+}
+
+// Calendars are stored like the queues, see getQueue.
+func getCalendar(tx localTx, enKey string) []Reservation {
+
+	calendar := make([]Reservation, 0)
+
+	if e, ok := tx.get(C_CALENDAR + ":" + enKey); ok {
+		_ = json.Unmarshal([]byte(e.Fields["items"]), &calendar)
+	}
+
+	return calendar
+}
+
+func putCalendar(tx localTx, enKey string, calendar []Reservation) error {
+
+	calendars, ok := tx.get(C_CALENDARS)
+	if !ok {
+		calendars = &localEntry{Fields: make(map[string]string)}
+	}
+
+	if len(calendar) == 0 {
+		delete(calendars.Fields, enKey)
+		if err := tx.del(C_CALENDAR + ":" + enKey); err != nil {
+			return err
+		}
+		return putSet(tx, C_CALENDARS, calendars)
+	}
+
+	items, err := json.Marshal(calendar)
+	if err != nil {
+		return err
+	}
+
+	calendars.Fields[enKey] = ""
+	if err := tx.put(C_CALENDAR+":"+enKey, &localEntry{Fields: map[string]string{"items": string(items)}}); err != nil {
+		return err
+	}
+	return putSet(tx, C_CALENDARS, calendars)
+}
+
+func (s *LocalStore) ReserveAdd(c *LockData) *RichErrorStatus {
+
+	key := c.Type + ":" + c.Name
+	var result string
+
+	err := s.engine.update(func(tx localTx) error {
+		e, ok := tx.get(key)
+		if !ok {
+			e = &localEntry{Fields: make(map[string]string)}
+		}
+		_, envExists := tx.get(C_TYPE_ENV + ":" + envOf(c.Type, c.Name))
+		calendar := getCalendar(tx, key)
+
+		result = reserveDecision(c, e.Fields["state"], e.Fields["user"], e.Fields["lastday"], envExists, calendar)
+		if result != acqOK {
+			return nil
+		}
+
+		// keep the calendar ordered by the first day
+		i := sort.Search(len(calendar), func(i int) bool { return calendar[i].FirstDay > c.FirstDay })
+		calendar = append(calendar[:i], append([]Reservation{{User: c.User, FirstDay: c.FirstDay, LastDay: c.LastDay, Expire: c.Expire}}, calendar[i:]...)...)
+
+		return putCalendar(tx, key, calendar)
+	})
+	if err != nil {
+		fmt.Printf("%s Reservation failed on '%s': %s\n", C_FAILED, key, err)
+		result = ""
+	}
+
+	return acqStatus(result, ERR_ReservationFail)
+}
+
+func (s *LocalStore) ReserveCancel(c *LockData) (bool, error) {
+
+	key := c.Type + ":" + c.Name
+	var canceled bool
+
+	err := s.engine.update(func(tx localTx) error {
+		calendar := getCalendar(tx, key)
+
+		for i, r := range calendar {
+			if r.FirstDay == c.FirstDay && (r.User == c.User || c.User == C_ADMIN) {
+				canceled = true
+				return putCalendar(tx, key, append(calendar[:i], calendar[i+1:]...))
+			}
+		}
+		return nil
+	})
+
+	return canceled, err
+}
+
+func (s *LocalStore) ReserveList(enType string, enName string) []Reservation {
+
+	var calendar []Reservation
+
+	_ = s.engine.view(func(tx localTx) error {
+		calendar = getCalendar(tx, enType+":"+enName)
+		return nil
+	})
+
+	return calendar
+}
+
+func (s *LocalStore) ReservedEntities() []string {
+
+	keys := make([]string, 0)
+
+	_ = s.engine.view(func(tx localTx) error {
+		if calendars, ok := tx.get(C_CALENDARS); ok {
+			for key := range calendars.Fields {
+				keys = append(keys, key)
+			}
+		}
+		return nil
+	})
+	sort.Strings(keys)
+
+	return keys
+}
+
+// Wants: env name
+//
+// Returns: the maximum lock duration of the env as stored, "" if none
+func getMaxLock(tx localTx, envName string) string {
+
+	if e, ok := tx.get(C_MAX_LOCK); ok {
+		return e.Fields[envName]
+	}
+
+	return ""
+}
+
+// Wants: entity key, JSON encoded lease, "" to remove it
+func putLease(tx localTx, key string, lease string) error {
+
+	leases, ok := tx.get(C_LEASES)
+	if !ok {
+		leases = &localEntry{Fields: make(map[string]string)}
+	}
+
+	if lease == "" {
+		delete(leases.Fields, key)
+	} else {
+		leases.Fields[key] = lease
+	}
+
+	return putSet(tx, C_LEASES, leases)
+}
+
+func (s *LocalStore) LeasesExpired(now time.Time) []Lease {
+
+	leases := make([]Lease, 0)
+
+	_ = s.engine.update(func(tx localTx) error {
+		e, ok := tx.get(C_LEASES)
+		if !ok {
+			return nil
+		}
+
+		for key, item := range e.Fields {
+			var l Lease
+			if json.Unmarshal([]byte(item), &l) != nil || l.ExpireAt > now.Unix() {
+				continue
+			}
+			leases = append(leases, l)
+			delete(e.Fields, key)
+		}
+
+		return putSet(tx, C_LEASES, e)
+	})
+	sort.Slice(leases, func(i, j int) bool { return leases[i].ExpireAt < leases[j].ExpireAt })
+
+	return leases
+}
+
+func (s *LocalStore) LeaseTake(key string, now time.Time) (Lease, bool) {
+
+	var l Lease
+	taken := false
+
+	_ = s.engine.update(func(tx localTx) error {
+		e, ok := tx.get(C_LEASES)
+		if !ok {
+			return nil
+		}
+
+		if json.Unmarshal([]byte(e.Fields[key]), &l) != nil || l.ExpireAt > now.Unix() {
+			return nil
+		}
+		taken = true
+		delete(e.Fields, key)
+
+		return putSet(tx, C_LEASES, e)
+	})
+
+	return l, taken
+}
+
+// The local engines expire entries lazily, on access, they have nothing to
+// tell.
+func (s *LocalStore) WatchExpired(stop <-chan struct{}) (<-chan string, error) {
+
+	return nil, fmt.Errorf("not supported by the local store")
+}
+
+// History events are stored one per key, `history:<unix time>:<id>`, both
+// zero padded, so they are sorted by time.
+func (s *LocalStore) HistoryAdd(e *Event) error {
+
+	t, err := time.Parse(time.RFC3339, e.Time)
+	if err != nil {
+		return err
+	}
+
+	// the ID is only given to the event once committed, a rolled back
+	// transaction gives it again
+	var id int64
+	err = s.engine.update(func(tx localTx) error {
+		meta, ok := tx.get(C_META)
+		if !ok {
+			meta = &localEntry{Fields: make(map[string]string)}
+		}
+
+		id, _ = strconv.ParseInt(meta.Fields["historyseq"], 10, 64)
+		id++
+		meta.Fields["historyseq"] = strconv.FormatInt(id, 10)
+		if err := tx.put(C_META, meta); err != nil {
+			return err
+		}
+
+		recorded := *e
+		recorded.ID = id
+		item, err := json.Marshal(recorded)
+		if err != nil {
+			return err
+		}
+
+		return tx.put(historyKey(t, id), &localEntry{Fields: map[string]string{"event": string(item)}})
+	})
+	if err == nil {
+		e.ID = id
+	}
+
+	return err
+}
+
+func (s *LocalStore) HistoryList(since time.Time) []Event {
+
+	events := make([]Event, 0)
+
+	_ = s.engine.view(func(tx localTx) error {
+		for _, key := range tx.keysFrom(C_HISTORY+":", historyKey(since, 0)) {
+			h, ok := tx.get(key)
+			if !ok {
+				continue
+			}
+			var e Event
+			if json.Unmarshal([]byte(h.Fields["event"]), &e) != nil {
+				continue
+			}
+			if t, err := time.Parse(time.RFC3339, e.Time); err == nil && !t.Before(since) {
+				events = append(events, e)
+			}
+		}
+		return nil
+	})
+
+	return events
+}
+
+func (s *LocalStore) HistoryPrune(before time.Time) (int64, error) {
+
+	var pruned int64
+
+	err := s.engine.update(func(tx localTx) error {
+		bound := historyKey(before, 0)
+		for _, key := range tx.keys(C_HISTORY + ":") {
+			if key >= bound {
+				break
+			}
+			if err := tx.del(key); err != nil {
+				return err
+			}
+			pruned++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return pruned, nil
+}
+
+// Returns: the key of a history event, the first key of the second of `t`
+// with id 0
+func historyKey(t time.Time, id int64) string {
+
+	return fmt.Sprintf("%s:%020d:%020d", C_HISTORY, max(t.Unix(), 0), id)
+}
+
+func (s *LocalStore) RateIncr(key string, window time.Duration) (int64, error) {
+
+	var count int64
+
+	err := s.volatile.update(func(tx localTx) error {
+		e, ok := tx.get(key)
+		if !ok {
+			e = &localEntry{
+				Fields:   map[string]string{"count": "0"},
+				ExpireAt: time.Now().Add(window),
+			}
+		}
+
+		var err error
+		count, err = strconv.ParseInt(e.Fields["count"], 10, 64)
+		if err != nil {
+			return fmt.Errorf("rate limit counter is not an integer: %w", err)
+		}
+		count++
+		e.Fields["count"] = strconv.FormatInt(count, 10)
+
+		return tx.put(key, e)
+	})
+
+	return count, err
+}
+
+// memEngine keeps the entries in a map, nothing is persisted.
+type memEngine struct {
+	mu      sync.RWMutex
+	entries map[string]*localEntry
+}
+
+func newMemEngine() *memEngine {
+
+	return &memEngine{entries: make(map[string]*localEntry)}
+}
+
+// memTx is a memEngine transaction, the engine's mutex is held while it runs.
+type memTx struct {
+	m        *memEngine
+	writable bool
+}
+
+func (m *memEngine) view(fn func(tx localTx) error) error {
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return fn(&memTx{m: m})
+}
+
+func (m *memEngine) update(fn func(tx localTx) error) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return fn(&memTx{m: m, writable: true})
+}
+
+func (m *memEngine) close() error {
+
+	return nil
+}
+
+// Entries are copied in and out, so callers cannot change the map unlocked.
+func (t *memTx) get(key string) (*localEntry, bool) {
+
+	e, ok := t.m.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	if e.expired(time.Now()) {
+		if t.writable {
+			delete(t.m.entries, key)
+		}
+		return nil, false
+	}
+
+	return copyEntry(e), true
+}
+
+func (t *memTx) put(key string, e *localEntry) error {
+
+	t.m.entries[key] = copyEntry(e)
+	return nil
+}
+
+func (t *memTx) del(key string) error {
+
+	delete(t.m.entries, key)
+	return nil
+}
+
+func (t *memTx) keys(prefix string) []string {
+
+	return t.keysFrom(prefix, prefix)
+}
+
+func (t *memTx) keysFrom(prefix string, from string) []string {
+
+	now := time.Now()
+	keys := make([]string, 0)
+
+	for key, e := range t.m.entries {
+		if strings.HasPrefix(key, prefix) && key >= from && !e.expired(now) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func copyEntry(e *localEntry) *localEntry {
+
+	c := &localEntry{
+		Fields:   make(map[string]string, len(e.Fields)),
+		ExpireAt: e.ExpireAt,
+	}
+	for field, value := range e.Fields {
+		c.Fields[field] = value
+	}
+
+	return c
+}
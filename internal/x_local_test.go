@@ -0,0 +1,72 @@
+package x
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// raceHostLock locks env1-host1 from n goroutines at once, as n users.
+//
+// Returns: the number of locks granted
+func raceHostLock(t *testing.T, n int) int {
+
+	t.Helper()
+
+	EnvCreate("env1")
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	won := 0
+
+	start := make(chan struct{})
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(user string) {
+			defer wg.Done()
+			c := lockRequest(C_TYPE_HOST, "env1-host1", user)
+			<-start
+			if r, _ := DB.LockAcquire(c, time.Hour); !r.IsError {
+				mu.Lock()
+				won++
+				mu.Unlock()
+			} else if r.ErrorMessage != ERR_LockedByAnotherUser {
+				t.Errorf("%s: %s", user, r.ErrorMessage)
+			}
+		}(fmt.Sprintf("user%d", i))
+	}
+	close(start)
+	wg.Wait()
+
+	return won
+}
+
+func TestLockAcquireRace(t *testing.T) {
+
+	for name, open := range map[string]func(t *testing.T){
+		"memory": func(t *testing.T) { useMemStore(t) },
+		"bolt": func(t *testing.T) {
+			s, err := NewBoltStore(filepath.Join(t.TempDir(), "nodelocker.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			useStore(t, s)
+		},
+		"redis": func(t *testing.T) { useRedisStore(t) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			open(t)
+
+			if won := raceHostLock(t, 50); won != 1 {
+				t.Errorf("%d of the concurrent locks won, want 1", won)
+			}
+
+			l := DB.LockGetter(C_TYPE_HOST + ":env1-host1")
+			if hosts := DB.GetHostsInEnv("env1"); l.State != C_STATE_LOCKED || len(hosts) != 1 {
+				t.Errorf("env1-host1 is %+v, locked hosts of env1 %v", l, hosts)
+			}
+		})
+	}
+}
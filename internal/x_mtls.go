@@ -0,0 +1,169 @@
+package x
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+const (
+	C_CLIENT_AUTH_OPTIONAL string = "optional" // a client certificate is verified if given
+	C_CLIENT_AUTH_REQUIRE  string = "require"  // every client needs a certificate
+
+	C_CLIENT_USER_CN    string = "cn"    // the user is the common name of the certificate
+	C_CLIENT_USER_DNS   string = "dns"   // the first DNS SAN
+	C_CLIENT_USER_EMAIL string = "email" // the part before '@' of the first email SAN
+)
+
+// ClientIdentity is the user a verified client certificate maps to.
+type ClientIdentity struct {
+	User    string
+	Subject string
+	Admin   bool
+}
+
+type clientIdentityKey struct{}
+
+// Wants: configuration with the client CA
+//
+// Returns: the TLS settings verifying the client certificates, nil without
+// a client CA
+func clientAuthConfig(c *Config) (*tls.Config, error) {
+
+	if c.TLSClientCA == "" {
+		return nil, nil
+	}
+
+	pem, err := os.ReadFile(c.TLSClientCA)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no certificates found", c.TLSClientCA)
+	}
+
+	auth := tls.VerifyClientCertIfGiven
+	if c.TLSClientAuth == C_CLIENT_AUTH_REQUIRE {
+		auth = tls.RequireAndVerifyClientCert
+	}
+
+	return &tls.Config{ClientCAs: pool, ClientAuth: auth}, nil
+}
+
+// Wants: verified client certificate, configuration
+//
+// Returns: the user it maps to, "" if the certificate has no such field
+func clientUser(cert *x509.Certificate, c *Config) string {
+
+	switch c.TLSClientUser {
+	case C_CLIENT_USER_DNS:
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	case C_CLIENT_USER_EMAIL:
+		if len(cert.EmailAddresses) > 0 {
+			user, _, _ := strings.Cut(cert.EmailAddresses[0], "@")
+			return user
+		}
+	default:
+		return cert.Subject.CommonName
+	}
+
+	return ""
+}
+
+// Wants: configuration
+//
+// Returns: the middleware adding the ClientIdentity of the verified client
+// certificates to the requests, see ClientIdentityOf
+func ClientCertMiddleware(c *Config) func(http.Handler) http.Handler {
+
+	// ';' separated, the subjects hold commas
+	admins := make([]string, 0)
+	for _, admin := range strings.Split(c.TLSClientAdmins, ";") {
+		if admin = strings.TrimSpace(admin); admin != "" {
+			admins = append(admins, admin)
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+			if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			cert := r.TLS.VerifiedChains[0][0]
+			id := ClientIdentity{
+				User:    clientUser(cert, c),
+				Subject: cert.Subject.String(),
+			}
+			id.Admin = slices.Contains(admins, id.Subject) || (id.User != "" && slices.Contains(admins, id.User))
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIdentityKey{}, id)))
+		})
+	}
+}
+
+// Returns: the identity of the client certificate of the request, `false`
+// without a verified one
+func ClientIdentityOf(r *http.Request) (ClientIdentity, bool) {
+
+	id, ok := r.Context().Value(clientIdentityKey{}).(ClientIdentity)
+
+	return id, ok
+}
+
+// Wants: request
+//
+// Returns: the 'user' and 'token' parameters, the user of the client
+// certificate if no 'user' is given
+func RequestUser(r *http.Request) (string, string) {
+
+	user := r.URL.Query().Get("user")
+	token := r.URL.Query().Get("token")
+
+	if id, ok := ClientIdentityOf(r); ok && user == "" && token == "" {
+		user = id.User
+	}
+
+	return user, token
+}
+
+// Wants: request, username, usertoken
+//
+// Returns: `true` if the token is valid for the user, or without a token,
+// the client certificate maps to this existing user, the admin is only
+// granted to the certificates of tls-client-admins
+func IsValidRequestUser(r *http.Request, userName string, userToken string) bool {
+
+	if id, ok := ClientIdentityOf(r); ok && userToken == "" {
+		if userName == C_ADMIN {
+			return id.Admin
+		}
+		return userName != "" && id.User == userName && IsExistingUser(userName)
+	}
+
+	return IsValidUser(userName, userToken)
+}
+
+// Wants: request, admin token
+//
+// Returns: `true` if the token is the admin's, or without a token, the
+// client certificate is granted admin rights
+func IsAdminRequest(r *http.Request, adminToken string) bool {
+
+	if id, ok := ClientIdentityOf(r); ok && adminToken == "" {
+		return id.Admin
+	}
+
+	return adminToken != "" && IsValidUser(C_ADMIN, adminToken)
+}
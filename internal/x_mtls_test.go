@@ -0,0 +1,72 @@
+package x
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// certRequest is the request of the URL made with a verified client
+// certificate of `cn`, "" for none, passed through ClientCertMiddleware.
+func certRequest(t *testing.T, c *Config, url string, cn string) *http.Request {
+
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodGet, url, nil)
+	if cn != "" {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: cn, Organization: []string{"CI"}}}
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	}
+
+	var seen *http.Request
+	ClientCertMiddleware(c)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r
+	})).ServeHTTP(httptest.NewRecorder(), r)
+
+	return seen
+}
+
+func TestClientCertificateUsers(t *testing.T) {
+
+	useMemStore(t)
+	addUser(t, C_ADMIN, "adminpass")
+	addUser(t, "user1", "pass1")
+	addUser(t, "user2", "pass2")
+
+	c := DefaultConfig()
+	c.TLSClientAdmins = "ci-admin; CN=ci-boss,O=CI"
+
+	for _, tc := range []struct {
+		name, url, cn string
+		user          string // RequestUser
+		valid, admin  bool   // IsValidRequestUser, IsAdminRequest
+	}{
+		{"maps to a user", "/lock", "user1", "user1", true, false},
+		{"unknown user", "/lock", "user9", "user9", false, false},
+		{"another user", "/lock?user=user2", "user1", "user2", false, false},
+		{"no certificate", "/lock", "", "", false, false},
+		{"admin not allowed", "/lock", C_ADMIN, C_ADMIN, false, false},
+		{"admin by name", "/lock?user=admin", "ci-admin", C_ADMIN, true, true},
+		{"admin by subject", "/lock?user=admin", "ci-boss", C_ADMIN, true, true},
+		{"admin not allowed by name", "/lock?user=admin", "user1", C_ADMIN, false, false},
+		{"token wins", "/lock?user=user2&token=pass2", "user1", "user2", true, false},
+		{"wrong token wins", "/lock?user=user1&token=wrong", "user1", "user1", false, false},
+		{"admin token wins", "/admin?user=admin&token=adminpass", "user1", C_ADMIN, true, true},
+		{"wrong admin token wins", "/admin?user=admin&token=wrong", "ci-admin", C_ADMIN, false, false},
+	} {
+		r := certRequest(t, c, tc.url, tc.cn)
+		user, token := RequestUser(r)
+		if user != tc.user {
+			t.Errorf("%s: user %q, want %q", tc.name, user, tc.user)
+		}
+		if valid := IsValidRequestUser(r, user, token); valid != tc.valid {
+			t.Errorf("%s: valid user %t, want %t", tc.name, valid, tc.valid)
+		}
+		if admin := IsAdminRequest(r, token); admin != tc.admin {
+			t.Errorf("%s: admin %t, want %t", tc.name, admin, tc.admin)
+		}
+	}
+}
@@ -8,9 +8,13 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
+// BcryptCost for bcrypt hashing (between 10 and 14 recommended for production),
+// see Config
+var BcryptCost = C_BCRYPT_COST
+
 const (
-	// BcryptCost for bcrypt hashing (between 10 and 14 recommended for production)
-	BcryptCost = 12
+	// C_BCRYPT_COST is the default of BcryptCost
+	C_BCRYPT_COST = 12
 
 	// Hash version prefixes
 	bcryptPrefix = "$2a$"
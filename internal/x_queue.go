@@ -0,0 +1,228 @@
+package x
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	C_QUEUE_INTERVAL time.Duration = 10 * time.Second // queue promoter period
+)
+
+// Wants: filled LockData with a valid LastDay
+//
+// Returns: `true` if the entity got locked or, being busy, the user got queued
+func LockOrQueue(c *LockData, res *WebResponse) bool {
+
+	msgs := len(res.Messages)
+	locked := false
+
+	switch c.Type {
+	case C_TYPE_ENV:
+		locked = EnvLock(c, res)
+	case C_TYPE_HOST:
+		locked = HostLock(c, res)
+	}
+
+	if locked {
+		return true
+	}
+
+	// only busy entities are waited for, other errors are returned as-is
+	last := res.Messages[len(res.Messages)-1]
+	if last != ERR_LockedByAnotherUser && last != ERR_ReservedForQueue {
+		return false
+	}
+
+	res.Messages = res.Messages[:msgs]
+	return EntityQueueJoin(c, res)
+}
+
+// Wants: filled LockData with a valid LastDay
+//
+// Returns: `true` if the user is in the queue or got the lock already
+func EntityQueueJoin(c *LockData, res *WebResponse) bool {
+
+	db := DB.LockGetter(c.Type + ":" + c.Name)
+	if db.State == C_STATE_LOCKED && db.User == c.User {
+		res.Messages = append(res.Messages, ERR_AlreadyOwner)
+		c.HttpErr = http.StatusConflict
+		return false
+	}
+
+	pos, err := DB.QueueJoin(c)
+	if err != nil {
+		fmt.Printf("%s Cannot queue '%s' for %s:%s: %s\n", C_FAILED, c.User, c.Type, c.Name, err)
+		res.Messages = append(res.Messages, ERR_QueueFail)
+		c.HttpErr = http.StatusInternalServerError
+		return false
+	}
+
+	// the entity may be free, the head of the queue gets it at once
+	if PromoteQueue(c.Type, c.Name) == c.User {
+		if c.Type == C_TYPE_ENV {
+			res.Messages = append(res.Messages, OK_EnvLocked)
+		} else {
+			res.Messages = append(res.Messages, OK_HostLocked)
+		}
+		c.HttpErr = http.StatusOK
+		return true
+	}
+
+	res.Messages = append(res.Messages, OK_Queued)
+	res.Position = pos
+	res.Queue = DB.QueueList(c.Type, c.Name)
+	c.HttpErr = http.StatusAccepted
+	return true
+}
+
+// Wants: filled LockData
+//
+// Returns: `true` if the user has left the queue
+func EntityQueueLeave(c *LockData, res *WebResponse) bool {
+
+	left, err := DB.QueueLeave(c)
+
+	switch {
+	case err != nil:
+		res.Messages = append(res.Messages, ERR_QueueFail)
+		c.HttpErr = http.StatusInternalServerError
+		return false
+	case !left:
+		res.Messages = append(res.Messages, ERR_NotInQueue)
+		c.HttpErr = http.StatusNotFound
+		return false
+	}
+
+	res.Messages = append(res.Messages, OK_QueueLeft)
+	c.HttpErr = http.StatusOK
+	return true
+}
+
+// Wants: filled LockData
+//
+// Returns: fills the queue and the user's position (0 if not queued)
+func EntityQueueStatus(c *LockData, res *WebResponse) {
+
+	res.Queue = DB.QueueList(c.Type, c.Name)
+	res.Position = 0
+
+	for i, q := range res.Queue {
+		if q.User == c.User {
+			res.Position = i + 1
+			break
+		}
+	}
+
+	res.Messages = append(res.Messages, OK_QueuePosition)
+	c.HttpErr = http.StatusOK
+}
+
+// Wants: entity type and name
+//
+// Returns: the user who got the lock from the queue, "" if nobody
+func PromoteQueue(enType string, enName string) string {
+
+	for _, q := range DB.QueueList(enType, enName) {
+
+		c := new(LockData)
+		c.Type = enType
+		c.Name = enName
+		c.User = q.User
+		c.LastDay = q.LastDay
+		c.Expire = q.Expire
+
+		// a duration is counted from the hand-over, not from joining
+		if d, err := time.ParseDuration(q.For); err == nil {
+			loc, _ := ResolveTZ(q.User, "")
+			SetExpiry(c, time.Now().Add(d).Truncate(time.Second).In(loc))
+		}
+
+		// the wanted lock would be over already
+		if time.Until(GetExpiry(c)) <= 0 {
+			_, _ = DB.QueueLeave(c)
+			continue
+		}
+
+		if !IsExistingUser(q.User) {
+			if !dropQueueHead(c, "the user is gone") {
+				return ""
+			}
+			continue
+		}
+
+		res := new(WebResponse)
+		locked := false
+
+		switch enType {
+		case C_TYPE_ENV:
+			locked = EnvLock(c, res)
+		case C_TYPE_HOST:
+			locked = HostLock(c, res)
+		}
+
+		if !locked {
+			reason := res.Messages[len(res.Messages)-1]
+			// still busy, the head keeps waiting
+			if isBusy(reason) {
+				return ""
+			}
+			// refused for good, e.g. maintenance or the maximum of the env
+			if !dropQueueHead(c, reason) {
+				return ""
+			}
+			continue
+		}
+
+		fmt.Printf("%s %s:%s handed over to '%s' from the queue\n", C_SUCCESS, enType, enName, q.User)
+		return q.User
+	}
+
+	return ""
+}
+
+// Wants: error message of a refused lock
+//
+// Returns: `true` if the entity is only busy for now, locked by another user
+// or its env or hosts are
+func isBusy(msg string) bool {
+
+	return msg == ERR_LockedByAnotherUser || msg == ERR_LockedHostsInEnv || msg == ERR_ParentEnvLockFail
+}
+
+// Wants: the lock wanted by the head of the queue, why it cannot get it
+//
+// Removes the head from the queue, so the rest of the queue is not stalled.
+//
+// Returns: `true` if the head has been removed
+func dropQueueHead(c *LockData, reason string) bool {
+
+	if _, err := DB.QueueLeave(c); err != nil {
+		fmt.Printf("%s Cannot drop '%s' from the queue of %s:%s: %s\n", C_FAILED, c.User, c.Type, c.Name, err)
+		return false
+	}
+	fmt.Printf("%s '%s' dropped from the queue of %s:%s: %s\n", C_FAILED, c.User, c.Type, c.Name, reason)
+	return true
+}
+
+// Wants: time between two runs, channel closed to stop
+//
+// Hands over the entities with a queue whose lock has expired.
+func RunQueuePromoter(interval time.Duration, stop <-chan struct{}) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			for _, key := range DB.QueuedEntities() {
+				enType, enName := splitKey(key)
+				PromoteQueue(enType, enName)
+			}
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package x
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPromoteQueueCountsDurationFromHandOver(t *testing.T) {
+
+	useMemStore(t)
+	EnvCreate("env1")
+	addUser(t, "user2", "pass2")
+
+	if r, _ := DB.LockAcquire(lockRequest(C_TYPE_HOST, "env1-host1", "user1"), time.Hour); r.IsError {
+		t.Fatal(r.ErrorMessage)
+	}
+
+	// joined with for=2h, three hours ago
+	waiting := &LockData{Type: C_TYPE_HOST, Name: "env1-host1", User: "user2", For: "2h"}
+	SetExpiry(waiting, time.Now().Add(-time.Hour).Truncate(time.Second))
+	if _, err := DB.QueueJoin(waiting); err != nil {
+		t.Fatal(err)
+	}
+
+	if r, _ := DB.LockRelease(&LockData{Type: C_TYPE_HOST, Name: "env1-host1", User: "user1"}); r.IsError {
+		t.Fatal(r.ErrorMessage)
+	}
+
+	if user := PromoteQueue(C_TYPE_HOST, "env1-host1"); user != "user2" {
+		t.Fatalf("handed over to %q, want user2", user)
+	}
+
+	l := DB.LockGetter(C_TYPE_HOST + ":env1-host1")
+	if left := time.Until(GetExpiry(l)); left < 2*time.Hour-time.Minute || left > 2*time.Hour {
+		t.Errorf("lock of %s expires in %s, want 2h", l.User, left)
+	}
+	if queue := DB.QueueList(C_TYPE_HOST, "env1-host1"); len(queue) != 0 {
+		t.Errorf("queue is %+v, want empty", queue)
+	}
+}
+
+func TestPromoteQueueDropsEnvInMaintenance(t *testing.T) {
+
+	forEachStore(t, func(t *testing.T) {
+
+		EnvCreate("env1")
+		addUser(t, "user2", "pass2")
+		addUser(t, "user3", "pass3")
+
+		if r, _ := DB.LockAcquire(lockRequest(C_TYPE_ENV, "env1", "user1"), time.Hour); r.IsError {
+			t.Fatal(r.ErrorMessage)
+		}
+		for _, user := range []string{"user2", "user3"} {
+			waiting := lockRequest(C_TYPE_ENV, "env1", user)
+			SetExpiry(waiting, time.Now().Add(2*time.Hour).Truncate(time.Second))
+			if _, err := DB.QueueJoin(waiting); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		EnvMaintenance("env1")
+
+		if user := PromoteQueue(C_TYPE_ENV, "env1"); user != "" {
+			t.Errorf("handed over to %q, want nobody", user)
+		}
+		if queue := DB.QueueList(C_TYPE_ENV, "env1"); len(queue) != 0 {
+			t.Errorf("queue is %+v, want empty", queue)
+		}
+		if l := DB.LockGetter(C_TYPE_ENV + ":env1"); l.State != C_STATE_MAINTENANCE {
+			t.Errorf("env1 is %s, want %s", l.State, C_STATE_MAINTENANCE)
+		}
+	})
+}
@@ -8,12 +8,19 @@ import (
 	"time"
 )
 
-const (
-	// RateWindow is the time window for rate limiting (1 minute)
-	RateWindow = 60 * time.Second
+var (
+	// RateWindow is the time window for rate limiting, see Config
+	RateWindow = C_RATE_WINDOW
 	// MaxRequests is the maximum number of requests allowed per window
-	MaxRequests = 60
-	// RateLimitPrefix is the Redis key prefix for rate limiting
+	MaxRequests = C_RATE_LIMIT
+)
+
+const (
+	// C_RATE_WINDOW is the default of RateWindow (1 minute)
+	C_RATE_WINDOW = 60 * time.Second
+	// C_RATE_LIMIT is the default of MaxRequests
+	C_RATE_LIMIT = 60
+	// RateLimitPrefix is the store key prefix for rate limiting
 	RateLimitPrefix = "ratelimit:"
 )
 
@@ -49,20 +56,15 @@ func RateLimitMiddleware(next http.Handler) http.Handler {
 		clientIP := GetRealIP(r)
 		key := fmt.Sprintf("%s%s", RateLimitPrefix, clientIP)
 
-		// Use Redis to track request count
-		count, err := RConn.Incr(key).Result()
+		// Use the store to track request count, expiry is set on first request
+		count, err := DB.RateIncr(key, RateWindow)
 		if err != nil {
 			http.Error(w, "Rate limit error", http.StatusInternalServerError)
 			return
 		}
 
-		// Set expiry on first request
-		if count == 1 {
-			RConn.Expire(key, RateWindow)
-		}
-
 		// Check if rate limit exceeded
-		if count > MaxRequests {
+		if count > int64(MaxRequests) {
 			w.Header().Set("X-RateLimit-Limit", fmt.Sprintf("%d", MaxRequests))
 			w.Header().Set("X-RateLimit-Remaining", "0")
 			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
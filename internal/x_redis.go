@@ -1,23 +1,53 @@
 package x
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-redis/redis"
 )
 
-var (
-	RConn *redis.Client // global Redis connection
-
+const (
+	C_SCRIPT_TRIES int = 5 // runs of a lock script whose keys changed meanwhile
 )
 
-func RGetSingle(key string, field string) any {
+// RedisStore is the Redis implementation of Store. The Lua scripts get every
+// key they touch in KEYS, those derived from the data, like the indexes, are
+// read beforehand and the scripts ask for a retry if the data has changed.
+type RedisStore struct {
+	Conn *redis.Client // Redis connection
+}
+
+func NewRedisStore(addr string, password string, db int) *RedisStore {
+
+	return &RedisStore{
+		Conn: redis.NewClient(&redis.Options{
+			Addr:     addr,
+			Password: password,
+			DB:       db,
+		}),
+	}
+}
+
+func (s *RedisStore) Ping() error {
+
+	return s.Conn.Ping().Err()
+}
+
+func (s *RedisStore) Close() error {
+
+	return s.Conn.Close()
+}
 
-	value, err := RConn.HGet(key, field).Result()
+func (s *RedisStore) GetSingle(key string, field string) any {
+
+	value, err := s.Conn.HGet(key, field).Result()
 	if err != nil || value == "" {
 
 		// In this function we use 'nil' as false return value
@@ -28,122 +58,630 @@ func RGetSingle(key string, field string) any {
 	return value
 }
 
-func RSetSingle(key string, field string, value any, lastDay time.Duration) bool {
+func (s *RedisStore) SetSingle(key string, field string, value any) bool {
 
-	err := RConn.HSet(key, field, value).Err()
+	err := s.Conn.HSet(key, field, value).Err()
 	return err == nil
 }
 
 // Usually key := 'entityType:entityName'
-func RSetExpire(key string, expire time.Duration) bool {
+func (s *RedisStore) GetAll(key string) map[string]string {
+
+	fields, err := s.Conn.HGetAll(key).Result()
+	if err != nil {
+		fmt.Printf("Error fetching '%s': %s\n", key, err)
+		return map[string]string{}
+	}
 
-	errExp := RConn.Expire(key, expire).Err()
-	return errExp == nil
+	return fields
 }
 
-// Usually key := 'entityType:entityName'
-func RLockGetter(key string) *LockData {
+func (s *RedisStore) LockGetter(key string) *LockData {
+
+	result, err := s.Conn.HMGet(key, "parent", "state", "user", "lastday", "expire").Result()
+	if err != nil {
+		result = nil
+	}
+
+	return lockDataOf(result)
+}
+
+// Wants: the parent, state, user, lastday and expire fields of an entity, in
+// this order, as HMGET or luaPrev returns them
+//
+// Returns: LockData of the entity, StatusNoContent if there is no record
+func lockDataOf(result []interface{}) *LockData {
 
 	c := new(LockData)
 	var resultsMap map[string]string
 
-	result, err := RConn.HMGet(key, "parent", "state", "user", "lastday").Result()
-	if err != nil || result[0] == nil { // no record found
+	if len(result) < 5 || result[0] == nil { // no record found
 		c.HttpErr = http.StatusNoContent
 		return c
 	}
 
-	fields := []string{"parent", "state", "user", "lastday"}
+	fields := []string{"parent", "state", "user", "lastday", "expire"}
 	resultsMap = make(map[string]string)
 
 	for i, field := range fields {
-		resultsMap[field] = result[i].(string)
+		if value, ok := result[i].(string); ok {
+			resultsMap[field] = value
+		}
 	}
 
 	c.Parent = resultsMap["parent"]
 	c.State = resultsMap["state"]
 	c.User = resultsMap["user"]
 	c.LastDay = resultsMap["lastday"]
+	c.Expire = resultsMap["expire"]
 	c.HttpErr = http.StatusOK
 
 	return c
 }
 
+// Lua helper of the scripts below, moves an entity between the state and
+// user indexes, whose keys are the four KEYS from `first` on, see
+// reindexKeys. The state and user they were built from must be unchanged.
+const luaReindex = `
+local function unchanged(old, state, user)
+	return (old[1] or '') == state and (old[2] or '') == user
+end
+
+local function reindex(key, first, oldState, oldUser, newState, newUser)
+	if oldState and oldState ~= '' then
+		redis.call('SREM', KEYS[first], key)
+	end
+	if oldUser and oldUser ~= '' then
+		redis.call('SREM', KEYS[first + 1], key)
+	end
+	if newState and newState ~= '' then
+		redis.call('SADD', KEYS[first + 2], key)
+	end
+	if newUser and newUser ~= '' then
+		redis.call('SADD', KEYS[first + 3], key)
+	end
+end
+`
+
+// Wants: entity key, the state and user it gets
+//
+// Returns: the state and user of the entity, the KEYS of the indexes it
+// leaves and joins, see luaReindex
+func (s *RedisStore) reindexKeys(key string, newState string, newUser string) (string, string, []string) {
+
+	var oldState, oldUser string
+	if old, err := s.Conn.HMGet(key, "state", "user").Result(); err == nil && len(old) == 2 {
+		oldState, _ = old[0].(string)
+		oldUser, _ = old[1].(string)
+	}
+
+	return oldState, oldUser, []string{
+		C_IDX_STATE + ":" + oldState,
+		C_IDX_USER + ":" + oldUser,
+		C_IDX_STATE + ":" + newState,
+		C_IDX_USER + ":" + newUser,
+	}
+}
+
+// Lua helper of the scripts below, the scripts reply with their result and
+// the entity as it was before, see scriptReply.
+const luaPrev = `
+local function prevOf(key)
+	return redis.call('HMGET', key, 'parent', 'state', 'user', 'lastday', 'expire')
+end
+
+local function reply(result, prev)
+	return {result, prev[1], prev[2], prev[3], prev[4], prev[5]}
+end
+`
+
+// Wants: reply of a script built on luaPrev
+//
+// Returns: the result of the script, empty if it failed, the entity as it
+// was before
+func scriptReply(reply interface{}) (string, *LockData) {
+
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 6 {
+		return "", lockDataOf(nil)
+	}
+
+	result, _ := values[0].(string)
+	return result, lockDataOf(values[1:])
+}
+
+// KEYS: entity, leases, the indexes, see reindexKeys
+//
+// ARGV: state, parent, user, lastday, '1' to write only a missing entity,
+// state and user read
+var lockSetterScript = redis.NewScript(luaReindex + luaPrev + `
+local prev = prevOf(KEYS[1])
+local old = redis.call('HMGET', KEYS[1], 'state', 'user')
+
+if ARGV[5] == '1' and redis.call('EXISTS', KEYS[1]) == 1 then
+	return reply('` + acqExists + `', prev)
+end
+
+if not unchanged(old, ARGV[6], ARGV[7]) then
+	return reply('` + acqRetry + `', prev)
+end
+
+redis.call('HDEL', KEYS[2], KEYS[1])
+
+redis.call('HMSET', KEYS[1], 'state', ARGV[1], 'parent', ARGV[2], 'user', ARGV[3], 'lastday', ARGV[4], 'expire', '', 'since', '')
+redis.call('PERSIST', KEYS[1])
+reindex(KEYS[1], 3, old[1], old[2], ARGV[1], ARGV[3])
+
+return reply('` + acqOK + `', prev)
+`)
+
 // Do not forget to fill x.LockData before function call!
 //
-// Returns `true` on successful run.
-func RLockSetter(c *LockData) bool {
+// Returns `true` on successful run, the entity as it was before.
+func (s *RedisStore) LockSetter(c *LockData) (bool, *LockData) {
 
-	err := RConn.HMSet(c.Type+":"+c.Name, map[string]any{
-		"state":   c.State,
-		"parent":  c.Parent,
-		"user":    c.User,
-		"lastday": c.LastDay,
-	}).Err()
+	return s.lockSet(c, "0")
+}
 
-	return err == nil
+func (s *RedisStore) LockSetterIfAbsent(c *LockData) bool {
+
+	written, _ := s.lockSet(c, "1")
+	return written
+}
+
+func (s *RedisStore) lockSet(c *LockData, ifAbsent string) (bool, *LockData) {
+
+	key := c.Type + ":" + c.Name
+
+	var result string
+	var prev *LockData
+	for try := 0; try < C_SCRIPT_TRIES; try++ {
+		oldState, oldUser, indexes := s.reindexKeys(key, c.State, c.User)
+		reply, err := lockSetterScript.Run(s.Conn, append([]string{key, C_LEASES}, indexes...),
+			c.State, c.Parent, c.User, c.LastDay, ifAbsent, oldState, oldUser).Result()
+		if err != nil {
+			fmt.Printf("%s Setter script failed on '%s': %s\n", C_FAILED, key, err)
+		}
+		if result, prev = scriptReply(reply); result != acqRetry {
+			break
+		}
+	}
+
+	return result == acqOK, prev
+}
+
+// Lua helper of the lock scripts, same as calendarConflict.
+const luaCalendar = `
+local function calendarConflict(calendarKey, user, firstDay, lastDay)
+	local booked, bookedNow = false, false
+	for _, item in ipairs(redis.call('LRANGE', calendarKey, 0, -1)) do
+		local r = cjson.decode(item)
+		if r['firstday'] <= lastDay and r['lastday'] >= firstDay then
+			if r['user'] ~= user then
+				booked = true
+			elseif r['firstday'] <= firstDay then
+				bookedNow = true
+			end
+		end
+	end
+	return booked, bookedNow
+end
+`
+
+// KEYS: see lockScriptKeys, the indexes, see reindexKeys, and for envs the
+// locked hosts of the env
+//
+// ARGV: type, user, admin, parent, state, lastday, expire in milliseconds,
+// name, today, expire as RFC 3339, now and expire as unix seconds, env name,
+// state and user read
+var lockAcquireScript = redis.NewScript(luaReindex + luaCalendar + luaPrev + `
+local prev = prevOf(KEYS[1])
+local old = redis.call('HMGET', KEYS[1], 'state', 'user', 'since')
+local owner = old[2]
+
+local booked, bookedNow = calendarConflict(KEYS[6], ARGV[2], ARGV[9], ARGV[6])
+
+-- a lock renewed by its owner is counted from its start
+local since = tonumber(ARGV[11])
+if old[1] == '` + C_STATE_LOCKED + `' and owner == ARGV[2] and tonumber(old[3]) then
+	since = tonumber(old[3])
+end
+local maxLock = tonumber(redis.call('HGET', KEYS[8], ARGV[13]))
+
+local queueHead = ''
+local head = redis.call('LINDEX', KEYS[4], 0)
+if head then
+	queueHead = cjson.decode(head)['user']
+end
+
+-- the env itself for envs
+local envState = redis.call('HGET', KEYS[2], 'state')
+
+if ARGV[1] == '` + C_TYPE_HOST + `' then
+	if not envState then
+		return reply('` + acqParentNil + `', prev)
+	end
+	if envState == '` + C_STATE_LOCKED + `' then
+		return reply('` + acqParentLocked + `', prev)
+	end
+end
+
+if ARGV[2] ~= ARGV[3] and (envState == '` + C_STATE_MAINTENANCE + `' or envState == '` + C_STATE_TERMINATED + `') then
+	return reply('` + acqUnavailable + `', prev)
+end
+
+if ARGV[2] ~= ARGV[3] and owner and owner ~= '' and owner ~= ARGV[2] then
+	return reply('` + acqLockedByAnother + `', prev)
+end
+
+if ARGV[2] ~= ARGV[3] and booked then
+	return reply('` + acqBooked + `', prev)
+end
+
+-- a free entity goes to the head of its queue first, unless it's booked
+-- for the user today
+if ARGV[2] ~= ARGV[3] and (not owner or owner == '') and queueHead ~= '' and queueHead ~= ARGV[2] and not bookedNow then
+	return reply('` + acqQueued + `', prev)
+end
+
+if ARGV[2] ~= ARGV[3] and maxLock and maxLock > 0 and tonumber(ARGV[12]) - since > maxLock then
+	return reply('` + acqTooLong + `', prev)
+end
+
+if ARGV[1] == '` + C_TYPE_ENV + `' then
+	-- the locked hosts must be those read, drop those expired since
+	if redis.call('SCARD', KEYS[3]) ~= #KEYS - 12 then
+		return reply('` + acqRetry + `', prev)
+	end
+	for i = 13, #KEYS do
+		local host = string.sub(KEYS[i], string.len('` + C_TYPE_HOST + `:') + 1)
+		if redis.call('SISMEMBER', KEYS[3], host) == 0 then
+			return reply('` + acqRetry + `', prev)
+		end
+		if redis.call('EXISTS', KEYS[i]) == 0 then
+			redis.call('SREM', KEYS[3], host)
+		end
+	end
+	if redis.call('SCARD', KEYS[3]) > 0 then
+		return reply('` + acqLockedHosts + `', prev)
+	end
+end
+
+if not unchanged(old, ARGV[14], ARGV[15]) then
+	return reply('` + acqRetry + `', prev)
+end
+
+redis.call('HMSET', KEYS[1], 'state', ARGV[5], 'parent', ARGV[4], 'user', ARGV[2], 'lastday', ARGV[6], 'expire', ARGV[10], 'since', since)
+redis.call('PEXPIRE', KEYS[1], ARGV[7])
+reindex(KEYS[1], 9, old[1], old[2], ARGV[5], ARGV[2])
+redis.call('HSET', KEYS[7], KEYS[1], cjson.encode({key = KEYS[1], user = ARGV[2], expire = ARGV[10], expireat = tonumber(ARGV[12])}))
+
+if ARGV[1] == '` + C_TYPE_HOST + `' then
+	redis.call('SADD', KEYS[3], ARGV[8])
+end
+
+if queueHead == ARGV[2] then
+	redis.call('LPOP', KEYS[4])
+	if redis.call('LLEN', KEYS[4]) == 0 then
+		redis.call('SREM', KEYS[5], KEYS[1])
+	end
+end
+
+return reply('` + acqOK + `', prev)
+`)
+
+// Wants: entity type and name
+//
+// Returns: the KEYS of the lock scripts: entity, env (the parent env for
+// hosts), locked hosts of the env, queue of the entity, entities with a
+// queue, calendar of the entity, leases, maximum lock durations
+func lockScriptKeys(enType string, enName string) []string {
+
+	env := envOf(enType, enName)
+
+	return []string{
+		enType + ":" + enName,
+		C_TYPE_ENV + ":" + env,
+		C_ENV_HOSTS + ":" + env,
+		C_QUEUE + ":" + enType + ":" + enName,
+		C_QUEUES,
+		C_CALENDAR + ":" + enType + ":" + enName,
+		C_LEASES,
+		C_MAX_LOCK,
+	}
 }
 
-func REntityDelete(enType string, enName string) bool {
+func (s *RedisStore) LockAcquire(c *LockData, expire time.Duration) (*RichErrorStatus, *LockData) {
+
+	// PEXPIRE would delete the entity
+	if expire <= 0 {
+		return acqStatus(acqExpired, ""), lockDataOf(nil)
+	}
 
-	err := RConn.HDel(enType, enName).Err()
+	key := c.Type + ":" + c.Name
+	env := envOf(c.Type, c.Name)
+
+	var result string
+	var prev *LockData
+	for try := 0; try < C_SCRIPT_TRIES; try++ {
+		oldState, oldUser, indexes := s.reindexKeys(key, c.State, c.User)
+		keys := append(lockScriptKeys(c.Type, c.Name), indexes...)
+		if c.Type == C_TYPE_ENV {
+			hosts, _ := s.Conn.SMembers(C_ENV_HOSTS + ":" + env).Result()
+			for _, host := range hosts {
+				keys = append(keys, C_TYPE_HOST+":"+host)
+			}
+		}
+
+		now := time.Now()
+		reply, err := lockAcquireScript.Run(s.Conn, keys,
+			c.Type, c.User, C_ADMIN, c.Parent, c.State, c.LastDay, expire.Milliseconds(), c.Name, Today(), c.Expire,
+			now.Unix(), now.Add(expire).Unix(), env, oldState, oldUser).Result()
+		if err != nil {
+			fmt.Printf("%s Lock script failed on '%s': %s\n", C_FAILED, key, err)
+		}
+		if result, prev = scriptReply(reply); result != acqRetry {
+			break
+		}
+	}
+
+	failMessage := ERR_HostLockFail
+	if c.Type == C_TYPE_ENV {
+		failMessage = ERR_EnvLockFail
+	}
+
+	return acqStatus(result, failMessage), prev
+}
+
+// KEYS: see lockScriptKeys, the indexes, see reindexKeys
+//
+// ARGV: type, user, admin, name, state and user read
+var lockReleaseScript = redis.NewScript(luaReindex + luaPrev + `
+local prev = prevOf(KEYS[1])
+local old = redis.call('HMGET', KEYS[1], 'state', 'user')
+local state, owner = old[1], old[2]
+
+if state ~= '` + C_STATE_LOCKED + `' then
+	return reply('` + acqNotLocked + `', prev)
+end
+
+if ARGV[2] ~= ARGV[3] and owner and owner ~= '' and owner ~= ARGV[2] then
+	return reply('` + acqLockedByAnother + `', prev)
+end
+
+if not unchanged(old, ARGV[5], ARGV[6]) then
+	return reply('` + acqRetry + `', prev)
+end
+
+redis.call('HDEL', KEYS[7], KEYS[1])
+
+if ARGV[1] == '` + C_TYPE_HOST + `' then
+	redis.call('DEL', KEYS[1])
+	redis.call('SREM', KEYS[3], ARGV[4])
+	reindex(KEYS[1], 9, state, owner, nil, nil)
+else
+	redis.call('HMSET', KEYS[1], 'state', '` + C_STATE_VALID + `', 'parent', '', 'user', '', 'lastday', '', 'expire', '', 'since', '')
+	redis.call('PERSIST', KEYS[1])
+	reindex(KEYS[1], 9, state, owner, '` + C_STATE_VALID + `', nil)
+end
+
+return reply('` + acqOK + `', prev)
+`)
+
+func (s *RedisStore) LockRelease(c *LockData) (*RichErrorStatus, *LockData) {
+
+	key := c.Type + ":" + c.Name
+
+	// a host is deleted, an env is left valid
+	newState := ""
+	if c.Type == C_TYPE_ENV {
+		newState = C_STATE_VALID
+	}
+
+	var result string
+	var prev *LockData
+	for try := 0; try < C_SCRIPT_TRIES; try++ {
+		oldState, oldUser, indexes := s.reindexKeys(key, newState, "")
+		reply, err := lockReleaseScript.Run(s.Conn, append(lockScriptKeys(c.Type, c.Name), indexes...),
+			c.Type, c.User, C_ADMIN, c.Name, oldState, oldUser).Result()
+		if err != nil {
+			fmt.Printf("%s Unlock script failed on '%s': %s\n", C_FAILED, key, err)
+		}
+		if result, prev = scriptReply(reply); result != acqRetry {
+			break
+		}
+	}
+
+	failMessage := ERR_HostUnlockFail
+	if c.Type == C_TYPE_ENV {
+		failMessage = ERR_EnvUnlockFail
+	}
+
+	return acqStatus(result, failMessage), prev
+}
+
+// KEYS: see lockScriptKeys
+//
+// ARGV: user, admin, lastday, expire in milliseconds, expire as RFC 3339,
+// now and expire as unix seconds, today, env name
+var lockExtendScript = redis.NewScript(luaCalendar + luaPrev + `
+local prev = prevOf(KEYS[1])
+local cur = redis.call('HMGET', KEYS[1], 'state', 'user', 'since')
+
+if cur[1] ~= '` + C_STATE_LOCKED + `' then
+	return reply('` + acqNotLocked + `', prev)
+end
+
+if ARGV[1] ~= ARGV[2] and cur[2] ~= ARGV[1] then
+	return reply('` + acqLockedByAnother + `', prev)
+end
+
+if redis.call('PTTL', KEYS[1]) >= tonumber(ARGV[4]) then
+	return reply('` + acqNotLater + `', prev)
+end
+
+local booked = calendarConflict(KEYS[6], cur[2], ARGV[8], ARGV[3])
+if ARGV[1] ~= ARGV[2] and booked then
+	return reply('` + acqBooked + `', prev)
+end
+
+local since = tonumber(cur[3]) or tonumber(ARGV[6])
+local maxLock = tonumber(redis.call('HGET', KEYS[8], ARGV[9]))
+if ARGV[1] ~= ARGV[2] and maxLock and maxLock > 0 and tonumber(ARGV[7]) - since > maxLock then
+	return reply('` + acqTooLong + `', prev)
+end
+
+redis.call('HMSET', KEYS[1], 'lastday', ARGV[3], 'expire', ARGV[5], 'since', since)
+redis.call('PEXPIRE', KEYS[1], ARGV[4])
+redis.call('HSET', KEYS[7], KEYS[1], cjson.encode({key = KEYS[1], user = cur[2], expire = ARGV[5], expireat = tonumber(ARGV[7])}))
+
+return reply('` + acqOK + `', prev)
+`)
+
+func (s *RedisStore) LockExtend(c *LockData, expire time.Duration) (*RichErrorStatus, *LockData) {
+
+	keys := lockScriptKeys(c.Type, c.Name)
+	now := time.Now()
+
+	reply, err := lockExtendScript.Run(s.Conn, keys,
+		c.User, C_ADMIN, c.LastDay, expire.Milliseconds(), c.Expire, now.Unix(), now.Add(expire).Unix(), Today(), envOf(c.Type, c.Name)).Result()
+	if err != nil {
+		fmt.Printf("%s Extend script failed on '%s': %s\n", C_FAILED, keys[0], err)
+	}
+	result, prev := scriptReply(reply)
+
+	return acqStatus(result, ERR_ExtendFail), prev
+}
+
+func (s *RedisStore) EntityDelete(enType string, enName string) bool {
+
+	err := s.Conn.HDel(enType, enName).Err()
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 
 	// Check if entity has gone
-	if RGetSingle(enType, enName) == nil {
+	if s.GetSingle(enType, enName) == nil {
 		return true
 	} else {
 		return false
 	}
 }
 
-func RGetHostsInEnv(envName string) []string {
+func (s *RedisStore) GetHostsInEnv(envName string) []string {
 
-	// Create a cursor to iterate over hash sets
-	var cursor uint64 = 0
 	var resultList []string
 
-	fmt.Printf("Checking hosts in '%s' environment...", envName)
+	hosts, err := s.Conn.SMembers(C_ENV_HOSTS + ":" + envName).Result()
+	if err != nil {
+		fmt.Printf("Error fetching locked hosts of '%s': %s\n", envName, err)
+		return resultList
+	}
+	sort.Strings(hosts)
 
-	for {
-		// Use SCAN command to get keys matching the pattern
-		keys, nextCursor, err := RConn.Scan(cursor, C_TYPE_HOST+":*", 0).Result()
-		if err != nil {
-			log.Fatal(err.Error())
+	// members are only removed on unlock, expired hosts may linger
+	for _, host := range hosts {
+		if s.Conn.Exists(C_TYPE_HOST+":"+host).Val() > 0 {
+			resultList = append(resultList, C_TYPE_HOST+":"+host)
 		}
+	}
 
-		// Loop through the keys and check if 'env' field contains envName
-		for _, key := range keys {
-			// Use HGET command to get the value of the 'env' field
-			parent, err := RConn.HGet(key, C_PARENT).Result()
-			if err != nil {
-				log.Fatal(err.Error())
-			}
+	return resultList
+}
 
-			if parent == envName {
-				resultList = append(resultList, key)
-				fmt.Printf("%s ", key)
-			}
-		}
-		fmt.Println()
+// Wants: index set, the entity field the index is built on, its value
+//
+// Returns: sorted entity keys of the index, stale members are removed
+func (s *RedisStore) liveMembers(index string, field string, value string) []string {
 
-		// If nextCursor is 0, it means iteration is complete
-		if nextCursor == 0 {
-			break
-		}
+	resultList := make([]string, 0)
+
+	keys, err := s.Conn.SMembers(index).Result()
+	if err != nil {
+		fmt.Printf("Error fetching index %s: %s\n", index, err)
+		return resultList
+	}
+	sort.Strings(keys)
 
-		// Update the cursor for the next iteration
-		cursor = nextCursor
+	pipe := s.Conn.Pipeline()
+	cmds := make([]*redis.StringCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.HGet(key, field)
+	}
+	_, _ = pipe.Exec() // missing fields are errors too, checked one by one
+
+	// expired keys leave their members behind
+	for i, key := range keys {
+		if cmds[i].Val() == value {
+			resultList = append(resultList, key)
+		} else {
+			s.Conn.SRem(index, key)
+		}
 	}
 
 	return resultList
+}
+
+func (s *RedisStore) EntitiesInState(state string) []string {
+
+	return s.liveMembers(C_IDX_STATE+":"+state, "state", state)
+}
+
+func (s *RedisStore) EntitiesOfUser(user string) []string {
+
+	return s.liveMembers(C_IDX_USER+":"+user, "user", user)
+}
+
+func (s *RedisStore) RebuildIndexes() error {
+
+	for _, index := range []string{C_ENV_HOSTS, C_IDX_STATE, C_IDX_USER} {
+		for _, key := range s.ScanKeys(index) {
+			if err := s.Conn.Del(key).Err(); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, enType := range []string{C_TYPE_ENV, C_TYPE_HOST} {
 
+		prefixLen := len(enType) + 1
+
+		for _, key := range s.ScanKeys(enType) {
+
+			result, err := s.Conn.HMGet(key, C_PARENT, "state", "user", "expire").Result()
+			if err != nil {
+				return err
+			}
+
+			parent, _ := result[0].(string)
+			state, _ := result[1].(string)
+			user, _ := result[2].(string)
+			expire, _ := result[3].(string)
+
+			pipe := s.Conn.TxPipeline()
+			if state != "" {
+				pipe.SAdd(C_IDX_STATE+":"+state, key)
+			}
+			if user != "" {
+				pipe.SAdd(C_IDX_USER+":"+user, key)
+			}
+			if enType == C_TYPE_HOST && state == C_STATE_LOCKED {
+				pipe.SAdd(C_ENV_HOSTS+":"+parent, key[prefixLen:])
+			}
+			if l, ok := leaseOf(key, state, user, expire); ok {
+				pipe.HSetNX(C_LEASES, key, l)
+			}
+			if _, err := pipe.Exec(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
 }
 
 // matchPattern should be C_TYPE_ENV or C_TYPE_HOST
-func RScanKeys(matchPattern string) []string {
+func (s *RedisStore) ScanKeys(matchPattern string) []string {
 
 	var cursor uint64
 	keys := make([]string, 0)
@@ -153,7 +691,7 @@ func RScanKeys(matchPattern string) []string {
 			result []string
 			err    error
 		)
-		result, cursor, err = RConn.Scan(cursor, matchPattern+":*", 10).Result()
+		result, cursor, err = s.Conn.Scan(cursor, matchPattern+":*", 10).Result()
 		if err != nil {
 			log.Fatal(err.Error())
 		}
@@ -166,74 +704,455 @@ func RScanKeys(matchPattern string) []string {
 	return keys
 }
 
-func RFillJsonStats(r *Stats) {
-
-	envs := RScanKeys(C_TYPE_ENV)
-	envPrefixLen := len(C_TYPE_ENV) + 1
-	hostPrefixLen := len(C_TYPE_HOST) + 1
+func (s *RedisStore) FillJsonStats(r *Stats) {
 
-	for _, key := range envs { // environment data
+	for _, state := range []string{C_STATE_VALID, C_STATE_LOCKED, C_STATE_MAINTENANCE, C_STATE_TERMINATED} {
 
-		var envName string
-		var lockingUser string
-		var lastDay string
+		keys := s.EntitiesInState(state)
 
-		result, err := RConn.HGetAll(key).Result()
-		if err != nil {
-			fmt.Printf("Error fetching data for key %s: %s\n", key, err)
+		pipe := s.Conn.Pipeline()
+		cmds := make([]*redis.StringStringMapCmd, len(keys))
+		for i, key := range keys {
+			cmds[i] = pipe.HGetAll(key)
+		}
+		if _, err := pipe.Exec(); err != nil {
+			fmt.Printf("Error fetching '%s' entities: %s\n", state, err)
 			continue
 		}
 
-		for field, value := range result {
+		for i, key := range keys {
+			enType, enName := splitKey(key)
+			fillStatsEntry(r, enType, enName, cmds[i].Val())
+		}
+	}
 
-			switch {
-			case field == "state" && value == C_STATE_VALID:
-				r.ValidEnvs = append(r.ValidEnvs, key[envPrefixLen:])
-			case field == "state" && value == C_STATE_LOCKED:
-				envName = key[envPrefixLen:]
-				if len(lockingUser) > 0 {
-					h := envName + " (👤" + lockingUser + "   📅" + lastDay + ")"
-					r.LockedEnvs = append(r.LockedEnvs, h)
-				}
-			case field == "state" && value == C_STATE_MAINTENANCE:
-				r.MaintEnvs = append(r.MaintEnvs, key[envPrefixLen:])
-			case field == "state" && value == C_STATE_TERMINATED:
-				r.TermdEnvs = append(r.TermdEnvs, key[envPrefixLen:])
-			case field == "user":
-				lockingUser = value
-			case field == "lastday":
-				lastDay = value
+	for _, key := range s.ReservedEntities() {
+		enType, enName := splitKey(key)
+		fillReservationStats(r, enType, enName, s.ReserveList(enType, enName))
+	}
+}
+
+func (s *RedisStore) FillStatus(r *StatusV2, keys []string, now time.Time) {
+
+	pipe := s.Conn.Pipeline()
+	cmds := make([]*redis.StringStringMapCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.HGetAll(key)
+	}
+	if _, err := pipe.Exec(); err != nil && len(keys) > 0 {
+		fmt.Printf("Error fetching the entities: %s\n", err)
+	} else {
+		for i, key := range keys {
+			if fields := cmds[i].Val(); len(fields) > 0 {
+				enType, enName := splitKey(key)
+				fillStatusEntry(r, enType, enName, fields, now)
 			}
 		}
 	}
 
-	hosts := RScanKeys(C_TYPE_HOST)
+	for _, key := range s.ReservedEntities() {
+		enType, enName := splitKey(key)
+		fillStatusReservations(r, enType, enName, s.ReserveList(enType, enName))
+	}
+}
 
-	for _, key := range hosts { // host data
+// KEYS: queue of the entity, entities with a queue
+//
+// ARGV: entity key, user, JSON encoded QueueEntry
+var queueJoinScript = redis.NewScript(`
+local items = redis.call('LRANGE', KEYS[1], 0, -1)
 
-		var hostName string
-		var lockingUser string
-		var lastDay string
+for i, item in ipairs(items) do
+	if cjson.decode(item)['user'] == ARGV[2] then
+		redis.call('LSET', KEYS[1], i - 1, ARGV[3])
+		return i
+	end
+end
 
-		result, err := RConn.HGetAll(key).Result()
-		if err != nil {
-			fmt.Printf("Error fetching data for key %s: %s\n", key, err)
-			continue
+redis.call('SADD', KEYS[2], ARGV[1])
+return redis.call('RPUSH', KEYS[1], ARGV[3])
+`)
+
+func (s *RedisStore) QueueJoin(c *LockData) (int, error) {
+
+	entry, err := json.Marshal(QueueEntry{User: c.User, LastDay: c.LastDay, Expire: c.Expire, For: c.For})
+	if err != nil {
+		return 0, err
+	}
+
+	key := c.Type + ":" + c.Name
+	pos, err := queueJoinScript.Run(s.Conn, []string{C_QUEUE + ":" + key, C_QUEUES},
+		key, c.User, string(entry)).Int()
+
+	return pos, err
+}
+
+// KEYS: queue of the entity, entities with a queue
+//
+// ARGV: entity key, user
+var queueLeaveScript = redis.NewScript(`
+local items = redis.call('LRANGE', KEYS[1], 0, -1)
+
+for _, item in ipairs(items) do
+	if cjson.decode(item)['user'] == ARGV[2] then
+		redis.call('LREM', KEYS[1], 1, item)
+		if redis.call('LLEN', KEYS[1]) == 0 then
+			redis.call('SREM', KEYS[2], ARGV[1])
+		end
+		return 1
+	end
+end
+
+return 0
+`)
+
+func (s *RedisStore) QueueLeave(c *LockData) (bool, error) {
+
+	key := c.Type + ":" + c.Name
+	left, err := queueLeaveScript.Run(s.Conn, []string{C_QUEUE + ":" + key, C_QUEUES},
+		key, c.User).Int()
+
+	return left == 1, err
+}
+
+func (s *RedisStore) QueueList(enType string, enName string) []QueueEntry {
+
+	queue := make([]QueueEntry, 0)
+
+	items, err := s.Conn.LRange(C_QUEUE+":"+enType+":"+enName, 0, -1).Result()
+	if err != nil {
+		fmt.Printf("Error fetching queue of %s:%s: %s\n", enType, enName, err)
+		return queue
+	}
+
+	for _, item := range items {
+		var q QueueEntry
+		if json.Unmarshal([]byte(item), &q) == nil {
+			queue = append(queue, q)
 		}
+	}
+
+	return queue
+}
+
+func (s *RedisStore) QueuedEntities() []string {
+
+	keys, err := s.Conn.SMembers(C_QUEUES).Result()
+	if err != nil {
+		fmt.Printf("Error fetching queued entities: %s\n", err)
+		return []string{}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// KEYS: entity, env (the parent env for hosts), calendar of the entity,
+// entities with reservations
+//
+// ARGV: type, user, firstday, lastday, JSON encoded Reservation, entity key
+var reserveAddScript = redis.NewScript(`
+if ARGV[1] == '` + C_TYPE_HOST + `' and redis.call('EXISTS', KEYS[2]) == 0 then
+	return '` + acqParentNil + `'
+end
+
+local cur = redis.call('HMGET', KEYS[1], 'state', 'user', 'lastday')
+if cur[1] == '` + C_STATE_LOCKED + `' and cur[2] and cur[2] ~= '' and cur[2] ~= ARGV[2] and cur[3] and cur[3] >= ARGV[3] then
+	return '` + acqBooked + `'
+end
+
+-- keep the calendar ordered by the first day
+local before = nil
+for _, item in ipairs(redis.call('LRANGE', KEYS[3], 0, -1)) do
+	local r = cjson.decode(item)
+	if r['firstday'] <= ARGV[4] and r['lastday'] >= ARGV[3] then
+		return '` + acqBooked + `'
+	end
+	if not before and r['firstday'] > ARGV[3] then
+		before = item
+	end
+end
 
-		for field, value := range result {
+if before then
+	redis.call('LINSERT', KEYS[3], 'BEFORE', before, ARGV[5])
+else
+	redis.call('RPUSH', KEYS[3], ARGV[5])
+end
+redis.call('SADD', KEYS[4], ARGV[6])
 
-			switch {
-			case field == "state" && value == C_STATE_LOCKED:
-				hostName = key[hostPrefixLen:]
-			case field == "user":
-				lockingUser = value
-			case field == "lastday":
-				lastDay = value
+return '` + acqOK + `'
+`)
+
+func (s *RedisStore) ReserveAdd(c *LockData) *RichErrorStatus {
+
+	entry, err := json.Marshal(Reservation{User: c.User, FirstDay: c.FirstDay, LastDay: c.LastDay, Expire: c.Expire})
+	if err != nil {
+		return acqStatus("", ERR_ReservationFail)
+	}
+
+	key := c.Type + ":" + c.Name
+	keys := []string{
+		key,
+		C_TYPE_ENV + ":" + envOf(c.Type, c.Name),
+		C_CALENDAR + ":" + key,
+		C_CALENDARS,
+	}
+
+	result, err := reserveAddScript.Run(s.Conn, keys,
+		c.Type, c.User, c.FirstDay, c.LastDay, string(entry), key).String()
+	if err != nil {
+		fmt.Printf("%s Reservation script failed on '%s': %s\n", C_FAILED, key, err)
+		result = ""
+	}
+
+	return acqStatus(result, ERR_ReservationFail)
+}
+
+// KEYS: calendar of the entity, entities with reservations
+//
+// ARGV: entity key, user, admin, firstday
+var reserveCancelScript = redis.NewScript(`
+for _, item in ipairs(redis.call('LRANGE', KEYS[1], 0, -1)) do
+	local r = cjson.decode(item)
+	if r['firstday'] == ARGV[4] and (r['user'] == ARGV[2] or ARGV[2] == ARGV[3]) then
+		redis.call('LREM', KEYS[1], 1, item)
+		if redis.call('LLEN', KEYS[1]) == 0 then
+			redis.call('SREM', KEYS[2], ARGV[1])
+		end
+		return 1
+	end
+end
+
+return 0
+`)
+
+func (s *RedisStore) ReserveCancel(c *LockData) (bool, error) {
+
+	key := c.Type + ":" + c.Name
+	canceled, err := reserveCancelScript.Run(s.Conn, []string{C_CALENDAR + ":" + key, C_CALENDARS},
+		key, c.User, C_ADMIN, c.FirstDay).Int()
+
+	return canceled == 1, err
+}
+
+func (s *RedisStore) ReserveList(enType string, enName string) []Reservation {
+
+	calendar := make([]Reservation, 0)
+
+	items, err := s.Conn.LRange(C_CALENDAR+":"+enType+":"+enName, 0, -1).Result()
+	if err != nil {
+		fmt.Printf("Error fetching reservations of %s:%s: %s\n", enType, enName, err)
+		return calendar
+	}
+
+	for _, item := range items {
+		var r Reservation
+		if json.Unmarshal([]byte(item), &r) == nil {
+			calendar = append(calendar, r)
+		}
+	}
+
+	return calendar
+}
+
+func (s *RedisStore) ReservedEntities() []string {
+
+	keys, err := s.Conn.SMembers(C_CALENDARS).Result()
+	if err != nil {
+		fmt.Printf("Error fetching reserved entities: %s\n", err)
+		return []string{}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// KEYS: leases
+//
+// ARGV: now as unix seconds
+var leasesExpiredScript = redis.NewScript(`
+local expired = {}
+
+local all = redis.call('HGETALL', KEYS[1])
+for i = 1, #all, 2 do
+	if tonumber(cjson.decode(all[i + 1])['expireat']) <= tonumber(ARGV[1]) then
+		redis.call('HDEL', KEYS[1], all[i])
+		table.insert(expired, all[i + 1])
+	end
+end
+
+return expired
+`)
+
+func (s *RedisStore) LeasesExpired(now time.Time) []Lease {
+
+	leases := make([]Lease, 0)
+
+	reply, err := leasesExpiredScript.Run(s.Conn, []string{C_LEASES}, now.Unix()).Result()
+	if err != nil {
+		fmt.Printf("Error fetching expired leases: %s\n", err)
+		return leases
+	}
+
+	items, _ := reply.([]interface{})
+	for _, item := range items {
+		var l Lease
+		if str, ok := item.(string); ok && json.Unmarshal([]byte(str), &l) == nil {
+			leases = append(leases, l)
+		}
+	}
+	sort.Slice(leases, func(i, j int) bool { return leases[i].ExpireAt < leases[j].ExpireAt })
+
+	return leases
+}
+
+// KEYS: leases
+//
+// ARGV: key, now as unix seconds
+var leaseTakeScript = redis.NewScript(`
+local item = redis.call('HGET', KEYS[1], ARGV[1])
+if not item or tonumber(cjson.decode(item)['expireat']) > tonumber(ARGV[2]) then
+	return false
+end
+
+redis.call('HDEL', KEYS[1], ARGV[1])
+return item
+`)
+
+func (s *RedisStore) LeaseTake(key string, now time.Time) (Lease, bool) {
+
+	var l Lease
+
+	item, err := leaseTakeScript.Run(s.Conn, []string{C_LEASES}, key, now.Unix()).String()
+	if err != nil {
+		if err != redis.Nil {
+			fmt.Printf("Error fetching lease of '%s': %s\n", key, err)
+		}
+		return l, false
+	}
+
+	return l, json.Unmarshal([]byte(item), &l) == nil
+}
+
+// Needs `notify-keyspace-events` with `E` and `x` (or `A`) on the server.
+func (s *RedisStore) WatchExpired(stop <-chan struct{}) (<-chan string, error) {
+
+	cfg, err := s.Conn.ConfigGet("notify-keyspace-events").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	flags := ""
+	if len(cfg) == 2 {
+		flags, _ = cfg[1].(string)
+	}
+	if !strings.Contains(flags, "E") || !strings.ContainsAny(flags, "xA") {
+		return nil, fmt.Errorf("notify-keyspace-events is '%s', expired events need 'Ex'", flags)
+	}
+
+	pubsub := s.Conn.Subscribe(fmt.Sprintf("__keyevent@%d__:expired", s.Conn.Options().DB))
+	if _, err := pubsub.Receive(); err != nil {
+		_ = pubsub.Close()
+		return nil, err
+	}
+
+	keys := make(chan string)
+
+	go func() {
+		defer close(keys)
+		defer pubsub.Close()
+
+		messages := pubsub.Channel()
+		for {
+			select {
+			case <-stop:
+				return
+			case m, ok := <-messages:
+				if !ok {
+					return
+				}
+				if !strings.HasPrefix(m.Payload, C_TYPE_ENV+":") && !strings.HasPrefix(m.Payload, C_TYPE_HOST+":") {
+					continue
+				}
+				select {
+				case keys <- m.Payload:
+				case <-stop:
+					return
+				}
 			}
 		}
+	}()
+
+	return keys, nil
+}
+
+func (s *RedisStore) HistoryAdd(e *Event) error {
+
+	t, err := time.Parse(time.RFC3339, e.Time)
+	if err != nil {
+		return err
+	}
+
+	id, err := s.Conn.HIncrBy(C_META, "historyseq", 1).Result()
+	if err != nil {
+		return err
+	}
+
+	recorded := *e
+	recorded.ID = id
+	item, err := json.Marshal(recorded)
+	if err != nil {
+		return err
+	}
+
+	if err := s.Conn.ZAdd(C_HISTORY, redis.Z{Score: float64(t.Unix()), Member: string(item)}).Err(); err != nil {
+		return err
+	}
+	e.ID = id
+
+	return nil
+}
+
+func (s *RedisStore) HistoryList(since time.Time) []Event {
+
+	events := make([]Event, 0)
+
+	items, err := s.Conn.ZRangeByScore(C_HISTORY, redis.ZRangeBy{
+		Min: strconv.FormatInt(since.Unix(), 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		fmt.Printf("Error fetching history: %s\n", err)
+		return events
+	}
+
+	for _, item := range items {
+		var e Event
+		if json.Unmarshal([]byte(item), &e) == nil {
+			events = append(events, e)
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].ID < events[j].ID })
+
+	return events
+}
+
+func (s *RedisStore) HistoryPrune(before time.Time) (int64, error) {
+
+	return s.Conn.ZRemRangeByScore(C_HISTORY, "-inf", "("+strconv.FormatInt(before.Unix(), 10)).Result()
+}
 
-		h := hostName + " (👤" + lockingUser + "   📅" + lastDay + ")"
-		r.LockedHosts = append(r.LockedHosts, h)
+func (s *RedisStore) RateIncr(key string, window time.Duration) (int64, error) {
+
+	count, err := s.Conn.Incr(key).Result()
+	if err != nil {
+		return 0, err
 	}
+
+	// Set expiry on first request
+	if count == 1 {
+		s.Conn.Expire(key, window)
+	}
+
+	return count, nil
 }
@@ -0,0 +1,363 @@
+package x
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	C_REMIND_INTERVAL time.Duration = time.Minute    // reminder scheduler period
+	C_REMIND_EXTEND   time.Duration = 24 * time.Hour // extension offered by the reminders
+	C_REMIND_WINDOWS  string        = "24h,1h"       // default reminder windows before the expiry
+
+	C_NOTIFIER_LOG     string = "log"
+	C_NOTIFIER_WEBHOOK string = "webhook"
+	C_NOTIFIER_SMTP    string = "smtp"
+
+	C_PUBLIC_URL string = "https://localhost:3000" // default base of the URLs sent out
+	C_SMTP_ADDR  string = "localhost:25"           // default SMTP relay
+	C_SMTP_FROM  string = "nodelocker@localhost"   // default sender of the reminders
+)
+
+// Reminder tells the owner of a lock that it runs out soon.
+type Reminder struct {
+	Type      string `json:"type"`
+	Name      string `json:"name"`
+	User      string `json:"user"`
+	Expire    string `json:"expire"`
+	Left      string `json:"left"`
+	ExtendURL string `json:"extendurl"`
+}
+
+// Notifier sends the reminders to the owners of the locks, giving up when
+// the context is cancelled.
+type Notifier interface {
+	Notify(ctx context.Context, r Reminder) error
+}
+
+// NotifierConfig selects and sets up a Notifier, see NewNotifier.
+type NotifierConfig struct {
+	Kind       string // 'log', 'webhook' or 'smtp'
+	URL        string // webhook: where the reminders are posted to
+	Secret     string // webhook: key of the HMAC signature
+	SMTPAddr   string // smtp: host:port of the relay, no authentication
+	SMTPFrom   string // smtp: sender address
+	MailDomain string // smtp: users get mail as <user>@<MailDomain>
+}
+
+// LogNotifier prints the reminders to the log.
+type LogNotifier struct{}
+
+func (n LogNotifier) Notify(ctx context.Context, r Reminder) error {
+
+	fmt.Printf("⏰ %s:%s of '%s' expires at %s, in %s, extend: %s\n", r.Type, r.Name, r.User, r.Expire, r.Left, r.ExtendURL)
+	return nil
+}
+
+// WebhookNotifier posts the reminders as JSON, signed like the webhooks.
+type WebhookNotifier struct {
+	URL    string
+	Secret string
+}
+
+func (n WebhookNotifier) Notify(ctx context.Context, r Reminder) error {
+
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", C_RespHeader)
+	req.Header.Set("User-Agent", "nodelocker")
+	req.Header.Set(C_HDR_EVENT, "remind")
+	signWebhook(req, n.Secret, body)
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// SMTPNotifier mails the reminders through a local relay.
+type SMTPNotifier struct {
+	Addr   string
+	From   string
+	Domain string
+}
+
+func (n SMTPNotifier) Notify(ctx context.Context, r Reminder) error {
+
+	// they end up in the headers
+	if strings.ContainsAny(r.User+r.Type+r.Name+r.Left, "\r\n") {
+		return fmt.Errorf("line break in the reminder of %s:%s", r.Type, r.Name)
+	}
+
+	to, err := mail.ParseAddress(r.User + "@" + n.Domain)
+	if err != nil {
+		return fmt.Errorf("no mail address of '%s': %w", r.User, err)
+	}
+	from, err := mail.ParseAddress(n.From)
+	if err != nil {
+		return fmt.Errorf("invalid sender '%s': %w", n.From, err)
+	}
+
+	subject := "Your lock of " + r.Type + ":" + r.Name + " expires in " + r.Left
+	msg := "From: " + from.String() + "\r\n" +
+		"To: " + to.String() + "\r\n" +
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" +
+		"Your lock of " + r.Type + ":" + r.Name + " expires at " + r.Expire + ".\r\n" +
+		"\r\n" +
+		"To keep it for " + shortDuration(C_REMIND_EXTEND) + " more, add your token to the end of:\r\n" +
+		r.ExtendURL + "\r\n"
+
+	return sendMail(ctx, n.Addr, from.Address, to.Address, []byte(msg))
+}
+
+// Wants: context cancelled to give up, SMTP relay, sender and recipient
+// addresses, the message
+//
+// Sends the mail like smtp.SendMail without authentication, the connection
+// is closed when the context gets cancelled.
+func sendMail(ctx context.Context, addr string, from string, to string, msg []byte) error {
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer context.AfterFunc(ctx, func() { conn.Close() })()
+
+	host, _, _ := net.SplitHostPort(addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+// Wants: filled NotifierConfig
+//
+// Returns: the notifier, error on unknown kind or missing settings
+func NewNotifier(cfg NotifierConfig) (Notifier, error) {
+
+	switch cfg.Kind {
+	case C_NOTIFIER_LOG, "":
+		return LogNotifier{}, nil
+	case C_NOTIFIER_WEBHOOK:
+		if !IsValidWebhookURL(cfg.URL) {
+			return nil, fmt.Errorf("invalid notifier url '%s'", cfg.URL)
+		}
+		return WebhookNotifier{URL: cfg.URL, Secret: cfg.Secret}, nil
+	case C_NOTIFIER_SMTP:
+		if cfg.MailDomain == "" {
+			return nil, fmt.Errorf("the smtp notifier needs the mail domain of the users")
+		}
+		return SMTPNotifier{Addr: cfg.SMTPAddr, From: cfg.SMTPFrom, Domain: cfg.MailDomain}, nil
+	default:
+		return nil, fmt.Errorf("unknown notifier '%s'", cfg.Kind)
+	}
+}
+
+// Wants: comma separated durations, e.g. "24h,1h"
+//
+// Returns: the windows, longest first, error if one is not a positive
+// duration
+func ParseRemindWindows(list string) ([]time.Duration, error) {
+
+	windows := make([]time.Duration, 0)
+	for _, item := range SplitList(list) {
+		w, err := time.ParseDuration(item)
+		if err != nil || w <= 0 {
+			return nil, fmt.Errorf("invalid reminder window '%s'", item)
+		}
+		windows = append(windows, w)
+	}
+	sort.Slice(windows, func(i, j int) bool { return windows[i] > windows[j] })
+
+	return windows, nil
+}
+
+// Returns: the duration without its zero minutes and seconds, e.g. 24h
+func shortDuration(d time.Duration) string {
+
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+
+	return s
+}
+
+// Wants: base URL of the server, the lease of the lock
+//
+// Returns: the extend URL of the lock, ending with the empty token
+func ExtendURL(publicURL string, l Lease) string {
+
+	enType, enName := splitKey(l.Key)
+
+	q := url.Values{}
+	q.Set("type", enType)
+	q.Set("name", enName)
+	q.Set("user", l.User)
+	q.Set("for", shortDuration(C_REMIND_EXTEND))
+
+	return strings.TrimRight(publicURL, "/") + "/extend?" + q.Encode() + "&token="
+}
+
+// Wants: context cancelled to stop, notifier, base URL of the extend URLs,
+// reminder windows longest first, current time
+//
+// Reminds the owners of the locks entering a window, once per window and
+// expiry, an extended lock gets reminded again.
+func SendReminders(ctx context.Context, n Notifier, publicURL string, windows []time.Duration, now time.Time) {
+
+	leases := make(map[string]Lease)
+	for key, item := range DB.GetAll(C_LEASES) {
+		var l Lease
+		if json.Unmarshal([]byte(item), &l) == nil {
+			leases[key] = l
+		}
+	}
+
+	// the reminders sent, the expiry and the window, of the gone locks
+	// aren't needed anymore
+	reminded := DB.GetAll(C_REMINDED)
+	for key := range reminded {
+		if _, ok := leases[key]; !ok {
+			DB.EntityDelete(C_REMINDED, key)
+		}
+	}
+
+	keys := make([]string, 0, len(leases))
+	for key := range leases {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		l := leases[key]
+		left := time.Unix(l.ExpireAt, 0).Sub(now)
+		if left <= 0 {
+			continue // expired, not recorded yet
+		}
+
+		// the shortest window the lock is in
+		window := time.Duration(0)
+		for _, w := range windows {
+			if left <= w {
+				window = w
+			}
+		}
+		if window == 0 {
+			continue
+		}
+
+		if expire, sent, ok := strings.Cut(reminded[key], " "); ok && expire == l.Expire {
+			if s, err := strconv.ParseInt(sent, 10, 64); err == nil && time.Duration(s)*time.Second <= window {
+				continue
+			}
+		}
+
+		enType, enName := splitKey(key)
+		r := Reminder{
+			Type:      enType,
+			Name:      enName,
+			User:      l.User,
+			Expire:    l.Expire,
+			Left:      shortDuration(left.Round(time.Minute)),
+			ExtendURL: ExtendURL(publicURL, l),
+		}
+		if err := n.Notify(ctx, r); err != nil {
+			fmt.Printf("%s Cannot remind '%s' of %s: %s\n", C_FAILED, l.User, key, err)
+			continue
+		}
+
+		DB.SetSingle(C_REMINDED, key, l.Expire+" "+strconv.FormatInt(int64(window.Seconds()), 10))
+	}
+}
+
+// Wants: time between two runs, notifier, base URL of the extend URLs,
+// reminder windows, channel closed to stop
+//
+// Reminds the owners of the locks running out soon.
+func RunReminderScheduler(interval time.Duration, n Notifier, publicURL string, windows []time.Duration, stop <-chan struct{}) {
+
+	if len(windows) == 0 {
+		return
+	}
+
+	ctx, cancel := stopContext(stop)
+	defer cancel()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			SendReminders(ctx, n, publicURL, windows, time.Now())
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package x
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureStdout returns what fn printed.
+func captureStdout(t *testing.T, fn func()) string {
+
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = prev }()
+
+	out := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		out <- string(b)
+	}()
+
+	fn()
+	w.Close()
+
+	return <-out
+}
+
+func TestRemindersOfShortLock(t *testing.T) {
+
+	useMemStore(t)
+	EnvCreate("env1")
+
+	c := &LockData{Type: C_TYPE_HOST, Name: "env1-host1", User: "user1"}
+	expire, _ := ParseExpiry("", "30m", DefaultTZ)
+	SetExpiry(c, expire)
+	if res := new(WebResponse); !HostLock(c, res) {
+		t.Fatal(res.Messages)
+	}
+
+	windows, _ := ParseRemindWindows("24h,1h")
+	now := time.Now()
+
+	out := captureStdout(t, func() {
+		SendReminders(context.Background(), LogNotifier{}, "https://nodelocker.example", windows, now)
+		SendReminders(context.Background(), LogNotifier{}, "https://nodelocker.example", windows, now.Add(time.Minute))
+	})
+
+	if n := strings.Count(out, "⏰"); n != 1 {
+		t.Fatalf("%d reminders, want 1 for the 1h window:\n%s", n, out)
+	}
+	for _, want := range []string{"host:env1-host1 of 'user1'", "in 30m", "https://nodelocker.example/extend?for=24h&name=env1-host1&type=host&user=user1&token="} {
+		if !strings.Contains(out, want) {
+			t.Errorf("reminder %q lacks %q", out, want)
+		}
+	}
+}
+
+func TestSMTPNotifierRefusesLineBreaks(t *testing.T) {
+
+	n := SMTPNotifier{Addr: "localhost:0", From: C_SMTP_FROM, Domain: "example.com"}
+
+	for _, r := range []Reminder{
+		{Type: C_TYPE_HOST, Name: "env1-host1", User: "user1\r\nBcc: x@example.org"},
+		{Type: C_TYPE_HOST, Name: "env1-host1\nSubject: x", User: "user1"},
+	} {
+		err := n.Notify(context.Background(), r)
+		if err == nil || !strings.Contains(err.Error(), "line break") {
+			t.Errorf("Notify(%q, %q) = %v, want refused", r.User, r.Name, err)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package x
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	C_RESERVATION_INTERVAL time.Duration = time.Minute // reservation scheduler period
+)
+
+// Wants: filled LockData with a valid LastDay and FirstDay, see
+// IsValidFirstDay
+//
+// Returns: `true` if the reservation got booked
+func EntityReserve(c *LockData, res *WebResponse) bool {
+
+	// it could never become a lock
+	if max := EnvMaxLock(envOf(c.Type, c.Name)); max > 0 {
+		start, _ := time.ParseInLocation("20060102", c.FirstDay, DefaultTZ)
+		if GetExpiry(c).Sub(start) > max {
+			res.Messages = append(res.Messages, ERR_LockTooLong)
+			c.HttpErr = http.StatusForbidden
+			return false
+		}
+	}
+
+	r := DB.ReserveAdd(c)
+	c.HttpErr = r.HttpErrCode
+
+	if r.IsError {
+		res.Messages = append(res.Messages, r.ErrorMessage)
+		return false
+	}
+
+	res.Messages = append(res.Messages, OK_Reserved)
+	res.FirstDay = c.FirstDay
+	res.LastDay = c.LastDay
+	c.HttpErr = http.StatusCreated
+
+	// a reservation starting today is a lock already
+	ActivateReservations(c.Type, c.Name)
+
+	res.Reservations = DB.ReserveList(c.Type, c.Name)
+	return true
+}
+
+// Wants: filled LockData with the FirstDay of the reservation
+//
+// Returns: `true` if the reservation got canceled
+func EntityCancelReservation(c *LockData, res *WebResponse) bool {
+
+	canceled, err := DB.ReserveCancel(c)
+
+	switch {
+	case err != nil:
+		fmt.Printf("%s Cannot cancel reservation of '%s' for %s:%s: %s\n", C_FAILED, c.User, c.Type, c.Name, err)
+		res.Messages = append(res.Messages, ERR_ReservationFail)
+		c.HttpErr = http.StatusInternalServerError
+		return false
+	case !canceled:
+		res.Messages = append(res.Messages, ERR_NoSuchReservation)
+		c.HttpErr = http.StatusNotFound
+		return false
+	}
+
+	res.Messages = append(res.Messages, OK_ReservationCanceled)
+	res.Reservations = DB.ReserveList(c.Type, c.Name)
+	c.HttpErr = http.StatusOK
+	return true
+}
+
+// Wants: entity type and name
+//
+// Returns: the user whose reservation became a lock, "" if nobody
+func ActivateReservations(enType string, enName string) string {
+
+	today := Today()
+
+	for _, r := range DB.ReserveList(enType, enName) {
+
+		c := new(LockData)
+		c.Type = enType
+		c.Name = enName
+		c.User = r.User
+		c.FirstDay = r.FirstDay
+		c.LastDay = r.LastDay
+		c.Expire = r.Expire
+
+		// the booked days are over already
+		if r.LastDay < today {
+			_, _ = DB.ReserveCancel(c)
+			continue
+		}
+
+		// the calendar is ordered, the rest is in the future
+		if r.FirstDay > today {
+			return ""
+		}
+
+		res := new(WebResponse)
+		locked := false
+
+		switch enType {
+		case C_TYPE_ENV:
+			locked = EnvLock(c, res)
+		case C_TYPE_HOST:
+			locked = HostLock(c, res)
+		}
+
+		if !locked { // e.g. the env/host hierarchy, tried again next time
+			return ""
+		}
+
+		_, _ = DB.ReserveCancel(c)
+		fmt.Printf("%s %s:%s locked for '%s' as reserved\n", C_SUCCESS, enType, enName, r.User)
+		return r.User
+	}
+
+	return ""
+}
+
+// Wants: time between two runs, channel closed to stop
+//
+// Turns the reservations into locks on their first day.
+func RunReservationScheduler(interval time.Duration, stop <-chan struct{}) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			for _, key := range DB.ReservedEntities() {
+				enType, enName := splitKey(key)
+				ActivateReservations(enType, enName)
+			}
+		}
+	}
+}
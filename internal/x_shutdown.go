@@ -0,0 +1,90 @@
+package x
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Wants: server from NewServer or NewTLSServer, configuration with the
+// shutdown timeout
+//
+// Serves until SIGTERM or SIGINT, then stops accepting connections, ends the
+// event streams and waits for the requests in flight for the shutdown
+// timeout at most. A second signal cuts the wait short.
+//
+// Returns: nil after a clean shutdown, the error of the server failing to
+// start or of the requests cut off
+func Serve(server *http.Server, c *Config) error {
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(sig)
+
+	server.RegisterOnShutdown(CloseEventStreams)
+
+	served := make(chan error, 1)
+	go func() {
+		fmt.Printf("%s Server is accepting connections on %s\n", C_STARTED, server.Addr)
+		if server.TLSConfig != nil {
+			served <- server.ListenAndServeTLS("", "")
+		} else {
+			served <- server.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err := <-served:
+		return err
+	case s := <-sig:
+		fmt.Printf("%s Received %s, finishing the requests in flight\n", C_STOPPING, s)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if c.ShutdownTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, c.ShutdownTimeout)
+		defer cancel()
+	}
+
+	go func() {
+		select {
+		case <-sig:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if err := server.Shutdown(ctx); err != nil {
+		_ = server.Close()
+		return fmt.Errorf("requests cut off: %w", err)
+	}
+
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+// Wants: channel closed to stop
+//
+// Returns: context cancelled when stop gets closed, for the requests of the
+// runners, cancel it when done
+func stopContext(stop <-chan struct{}) (context.Context, context.CancelFunc) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
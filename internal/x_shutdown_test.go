@@ -0,0 +1,105 @@
+package x
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// SIGTERM in the middle of a request and of a webhook delivery: the request
+// is finished, the delivery is cut off without waiting for its timeout and
+// stays due.
+func TestServeStopsOnSIGTERM(t *testing.T) {
+
+	useMemStore(t)
+
+	hooked := make(chan struct{})
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body) // then the closed connection cancels the context
+		close(hooked)
+		<-r.Context().Done() // never answers
+	}))
+	defer hook.Close()
+
+	WebhookSet(Webhook{Name: "slow", URL: hook.URL})
+	QueueWebhooks(Event{ID: 1, Action: C_EV_LOCK, Type: C_TYPE_ENV, Name: "env1"})
+
+	stop := make(chan struct{})
+	var runners sync.WaitGroup
+	runners.Add(1)
+	go func() {
+		defer runners.Done()
+		RunWebhookDispatcher(time.Hour, stop)
+	}()
+	<-hooked
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := DefaultConfig()
+	c.Listen = ln.Addr().String()
+	c.ShutdownTimeout = 5 * time.Second
+	ln.Close()
+
+	inFlight := make(chan struct{})
+	server := NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(inFlight)
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte("done"))
+	}), c)
+
+	served := make(chan error, 1)
+	go func() { served <- Serve(server, c) }()
+
+	answered := make(chan string, 1)
+	go func() {
+		for {
+			resp, err := http.Get("http://" + c.Listen + "/")
+			if err != nil {
+				time.Sleep(10 * time.Millisecond) // not listening yet
+				continue
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			answered <- string(body)
+			return
+		}
+	}()
+
+	<-inFlight
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatalf("Serve: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return")
+	}
+	if body := <-answered; body != "done" {
+		t.Errorf("request in flight got %q, want done", body)
+	}
+
+	start := time.Now()
+	close(stop)
+	runners.Wait()
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("the runners stopped in %s, the delivery was not cut off", waited)
+	}
+
+	var d Delivery
+	item, ok := DB.GetAll(C_DELIVERIES)["00000000000000000001-slow"]
+	if !ok || json.Unmarshal([]byte(item), &d) != nil || d.Attempts != 0 {
+		t.Errorf("delivery %q, want it due without attempts", item)
+	}
+}
@@ -0,0 +1,266 @@
+package x
+
+import (
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	C_STATUS_VERSION int = 2 // version of the /v2/status schema
+)
+
+// entityStates are the states of the entities, in the order of the stats.
+var entityStates = []string{C_STATE_VALID, C_STATE_LOCKED, C_STATE_MAINTENANCE, C_STATE_TERMINATED}
+
+// StatusQuery filters, sorts and pages the status, its zero value selects
+// everything ordered by name.
+type StatusQuery struct {
+	States   []string       // any of the states
+	Type     string         // env or host
+	Env      string         // the env and its hosts
+	Owners   []string       // locked by any of them
+	Name     string         // glob on the name
+	Regex    *regexp.Regexp // regular expression on the name
+	Expiring time.Duration  // locks expiring within
+	Sort     string         // name, type, state, owner, expire or ttl
+	Desc     bool           // descending order
+	Offset   int            // entities skipped
+	Limit    int            // entities returned at most, 0 for all
+}
+
+// statusSorts are the fields the status can be sorted by.
+var statusSorts = []string{"name", "type", "state", "owner", "expire", "ttl"}
+
+// Wants: query parameters of a status request
+//
+// Returns: the query, "" or the error message of the first wrong parameter
+func ParseStatusQuery(params url.Values) (*StatusQuery, string) {
+
+	q := &StatusQuery{
+		States: SplitList(params.Get("state")),
+		Type:   params.Get("type"),
+		Env:    params.Get("env"),
+		Owners: SplitList(params.Get("owner")),
+		Name:   params.Get("name"),
+		Sort:   strings.TrimPrefix(params.Get("sort"), "-"),
+		Desc:   strings.HasPrefix(params.Get("sort"), "-"),
+	}
+
+	for _, state := range q.States {
+		if !slices.Contains(entityStates, state) {
+			return nil, ERR_InvalidStateFilter
+		}
+	}
+
+	if q.Type != "" && ValidateType(q.Type).IsError {
+		return nil, ERR_WrongTypeSpecified
+	}
+
+	if _, err := path.Match(q.Name, ""); err != nil {
+		return nil, ERR_InvalidNameFilter
+	}
+
+	if regex := params.Get("regex"); regex != "" {
+		re, err := regexp.Compile(regex)
+		if err != nil {
+			return nil, ERR_InvalidNameFilter
+		}
+		q.Regex = re
+	}
+
+	// plain hours or a duration
+	if expiring := params.Get("expiring"); expiring != "" {
+		hours, err := strconv.Atoi(expiring)
+		q.Expiring = time.Duration(hours) * time.Hour
+		if err != nil {
+			q.Expiring, err = time.ParseDuration(expiring)
+		}
+		if err != nil || q.Expiring <= 0 {
+			return nil, ERR_InvalidExpiringFilter
+		}
+	}
+
+	if q.Sort != "" && !slices.Contains(statusSorts, q.Sort) {
+		return nil, ERR_InvalidSort
+	}
+
+	var err error
+	if offset := params.Get("offset"); offset != "" {
+		if q.Offset, err = strconv.Atoi(offset); err != nil || q.Offset < 0 {
+			return nil, ERR_InvalidPaging
+		}
+	}
+	if limit := params.Get("limit"); limit != "" {
+		if q.Limit, err = strconv.Atoi(limit); err != nil || q.Limit < 0 {
+			return nil, ERR_InvalidPaging
+		}
+	}
+
+	return q, ""
+}
+
+// Wants: entity of the status
+//
+// Returns: `true` if the entity passes the filters
+func (q *StatusQuery) Matches(e EntityStatus) bool {
+
+	switch {
+	case len(q.States) > 0 && !slices.Contains(q.States, e.State):
+		return false
+	case q.Type != "" && e.Type != q.Type:
+		return false
+	case q.Env != "" && envOf(e.Type, e.Name) != q.Env:
+		return false
+	case len(q.Owners) > 0 && !slices.Contains(q.Owners, e.Owner):
+		return false
+	case q.Regex != nil && !q.Regex.MatchString(e.Name):
+		return false
+	case q.Expiring > 0 && (e.State != C_STATE_LOCKED || time.Duration(e.TTL)*time.Second > q.Expiring):
+		return false
+	}
+
+	if q.Name != "" {
+		if ok, _ := path.Match(q.Name, e.Name); !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Returns: `true` if entity a comes before b, by name if the sort field is
+// the same
+func (q *StatusQuery) less(a EntityStatus, b EntityStatus) bool {
+
+	var cmp int
+	switch q.Sort {
+	case "type":
+		cmp = strings.Compare(a.Type, b.Type)
+	case "state":
+		cmp = strings.Compare(a.State, b.State)
+	case "owner":
+		cmp = strings.Compare(a.Owner, b.Owner)
+	case "expire", "ttl": // the same order, RFC 3339 times may differ in zone
+		switch {
+		case a.TTL < b.TTL:
+			cmp = -1
+		case a.TTL > b.TTL:
+			cmp = 1
+		}
+	}
+	if cmp == 0 {
+		cmp = strings.Compare(a.Name, b.Name)
+	}
+
+	if q.Desc {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+// Returns: the keys of the entities which can pass the filters, looked up
+// in the owner, the env hosts or the state indexes, the rest of the filters
+// is left to Matches
+func (q *StatusQuery) candidates() []string {
+
+	keys := make([]string, 0)
+
+	switch {
+	case len(q.Owners) > 0:
+		for _, owner := range uniq(q.Owners) {
+			keys = append(keys, DB.EntitiesOfUser(owner)...)
+		}
+	case q.Env != "":
+		// the hosts exist while locked only
+		keys = append(keys, C_TYPE_ENV+":"+q.Env)
+		keys = append(keys, DB.GetHostsInEnv(q.Env)...)
+	default:
+		states := q.States
+		if len(states) == 0 {
+			states = entityStates
+		}
+		for _, state := range uniq(states) {
+			keys = append(keys, DB.EntitiesInState(state)...)
+		}
+	}
+
+	return keys
+}
+
+// Returns: the sorted list without duplicates
+func uniq(list []string) []string {
+
+	list = slices.Clone(list)
+	slices.Sort(list)
+
+	return slices.Compact(list)
+}
+
+// Wants: filters, sorting and paging
+//
+// Returns: the v2 overview of the entities, envs first, Total is the number
+// of them before paging
+func QueryStatus(q *StatusQuery) *StatusV2 {
+
+	now := time.Now()
+
+	r := &StatusV2{
+		Version: C_STATUS_VERSION,
+		Time:    now.UTC().Format(time.RFC3339),
+		Envs:    make([]EntityStatus, 0),
+		Hosts:   make([]EntityStatus, 0),
+	}
+	DB.FillStatus(r, q.candidates(), now)
+
+	entities := make([]EntityStatus, 0, len(r.Envs)+len(r.Hosts))
+	for _, e := range append(r.Envs, r.Hosts...) {
+		if q.Matches(e) {
+			entities = append(entities, e)
+		}
+	}
+	sort.SliceStable(entities, func(i, j int) bool { return q.less(entities[i], entities[j]) })
+
+	r.Total = len(entities)
+	entities = entities[min(q.Offset, len(entities)):]
+	if q.Limit > 0 && q.Limit < len(entities) {
+		entities = entities[:q.Limit]
+	}
+
+	r.Envs = make([]EntityStatus, 0)
+	r.Hosts = make([]EntityStatus, 0)
+	for _, e := range entities {
+		if e.Type == C_TYPE_ENV {
+			r.Envs = append(r.Envs, e)
+		} else {
+			r.Hosts = append(r.Hosts, e)
+		}
+	}
+
+	return r
+}
+
+// Wants: v2 overview
+//
+// Returns: the same in the original stats shape
+func StatsOf(st *StatusV2) *Stats {
+
+	r := new(Stats)
+
+	for _, e := range append(st.Envs, st.Hosts...) {
+		fillStatsEntry(r, e.Type, e.Name, map[string]string{
+			"state":   e.State,
+			"user":    e.Owner,
+			"lastday": e.LastDay,
+			"expire":  e.Expire,
+		})
+		fillReservationStats(r, e.Type, e.Name, e.Reservations)
+	}
+
+	return r
+}
@@ -0,0 +1,119 @@
+package x
+
+import (
+	"encoding/json"
+	"math"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestQueryStatusFilters(t *testing.T) {
+
+	forEachStore(t, func(t *testing.T) {
+		for _, env := range []string{"env1", "env2", "env3"} {
+			EnvCreate(env)
+		}
+		EnvMaintenance("env3")
+		for _, l := range []*LockData{
+			lockRequest(C_TYPE_HOST, "env1-host1", "user1"),
+			lockRequest(C_TYPE_HOST, "env1-host2", "user2"),
+			lockRequest(C_TYPE_HOST, "env2-host1", "user1"),
+		} {
+			if r, _ := DB.LockAcquire(l, time.Hour); r.IsError {
+				t.Fatal(l.Name, r.ErrorMessage)
+			}
+		}
+		if r := DB.ReserveAdd(&LockData{Type: C_TYPE_HOST, Name: "env1-host3", User: "user1", FirstDay: day(3), LastDay: day(4)}); r.IsError {
+			t.Fatal(r.ErrorMessage)
+		}
+
+		for query, want := range map[string][]string{
+			"":                                   {"env1", "env2", "env3", "env1-host1", "env1-host2", "env1-host3", "env2-host1"},
+			"owner=user1":                        {"env1-host1", "env2-host1"},
+			"owner=user1,user2,user1":            {"env1-host1", "env1-host2", "env2-host1"},
+			"owner=user9":                        {},
+			"env=env1":                           {"env1", "env1-host1", "env1-host2", "env1-host3"},
+			"env=env1&owner=user2":               {"env1-host2"},
+			"env=env9":                           {},
+			"state=maint":                        {"env3"},
+			"state=locked&type=host":             {"env1-host1", "env1-host2", "env2-host1"},
+			"owner=user1&state=valid":            {},
+			"env=env1&type=host&sort=-name":      {"env1-host3", "env1-host2", "env1-host1"},
+			"owner=user1,user2&limit=1&offset=1": {"env1-host2"},
+		} {
+			params, _ := url.ParseQuery(query)
+			q, msg := ParseStatusQuery(params)
+			if msg != "" {
+				t.Fatalf("%s: %s", query, msg)
+			}
+
+			got := make([]string, 0)
+			r := QueryStatus(q)
+			for _, e := range append(r.Envs, r.Hosts...) {
+				got = append(got, e.Name)
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("%s: %v, want %v", query, got, want)
+			}
+		}
+	})
+}
+
+func TestStatusByTTL(t *testing.T) {
+
+	entities := []EntityStatus{
+		{Name: "a", TTL: math.MaxInt64},
+		{Name: "b", TTL: 0},
+		{Name: "c", TTL: 60},
+		{Name: "d", TTL: 0},
+	}
+
+	for sort, want := range map[string]string{"ttl": "bdca", "-ttl": "acdb"} {
+		q, msg := ParseStatusQuery(url.Values{"sort": {sort}})
+		if msg != "" {
+			t.Fatal(msg)
+		}
+		sorted := slices.Clone(entities)
+		slices.SortStableFunc(sorted, func(a EntityStatus, b EntityStatus) int {
+			if q.less(a, b) {
+				return -1
+			}
+			if q.less(b, a) {
+				return 1
+			}
+			return 0
+		})
+		got := ""
+		for _, e := range sorted {
+			got += e.Name
+		}
+		if got != want {
+			t.Errorf("sort=%s: %s, want %s", sort, got, want)
+		}
+	}
+
+	// a lock in its last second still tells how long it has left
+	out, _ := json.Marshal(EntityStatus{Name: "env1", Type: C_TYPE_ENV, State: C_STATE_LOCKED})
+	var fields map[string]any
+	if err := json.Unmarshal(out, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, ok := fields["ttl"]; !ok || ttl != 0.0 {
+		t.Errorf("ttl of %s is %v, want 0", out, ttl)
+	}
+}
+
+// The legacy lists keep their format, the expiry is in /v2/status only.
+func TestStatsEntryWithoutExpiry(t *testing.T) {
+
+	r := new(Stats)
+	fillStatsEntry(r, C_TYPE_ENV, "env1", map[string]string{
+		"state": C_STATE_LOCKED, "user": "user1", "lastday": "20261102", "expire": "2026-11-02T16:30:00+01:00",
+	})
+
+	if want := []string{"env1 (👤user1   📅20261102)"}; !slices.Equal(r.LockedEnvs, want) {
+		t.Errorf("%q, want %q", r.LockedEnvs, want)
+	}
+}
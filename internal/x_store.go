@@ -0,0 +1,548 @@
+package x
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Store is the storage backend behind every lock, user and stats operation.
+//
+// Keys follow the Redis data model regardless of the backend in use:
+// `env:<name>` and `host:<name>` hashes for entities, the `user` hash for
+// user tokens and `ratelimit:<ip>` counters for the rate limiter.
+//
+// Sets kept up to date with the entities serve as indexes: `envhosts:<env>`
+// holds the locked hosts of an env, `bystate:<state>` and `byuser:<user>`
+// hold entity keys.
+//
+// Lock queues are `queue:<type>:<name>` lists of JSON encoded QueueEntry
+// items, the `queues` set holds the entity keys having a queue.
+//
+// Every lock has a lease in the `leases` hash with its owner and expiry,
+// which is kept after the lock's key has expired until the expiry gets
+// recorded. The history is kept in `history`, the maximum lock durations of
+// the envs in the `maxlock` hash.
+//
+// Outgoing webhooks are JSON encoded Webhook items in the `webhooks` hash by
+// name, their pending deliveries are Delivery items in the `deliveries`
+// hash by ID. The `reminded` hash holds the expiry and the window of the
+// last reminder sent per lock.
+//
+// Reservation calendars are `calendar:<type>:<name>` lists of JSON encoded
+// Reservation items ordered by their first day, the `calendars` set holds
+// the entity keys having reservations.
+type Store interface {
+	// Ping checks that the backend is reachable.
+	Ping() error
+	// Close releases the backend's resources.
+	Close() error
+
+	// GetSingle returns a single hash field or nil if it is missing.
+	GetSingle(key string, field string) any
+	// SetSingle sets a single hash field.
+	SetSingle(key string, field string, value any) bool
+	// GetAll returns every field of a hash, empty if it is missing.
+	GetAll(key string) map[string]string
+
+	// LockGetter reads an entity, usually key := 'entityType:entityName'.
+	LockGetter(key string) *LockData
+	// LockSetter writes a filled LockData as a non-expiring entity. Returns
+	// the entity as it was before, read in the same atomic operation.
+	LockSetter(c *LockData) (bool, *LockData)
+	// LockSetterIfAbsent is LockSetter for an entity which does not exist,
+	// checked in the same atomic operation. Returns `true` if written.
+	LockSetterIfAbsent(c *LockData) bool
+	// LockAcquire checks the owner, the reservations, the queue and the
+	// env/host hierarchy, then writes the lock with its expiry, adds hosts
+	// to the locked hosts of the parent env and pops the user from the head
+	// of the queue. All of it is one atomic operation. An expiry not in the
+	// future is refused without touching the store. Returns the entity as it
+	// was before too.
+	LockAcquire(c *LockData, expire time.Duration) (*RichErrorStatus, *LockData)
+	// LockExtend checks the owner, the reservations and the maximum lock
+	// duration of the env, then pushes the expiry of a lock forward,
+	// atomically. Returns the entity as it was before too.
+	LockExtend(c *LockData, expire time.Duration) (*RichErrorStatus, *LockData)
+	// LockRelease checks the owner, then unlocks the entity and removes
+	// hosts from the locked hosts of the parent env, atomically. Returns the
+	// entity as it was before too.
+	LockRelease(c *LockData) (*RichErrorStatus, *LockData)
+	// EntityDelete removes the `enName` field from the `enType` hash.
+	EntityDelete(enType string, enName string) bool
+
+	// GetHostsInEnv returns the keys of the locked hosts in envName.
+	GetHostsInEnv(envName string) []string
+	// EntitiesInState returns the sorted entity keys in the given state.
+	EntitiesInState(state string) []string
+	// EntitiesOfUser returns the sorted entity keys owned by the user.
+	EntitiesOfUser(user string) []string
+	// RebuildIndexes recreates the locked hosts of the envs and the state
+	// and user indexes from the entity keys.
+	RebuildIndexes() error
+	// ScanKeys returns the sorted keys with the given type prefix.
+	ScanKeys(matchPattern string) []string
+	// FillJsonStats collects the overview of all entities.
+	FillJsonStats(r *Stats)
+	// FillStatus collects the v2 overview of the entities with the given
+	// keys, the missing ones skipped, and of the reserved ones, see
+	// QueryStatus.
+	FillStatus(r *StatusV2, keys []string, now time.Time)
+
+	// QueueJoin puts the user at the end of the entity's queue, or updates
+	// its lastday if already queued, and returns its 1-based position.
+	QueueJoin(c *LockData) (int, error)
+	// QueueLeave removes the user from the entity's queue.
+	QueueLeave(c *LockData) (bool, error)
+	// QueueList returns the queue of an entity, head first.
+	QueueList(enType string, enName string) []QueueEntry
+	// QueuedEntities returns the sorted entity keys having a queue.
+	QueuedEntities() []string
+
+	// ReserveAdd books the entity from c.FirstDay to c.LastDay unless it
+	// overlaps with other reservations or the current lock, atomically.
+	ReserveAdd(c *LockData) *RichErrorStatus
+	// ReserveCancel removes the user's reservation starting on c.FirstDay,
+	// admin can remove anybody's.
+	ReserveCancel(c *LockData) (bool, error)
+	// ReserveList returns the reservations of an entity, earliest first.
+	ReserveList(enType string, enName string) []Reservation
+	// ReservedEntities returns the sorted entity keys having reservations.
+	ReservedEntities() []string
+
+	// LeasesExpired removes and returns the leases expired by `now`,
+	// earliest first.
+	LeasesExpired(now time.Time) []Lease
+	// LeaseTake removes and returns the lease of a key if it's expired by
+	// `now`, a new lock of the key keeps its own.
+	LeaseTake(key string, now time.Time) (Lease, bool)
+	// WatchExpired returns the env and host keys as the store expires them,
+	// until `stop` is closed. An error means the store cannot tell.
+	WatchExpired(stop <-chan struct{}) (<-chan string, error)
+	// HistoryAdd appends an event to the history, setting its ID.
+	HistoryAdd(e *Event) error
+	// HistoryList returns the events from `since` on, oldest first.
+	HistoryList(since time.Time) []Event
+	// HistoryPrune drops the events older than `before`, returns how many.
+	HistoryPrune(before time.Time) (int64, error)
+
+	// RateIncr increments a rate limit counter, which lives for `window`.
+	RateIncr(key string, window time.Duration) (int64, error)
+}
+
+var (
+	DB Store // global storage backend
+
+)
+
+// Wants: configuration with the backend (C_STORE_REDIS, C_STORE_MEMORY or
+// C_STORE_BOLT) and its settings
+//
+// Returns: a new, not yet checked Store
+func NewStore(c *Config) (Store, error) {
+
+	switch c.Store {
+	case C_STORE_REDIS:
+		return NewRedisStore(c.RedisAddr, c.RedisPassword, c.RedisDB), nil
+	case C_STORE_MEMORY:
+		return NewMemStore(), nil
+	case C_STORE_BOLT:
+		return NewBoltStore(c.BoltPath)
+	default:
+		return nil, fmt.Errorf("unknown store backend '%s'", c.Store)
+	}
+}
+
+// Results of the lock operations, shared by the Lua scripts in x_redis.go
+const (
+	acqOK              string = "ok"
+	acqParentNil       string = "parentnil"
+	acqParentLocked    string = "parentlocked"
+	acqLockedByAnother string = "owner"
+	acqLockedHosts     string = "lockedhosts"
+	acqNotLocked       string = "notlocked"
+	acqExpired         string = "expired"
+	acqQueued          string = "queued"
+	acqUnavailable     string = "unavailable"
+	acqBooked          string = "booked"
+	acqTooLong         string = "toolong"
+	acqNotLater        string = "notlater"
+	acqExists          string = "exists" // see LockSetterIfAbsent
+	acqRetry           string = "retry"  // changed since its keys were read, see RedisStore
+)
+
+// Wants: the lock request, current owner of the entity, state of the parent
+// env for hosts (envExists `false` if it's missing), number of locked hosts
+// in the env for envs, user at the head of the entity's queue, the
+// reservations of the entity, `true` if the lock would be longer than the
+// maximum of the env
+//
+// Returns: one of the acq* results, the local backends decide with it
+func lockDecision(c *LockData, owner string, envState string, envExists bool, lockedHosts int, queueHead string, calendar []Reservation, tooLong bool) string {
+
+	if c.Type == C_TYPE_HOST {
+		if !envExists { // parent env not defined
+			return acqParentNil
+		}
+		if envState == C_STATE_LOCKED { // parent env has been locked
+			return acqParentLocked
+		}
+	}
+
+	// the env, or the parent env of a host, is taken away by the admin
+	if c.User != C_ADMIN && (envState == C_STATE_MAINTENANCE || envState == C_STATE_TERMINATED) {
+		return acqUnavailable
+	}
+
+	// normal users can modify only their own records
+	if c.User != C_ADMIN && len(owner) > 0 && c.User != owner {
+		return acqLockedByAnother
+	}
+
+	booked, bookedNow := calendarConflict(c, Today(), c.LastDay, calendar)
+	if c.User != C_ADMIN && booked {
+		return acqBooked
+	}
+
+	// a free entity goes to the head of its queue first, unless it's booked
+	// for the user today
+	if c.User != C_ADMIN && len(owner) == 0 && len(queueHead) > 0 && c.User != queueHead && !bookedNow {
+		return acqQueued
+	}
+
+	if c.User != C_ADMIN && tooLong {
+		return acqTooLong
+	}
+
+	if c.Type == C_TYPE_ENV && lockedHosts > 0 {
+		return acqLockedHosts
+	}
+
+	return acqOK
+}
+
+// Wants: the extend request, current state and owner of the entity, `true`
+// if the new expiry is not later than the current one, the reservations of
+// the entity, `true` if the lock would be longer than the maximum of the env
+//
+// Returns: one of the acq* results, the local backends decide with it
+func extendDecision(c *LockData, state string, owner string, notLater bool, calendar []Reservation, tooLong bool) string {
+
+	if state != C_STATE_LOCKED {
+		return acqNotLocked
+	}
+
+	// normal users can extend only their own locks
+	if c.User != C_ADMIN && c.User != owner {
+		return acqLockedByAnother
+	}
+
+	if notLater {
+		return acqNotLater
+	}
+
+	// the lock stays with the owner, so are the bookings of others checked
+	ownerLock := &LockData{User: owner}
+	if booked, _ := calendarConflict(ownerLock, Today(), c.LastDay, calendar); c.User != C_ADMIN && booked {
+		return acqBooked
+	}
+
+	if c.User != C_ADMIN && tooLong {
+		return acqTooLong
+	}
+
+	return acqOK
+}
+
+// Wants: start of the lock and its expiry as unix seconds, maximum lock
+// duration in seconds as stored in the env, "" or 0 for no limit
+//
+// Returns: `true` if the lock would be longer than the maximum
+func overMaxLock(since int64, expireAt int64, maxLock string) bool {
+
+	max, err := strconv.ParseInt(maxLock, 10, 64)
+	if err != nil || max <= 0 {
+		return false
+	}
+
+	return expireAt-since > max
+}
+
+// Wants: the reservation request, current state, owner and lastday of the
+// entity, `false` for hosts without parent env, the reservations of the
+// entity
+//
+// Returns: one of the acq* results, the local backends decide with it
+func reserveDecision(c *LockData, state string, owner string, lastDay string, envExists bool, calendar []Reservation) string {
+
+	if c.Type == C_TYPE_HOST && !envExists { // parent env not defined
+		return acqParentNil
+	}
+
+	// the current lock of somebody else runs into the booked days
+	if state == C_STATE_LOCKED && len(owner) > 0 && owner != c.User && lastDay >= c.FirstDay {
+		return acqBooked
+	}
+
+	for _, r := range calendar {
+		if r.FirstDay <= c.LastDay && r.LastDay >= c.FirstDay {
+			return acqBooked
+		}
+	}
+
+	return acqOK
+}
+
+// Wants: the request, days from `firstDay` to `lastDay` it wants, the
+// reservations of the entity
+//
+// Returns: `true` if another user booked any of those days, `true` if the
+// requesting user has a reservation covering `firstDay`
+func calendarConflict(c *LockData, firstDay string, lastDay string, calendar []Reservation) (bool, bool) {
+
+	booked, bookedNow := false, false
+
+	for _, r := range calendar {
+		if r.FirstDay > lastDay || r.LastDay < firstDay {
+			continue
+		}
+		if r.User != c.User {
+			booked = true
+		} else if r.FirstDay <= firstDay {
+			bookedNow = true
+		}
+	}
+
+	return booked, bookedNow
+}
+
+// Wants: the unlock request, current state and owner of the entity
+//
+// Returns: one of the acq* results, the local backends decide with it
+func releaseDecision(c *LockData, state string, owner string) string {
+
+	if state != C_STATE_LOCKED {
+		return acqNotLocked
+	}
+
+	// normal users can modify only their own records
+	if c.User != C_ADMIN && len(owner) > 0 && c.User != owner {
+		return acqLockedByAnother
+	}
+
+	return acqOK
+}
+
+// Wants: one of the acq* results or "" on storage error, error message
+// for the latter
+//
+// Returns: Specific RichErrorStatus
+func acqStatus(result string, failMessage string) *RichErrorStatus {
+
+	r := new(RichErrorStatus)
+
+	switch result {
+	case acqOK:
+		r.IsError = false
+		r.HttpErrCode = http.StatusOK
+	case acqParentNil:
+		r.IsError = true
+		r.HttpErrCode = http.StatusForbidden
+		r.ErrorMessage = ERR_ParentEnvNil
+	case acqParentLocked:
+		r.IsError = true
+		r.HttpErrCode = http.StatusForbidden
+		r.ErrorMessage = ERR_ParentEnvLockFail
+	case acqLockedByAnother:
+		r.IsError = true
+		r.HttpErrCode = http.StatusForbidden
+		r.ErrorMessage = ERR_LockedByAnotherUser
+	case acqExpired:
+		r.IsError = true
+		r.HttpErrCode = http.StatusBadRequest
+		r.ErrorMessage = ERR_InvalidDateSpecified
+	case acqUnavailable:
+		r.IsError = true
+		r.HttpErrCode = http.StatusForbidden
+		r.ErrorMessage = ERR_EnvUnavailable
+	case acqLockedHosts:
+		r.IsError = true
+		r.HttpErrCode = http.StatusForbidden
+		r.ErrorMessage = ERR_LockedHostsInEnv
+	case acqQueued:
+		r.IsError = true
+		r.HttpErrCode = http.StatusForbidden
+		r.ErrorMessage = ERR_ReservedForQueue
+	case acqBooked:
+		r.IsError = true
+		r.HttpErrCode = http.StatusConflict
+		r.ErrorMessage = ERR_BookedByAnotherUser
+	case acqTooLong:
+		r.IsError = true
+		r.HttpErrCode = http.StatusForbidden
+		r.ErrorMessage = ERR_LockTooLong
+	case acqNotLater:
+		r.IsError = true
+		r.HttpErrCode = http.StatusBadRequest
+		r.ErrorMessage = ERR_ExtendNotLater
+	case acqNotLocked:
+		r.IsError = true
+		r.HttpErrCode = http.StatusConflict
+		r.ErrorMessage = ERR_EntityNotLocked
+	default:
+		r.IsError = true
+		r.HttpErrCode = http.StatusInternalServerError
+		r.ErrorMessage = failMessage
+	}
+
+	return r
+}
+
+// Wants: `type:name` entity key
+//
+// Returns: entity type and name
+func splitKey(key string) (string, string) {
+
+	enType, enName, _ := strings.Cut(key, ":")
+	return enType, enName
+}
+
+// Wants: entity type and name
+//
+// Returns: name of the env the entity belongs to, the env itself for envs
+func envOf(enType string, enName string) string {
+
+	if enType == C_TYPE_HOST {
+		return GetEnvFromHost(enName)
+	}
+
+	return enName
+}
+
+// Wants: entity key and its state, owner and expire fields
+//
+// Returns: the JSON encoded lease of a lock, `false` for other entities
+func leaseOf(key string, state string, user string, expire string) (string, bool) {
+
+	t, err := time.Parse(time.RFC3339, expire)
+	if state != C_STATE_LOCKED || err != nil {
+		return "", false
+	}
+
+	l, err := json.Marshal(Lease{Key: key, User: user, Expire: expire, ExpireAt: t.Unix()})
+	if err != nil {
+		return "", false
+	}
+
+	return string(l), true
+}
+
+// Shared by the backends, fills one entity into the stats.
+func fillStatsEntry(r *Stats, enType string, enName string, fields map[string]string) {
+
+	state := fields["state"]
+	lockingUser := fields["user"]
+	lastDay := fields["lastday"]
+
+	switch {
+	case enType == C_TYPE_ENV && state == C_STATE_VALID:
+		r.ValidEnvs = append(r.ValidEnvs, enName)
+	case enType == C_TYPE_ENV && state == C_STATE_LOCKED:
+		if len(lockingUser) > 0 {
+			h := enName + " (👤" + lockingUser + "   📅" + lastDay + ")"
+			r.LockedEnvs = append(r.LockedEnvs, h)
+		}
+	case enType == C_TYPE_ENV && state == C_STATE_MAINTENANCE:
+		r.MaintEnvs = append(r.MaintEnvs, enName)
+	case enType == C_TYPE_ENV && state == C_STATE_TERMINATED:
+		r.TermdEnvs = append(r.TermdEnvs, enName)
+	case enType == C_TYPE_HOST && state == C_STATE_LOCKED:
+		h := enName + " (👤" + lockingUser + "   📅" + lastDay + ")"
+		r.LockedHosts = append(r.LockedHosts, h)
+	}
+}
+
+// Shared by the backends, fills one entity into the v2 status.
+func fillStatusEntry(r *StatusV2, enType string, enName string, fields map[string]string, now time.Time) {
+
+	e := newEntityStatus(enType, enName, fields, now)
+
+	if enType == C_TYPE_ENV {
+		r.Envs = append(r.Envs, e)
+	} else {
+		r.Hosts = append(r.Hosts, e)
+	}
+}
+
+// Wants: entity type and name, its hash fields, current time
+//
+// Returns: the entity as in the v2 status
+func newEntityStatus(enType string, enName string, fields map[string]string, now time.Time) EntityStatus {
+
+	e := EntityStatus{
+		Name:  enName,
+		Type:  enType,
+		State: fields["state"],
+	}
+
+	// envs have no parent, only a placeholder
+	if enType == C_TYPE_HOST {
+		e.Parent = fields[C_PARENT]
+	}
+
+	if e.State == C_STATE_LOCKED {
+		e.Owner = fields["user"]
+		e.LastDay = fields["lastday"]
+		e.Expire = fields["expire"]
+
+		// locks made before the exact expiry was stored only have lastday
+		expire, err := time.Parse(time.RFC3339, e.Expire)
+		if err != nil {
+			expire, _ = ParseExpiry(e.LastDay, "", DefaultTZ)
+		}
+		e.TTL = max(int64(expire.Sub(now).Seconds()), 0)
+	}
+
+	return e
+}
+
+// Shared by the backends, adds the reservations of one entity to the v2
+// status, a free host gets its own entry.
+func fillStatusReservations(r *StatusV2, enType string, enName string, calendar []Reservation) {
+
+	list := &r.Hosts
+	if enType == C_TYPE_ENV {
+		list = &r.Envs
+	}
+
+	for i := range *list {
+		if (*list)[i].Name == enName {
+			(*list)[i].Reservations = calendar
+			return
+		}
+	}
+
+	*list = append(*list, EntityStatus{
+		Name:         enName,
+		Type:         enType,
+		State:        C_STATE_VALID,
+		Parent:       envOf(enType, enName),
+		Reservations: calendar,
+	})
+}
+
+// Shared by the backends, fills the reservations of one entity into the stats.
+func fillReservationStats(r *Stats, enType string, enName string, calendar []Reservation) {
+
+	for _, b := range calendar {
+		h := enName + " (👤" + b.User + "   📅" + b.FirstDay + " - " + b.LastDay + ")"
+		if enType == C_TYPE_ENV {
+			r.ReservedEnvs = append(r.ReservedEnvs, h)
+		} else {
+			r.ReservedHosts = append(r.ReservedHosts, h)
+		}
+	}
+}
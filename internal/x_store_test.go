@@ -0,0 +1,398 @@
+package x
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// useMemStore makes a new memory store the DB of the test.
+func useMemStore(t *testing.T) *LocalStore {
+
+	t.Helper()
+
+	s := NewMemStore()
+	useStore(t, s)
+
+	return s
+}
+
+// useRedisStore makes the Redis database at NODELOCKER_TEST_REDIS the DB of
+// the test, flushed before and after, the test is skipped without it.
+func useRedisStore(t *testing.T) *RedisStore {
+
+	t.Helper()
+
+	addr := os.Getenv("NODELOCKER_TEST_REDIS")
+	if addr == "" {
+		t.Skip("NODELOCKER_TEST_REDIS is not set")
+	}
+
+	s := NewRedisStore(addr, "", 0)
+	if err := s.Ping(); err != nil {
+		t.Skipf("Redis at %s is not available: %s", addr, err)
+	}
+	if err := s.Conn.FlushDB().Err(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Conn.FlushDB() })
+	useStore(t, s)
+
+	return s
+}
+
+// forEachStore runs the test against a new memory store, bolt store and
+// Redis database, if available, as DB.
+func forEachStore(t *testing.T, test func(t *testing.T)) {
+
+	t.Run(C_STORE_MEMORY, func(t *testing.T) {
+		useMemStore(t)
+		test(t)
+	})
+	t.Run(C_STORE_BOLT, func(t *testing.T) {
+		s, err := NewBoltStore(filepath.Join(t.TempDir(), "nodelocker.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		useStore(t, s)
+		test(t)
+	})
+	t.Run(C_STORE_REDIS, func(t *testing.T) {
+		useRedisStore(t)
+		test(t)
+	})
+}
+
+func useStore(t *testing.T, s Store) {
+
+	t.Helper()
+
+	prev := DB
+	DB = s
+	t.Cleanup(func() {
+		DB = prev
+		s.Close()
+	})
+}
+
+// lockRequest is a lock of the entity by the user for an hour.
+func lockRequest(enType string, enName string, user string) *LockData {
+
+	c := &LockData{Type: enType, Name: enName, User: user, State: C_STATE_LOCKED}
+	if enType == C_TYPE_HOST {
+		c.Parent = GetEnvFromHost(enName)
+	}
+	SetExpiry(c, time.Now().Add(time.Hour).Truncate(time.Second))
+
+	return c
+}
+
+func TestLockAcquireRefusesPastExpiry(t *testing.T) {
+
+	useMemStore(t)
+	EnvCreate("env1")
+
+	for _, expire := range []time.Duration{0, -time.Hour} {
+		r, _ := DB.LockAcquire(lockRequest(C_TYPE_ENV, "env1", "user1"), expire)
+		if !r.IsError || r.HttpErrCode != 400 || r.ErrorMessage != ERR_InvalidDateSpecified {
+			t.Errorf("expire %s: got %+v, want ERR_InvalidDateSpecified", expire, r)
+		}
+	}
+
+	if l := DB.LockGetter(C_TYPE_ENV + ":env1"); l.State != C_STATE_VALID {
+		t.Errorf("env1 is %+v, want it untouched", l)
+	}
+}
+
+// addUser registers the user with the token, hashed at the lowest cost.
+func addUser(t *testing.T, name string, token string) {
+
+	t.Helper()
+
+	prev := BcryptCost
+	BcryptCost = bcrypt.MinCost
+	defer func() { BcryptCost = prev }()
+
+	hash, err := HashPassword(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	DB.SetSingle("user", name, hash)
+}
+
+// day is the YYYYMMDD date `days` from today.
+func day(days int) string {
+
+	return time.Now().In(DefaultTZ).AddDate(0, 0, days).Format("20060102")
+}
+
+func TestLockDecision(t *testing.T) {
+
+	host := &LockData{Type: C_TYPE_HOST, Name: "env1-host1", User: "user1", LastDay: day(1)}
+	env := &LockData{Type: C_TYPE_ENV, Name: "env1", User: "user1", LastDay: day(1)}
+	admin := &LockData{Type: C_TYPE_HOST, Name: "env1-host1", User: C_ADMIN, LastDay: day(1)}
+	booked := []Reservation{{User: "user2", FirstDay: day(0), LastDay: day(2)}}
+	mine := []Reservation{{User: "user1", FirstDay: day(0), LastDay: day(2)}}
+
+	for _, tc := range []struct {
+		name        string
+		c           *LockData
+		owner       string
+		envState    string
+		envExists   bool
+		lockedHosts int
+		queueHead   string
+		calendar    []Reservation
+		tooLong     bool
+		want        string
+	}{
+		{"free host", host, "", C_STATE_VALID, true, 0, "", nil, false, acqOK},
+		{"own host", host, "user1", C_STATE_VALID, true, 0, "", nil, false, acqOK},
+		{"no env", host, "", "", false, 0, "", nil, false, acqParentNil},
+		{"env locked", host, "", C_STATE_LOCKED, true, 0, "", nil, false, acqParentLocked},
+		{"another owner", host, "user2", C_STATE_VALID, true, 0, "", nil, false, acqLockedByAnother},
+		{"admin over another owner", admin, "user2", C_STATE_VALID, true, 0, "", nil, false, acqOK},
+		{"booked", host, "", C_STATE_VALID, true, 0, "", booked, false, acqBooked},
+		{"admin over booked", admin, "", C_STATE_VALID, true, 0, "", booked, false, acqOK},
+		{"queue head", host, "", C_STATE_VALID, true, 0, "user1", nil, false, acqOK},
+		{"queued for another", host, "", C_STATE_VALID, true, 0, "user2", nil, false, acqQueued},
+		{"booked for the user", host, "", C_STATE_VALID, true, 0, "user2", mine, false, acqOK},
+		{"too long", host, "", C_STATE_VALID, true, 0, "", nil, true, acqTooLong},
+		{"admin too long", admin, "", C_STATE_VALID, true, 0, "", nil, true, acqOK},
+		{"free env", env, "", "", false, 0, "", nil, false, acqOK},
+		{"env with locked hosts", env, "", "", false, 2, "", nil, false, acqLockedHosts},
+		{"env in maintenance", env, "", C_STATE_MAINTENANCE, true, 0, "", nil, false, acqUnavailable},
+		{"terminated env", env, C_ADMIN, C_STATE_TERMINATED, true, 0, "", nil, false, acqUnavailable},
+		{"host in maintenance", host, "", C_STATE_MAINTENANCE, true, 0, "", nil, false, acqUnavailable},
+		{"admin in maintenance", admin, "", C_STATE_MAINTENANCE, true, 0, "", nil, false, acqOK},
+	} {
+		got := lockDecision(tc.c, tc.owner, tc.envState, tc.envExists, tc.lockedHosts, tc.queueHead, tc.calendar, tc.tooLong)
+		if got != tc.want {
+			t.Errorf("%s: %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestExtendDecision(t *testing.T) {
+
+	user := &LockData{User: "user1", LastDay: day(3)}
+	admin := &LockData{User: C_ADMIN, LastDay: day(3)}
+	booked := []Reservation{{User: "user2", FirstDay: day(2), LastDay: day(4)}}
+	mine := []Reservation{{User: "user1", FirstDay: day(2), LastDay: day(4)}}
+
+	for _, tc := range []struct {
+		name     string
+		c        *LockData
+		state    string
+		owner    string
+		notLater bool
+		calendar []Reservation
+		tooLong  bool
+		want     string
+	}{
+		{"own lock", user, C_STATE_LOCKED, "user1", false, nil, false, acqOK},
+		{"not locked", user, C_STATE_VALID, "", false, nil, false, acqNotLocked},
+		{"another owner", user, C_STATE_LOCKED, "user2", false, nil, false, acqLockedByAnother},
+		{"admin over another owner", admin, C_STATE_LOCKED, "user2", false, nil, false, acqOK},
+		{"not later", user, C_STATE_LOCKED, "user1", true, nil, false, acqNotLater},
+		{"admin not later", admin, C_STATE_LOCKED, "user2", true, nil, false, acqNotLater},
+		{"booked", user, C_STATE_LOCKED, "user1", false, booked, false, acqBooked},
+		{"own booking", user, C_STATE_LOCKED, "user1", false, mine, false, acqOK},
+		{"admin over booked", admin, C_STATE_LOCKED, "user1", false, booked, false, acqOK},
+		{"too long", user, C_STATE_LOCKED, "user1", false, nil, true, acqTooLong},
+		{"admin too long", admin, C_STATE_LOCKED, "user1", false, nil, true, acqOK},
+	} {
+		got := extendDecision(tc.c, tc.state, tc.owner, tc.notLater, tc.calendar, tc.tooLong)
+		if got != tc.want {
+			t.Errorf("%s: %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestReserveDecision(t *testing.T) {
+
+	host := &LockData{Type: C_TYPE_HOST, User: "user1", FirstDay: day(5), LastDay: day(7)}
+	env := &LockData{Type: C_TYPE_ENV, User: "user1", FirstDay: day(5), LastDay: day(7)}
+
+	for _, tc := range []struct {
+		name      string
+		c         *LockData
+		state     string
+		owner     string
+		lastDay   string
+		envExists bool
+		calendar  []Reservation
+		want      string
+	}{
+		{"free host", host, "", "", "", true, nil, acqOK},
+		{"no env", host, "", "", "", false, nil, acqParentNil},
+		{"env without parent", env, "", "", "", false, nil, acqOK},
+		{"locked before", host, C_STATE_LOCKED, "user2", day(4), true, nil, acqOK},
+		{"locked into the days", host, C_STATE_LOCKED, "user2", day(5), true, nil, acqBooked},
+		{"own lock into the days", host, C_STATE_LOCKED, "user1", day(6), true, nil, acqOK},
+		{"booked before", host, "", "", "", true, []Reservation{{User: "user2", FirstDay: day(1), LastDay: day(4)}}, acqOK},
+		{"booked after", host, "", "", "", true, []Reservation{{User: "user2", FirstDay: day(8), LastDay: day(9)}}, acqOK},
+		{"overlapping", host, "", "", "", true, []Reservation{{User: "user2", FirstDay: day(7), LastDay: day(9)}}, acqBooked},
+		{"overlapping own", host, "", "", "", true, []Reservation{{User: "user1", FirstDay: day(3), LastDay: day(5)}}, acqBooked},
+	} {
+		got := reserveDecision(tc.c, tc.state, tc.owner, tc.lastDay, tc.envExists, tc.calendar)
+		if got != tc.want {
+			t.Errorf("%s: %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestReleaseDecision(t *testing.T) {
+
+	user := &LockData{User: "user1"}
+	admin := &LockData{User: C_ADMIN}
+
+	for _, tc := range []struct {
+		name  string
+		c     *LockData
+		state string
+		owner string
+		want  string
+	}{
+		{"own lock", user, C_STATE_LOCKED, "user1", acqOK},
+		{"not locked", user, C_STATE_VALID, "", acqNotLocked},
+		{"another owner", user, C_STATE_LOCKED, "user2", acqLockedByAnother},
+		{"admin over another owner", admin, C_STATE_LOCKED, "user2", acqOK},
+		{"admin not locked", admin, C_STATE_MAINTENANCE, "", acqNotLocked},
+	} {
+		if got := releaseDecision(tc.c, tc.state, tc.owner); got != tc.want {
+			t.Errorf("%s: %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+// The decisions as the stores apply them, the same on every backend.
+func TestStoreLockLifecycle(t *testing.T) {
+
+	forEachStore(t, func(t *testing.T) {
+		EnvCreate("env1")
+
+		user1 := lockRequest(C_TYPE_HOST, "env1-host1", "user1")
+		user2 := lockRequest(C_TYPE_HOST, "env1-host1", "user2")
+		env := lockRequest(C_TYPE_ENV, "env1", "user2")
+
+		steps := []struct {
+			name string
+			run  func() *RichErrorStatus
+			want string
+		}{
+			{"lock without env", func() *RichErrorStatus {
+				r, _ := DB.LockAcquire(lockRequest(C_TYPE_HOST, "env9-host1", "user1"), time.Hour)
+				return r
+			}, ERR_ParentEnvNil},
+			{"lock", func() *RichErrorStatus { r, _ := DB.LockAcquire(user1, time.Hour); return r }, ""},
+			{"lock of another", func() *RichErrorStatus { r, _ := DB.LockAcquire(user2, time.Hour); return r }, ERR_LockedByAnotherUser},
+			{"env with a locked host", func() *RichErrorStatus { r, _ := DB.LockAcquire(env, time.Hour); return r }, ERR_LockedHostsInEnv},
+			{"extend not later", func() *RichErrorStatus { r, _ := DB.LockExtend(user1, time.Minute); return r }, ERR_ExtendNotLater},
+			{"extend of another", func() *RichErrorStatus { r, _ := DB.LockExtend(user2, 2*time.Hour); return r }, ERR_LockedByAnotherUser},
+			{"extend", func() *RichErrorStatus { r, _ := DB.LockExtend(user1, 2*time.Hour); return r }, ""},
+			{"reserve into the lock", func() *RichErrorStatus {
+				return DB.ReserveAdd(&LockData{Type: C_TYPE_HOST, Name: "env1-host1", User: "user2", FirstDay: day(0), LastDay: day(1)})
+			}, ERR_BookedByAnotherUser},
+			{"reserve later", func() *RichErrorStatus {
+				return DB.ReserveAdd(&LockData{Type: C_TYPE_HOST, Name: "env1-host1", User: "user2", FirstDay: day(5), LastDay: day(6)})
+			}, ""},
+			{"unlock of another", func() *RichErrorStatus { r, _ := DB.LockRelease(user2); return r }, ERR_LockedByAnotherUser},
+			{"unlock", func() *RichErrorStatus { r, _ := DB.LockRelease(user1); return r }, ""},
+			{"unlock again", func() *RichErrorStatus { r, _ := DB.LockRelease(user1); return r }, ERR_EntityNotLocked},
+			{"env", func() *RichErrorStatus { r, _ := DB.LockAcquire(env, time.Hour); return r }, ""},
+			{"host in a locked env", func() *RichErrorStatus { r, _ := DB.LockAcquire(user1, time.Hour); return r }, ERR_ParentEnvLockFail},
+		}
+
+		for _, step := range steps {
+			r := step.run()
+			if got := map[bool]string{true: r.ErrorMessage}[r.IsError]; got != step.want {
+				t.Fatalf("%s: %q, want %q", step.name, got, step.want)
+			}
+			if step.name == "lock" {
+				if hosts := DB.GetHostsInEnv("env1"); !slices.Equal(hosts, []string{C_TYPE_HOST + ":env1-host1"}) {
+					t.Errorf("locked hosts of env1 are %v", hosts)
+				}
+			}
+		}
+	})
+}
+
+func TestStoreEntities(t *testing.T) {
+
+	forEachStore(t, func(t *testing.T) {
+		if l := DB.LockGetter(C_TYPE_ENV + ":env1"); l.HttpErr != http.StatusNoContent {
+			t.Errorf("missing env1 is %+v, want no content", l)
+		}
+
+		if written, _ := DB.LockSetter(&LockData{Type: C_TYPE_ENV, Name: "env1", State: C_STATE_VALID}); !written {
+			t.Fatal("cannot write env1")
+		}
+		if written, _ := DB.LockSetter(&LockData{Type: C_TYPE_HOST, Name: "env1-host1", Parent: "env1", State: C_STATE_LOCKED, User: "user1", LastDay: "20301231"}); !written {
+			t.Fatal("cannot write env1-host1")
+		}
+
+		if l := DB.LockGetter(C_TYPE_HOST + ":env1-host1"); l.HttpErr != http.StatusOK || l.State != C_STATE_LOCKED || l.User != "user1" || l.LastDay != "20301231" {
+			t.Errorf("env1-host1 is %+v", l)
+		}
+		if keys := DB.ScanKeys(C_TYPE_ENV); !slices.Equal(keys, []string{C_TYPE_ENV + ":env1"}) {
+			t.Errorf("envs are %v", keys)
+		}
+
+		if !DB.SetSingle("user", "user1", "token") || DB.GetSingle("user", "user1") != "token" {
+			t.Error("user1 not stored")
+		}
+		if !DB.EntityDelete("user", "user1") || DB.GetSingle("user", "user1") != nil {
+			t.Error("user1 not deleted")
+		}
+
+		for want := int64(1); want <= 2; want++ {
+			if n, err := DB.RateIncr("ratelimit:127.0.0.1", time.Minute); err != nil || n != want {
+				t.Errorf("rate counter %d (%v), want %d", n, err, want)
+			}
+		}
+	})
+}
+
+// The keys passed to a script are read beforehand, a change in between asks
+// for a retry instead of writing the wrong indexes.
+func TestRedisScriptsRetryOnChange(t *testing.T) {
+
+	s := useRedisStore(t)
+	EnvCreate("env1")
+
+	host := lockRequest(C_TYPE_HOST, "env1-host1", "user1")
+	if r, _ := DB.LockAcquire(host, time.Hour); r.IsError {
+		t.Fatal(r.ErrorMessage)
+	}
+
+	// read as free, locked since
+	_, _, indexes := s.reindexKeys(C_TYPE_HOST+":env1-host1", C_STATE_VALID, "")
+	reply, _ := lockSetterScript.Run(s.Conn, append([]string{C_TYPE_HOST + ":env1-host1", C_LEASES}, indexes...),
+		C_STATE_VALID, "", "", "", "0", "", "").Result()
+	if result, _ := scriptReply(reply); result != acqRetry {
+		t.Errorf("setter of a changed entity: %q, want %q", result, acqRetry)
+	}
+
+	// read without locked hosts, a host locked since
+	env := lockRequest(C_TYPE_ENV, "env1", "user2")
+	oldState, oldUser, indexes := s.reindexKeys(C_TYPE_ENV+":env1", C_STATE_LOCKED, "user2")
+	reply, _ = lockAcquireScript.Run(s.Conn, append(lockScriptKeys(C_TYPE_ENV, "env1"), indexes...),
+		C_TYPE_ENV, "user2", C_ADMIN, env.Parent, env.State, env.LastDay, time.Hour.Milliseconds(), "env1", Today(), env.Expire,
+		time.Now().Unix(), time.Now().Add(time.Hour).Unix(), "env1", oldState, oldUser).Result()
+	if result, _ := scriptReply(reply); result != acqRetry {
+		t.Errorf("env lock with other locked hosts: %q, want %q", result, acqRetry)
+	}
+
+	if r, _ := DB.LockAcquire(env, time.Hour); r.ErrorMessage != ERR_LockedHostsInEnv {
+		t.Errorf("env lock: %q, want %q", r.ErrorMessage, ERR_LockedHostsInEnv)
+	}
+	if keys := DB.EntitiesOfUser("user1"); len(keys) != 1 || keys[0] != C_TYPE_HOST+":env1-host1" {
+		t.Errorf("entities of user1 are %v, want host:env1-host1", keys)
+	}
+}
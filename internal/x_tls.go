@@ -10,117 +10,453 @@ import (
 	"encoding/pem"
 	"fmt"
 	"math/big"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 )
 
 const (
-	C_CERT_BASEPATH string = "/var/lib/nodelocker/certs/"
+	C_CERT_DIR     string        = "/var/lib/nodelocker/certs" // default of the cert-dir setting
+	C_CERT_FILE    string        = "certificate.pem"           // server certificate in the cert-dir
+	C_KEY_FILE     string        = "private-key.pem"           // its private key
+	C_CA_FILE      string        = "ca.pem"                    // the local CA issuing it
+	C_CA_KEY_FILE  string        = "ca-key.pem"                // the private key of the CA
+	C_CERT_VALID   time.Duration = 365 * 24 * time.Hour        // validity of a server certificate
+	C_CA_VALID     time.Duration = 10 * 365 * 24 * time.Hour   // validity of the local CA
+	C_CERT_RENEW   time.Duration = 30 * 24 * time.Hour         // a server certificate expiring sooner is replaced
+	C_CERT_POLL    time.Duration = 10 * time.Second            // the certificate files are checked for changes this often
+	C_RENEW_PERIOD time.Duration = time.Hour                   // the server certificate is checked for renewal this often
 )
 
-func generateCertificate() error {
-	// Ensure certificate directory exists
-	if err := os.MkdirAll(C_CERT_BASEPATH, 0700); err != nil {
-		return fmt.Errorf("failed to create certificate directory: %w", err)
+// Returns: the default SANs of the server certificate, the host name and
+// the loopback addresses
+func DefaultSANs() string {
+
+	sans := "localhost,127.0.0.1,::1"
+	if host, err := os.Hostname(); err == nil && host != "" && host != "localhost" {
+		sans = host + "," + sans
+	}
+
+	return sans
+}
+
+// Wants: comma separated DNS names and IP addresses
+//
+// Returns: the DNS names, the IP addresses
+func splitSANs(sans string) ([]string, []net.IP) {
+
+	names := make([]string, 0)
+	ips := make([]net.IP, 0)
+	for _, san := range SplitList(sans) {
+		if ip := net.ParseIP(san); ip != nil {
+			ips = append(ips, ip)
+		} else {
+			names = append(names, san)
+		}
+	}
+
+	return names, ips
+}
+
+// Returns: a random serial number of 128 bits
+func randomSerial() (*big.Int, error) {
+
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// Wants: file name, PEM block type, DER bytes, file mode
+func writePEM(name string, blockType string, der []byte, mode os.FileMode) error {
+
+	return os.WriteFile(name, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), mode)
+}
+
+// Wants: certificate file, key file
+//
+// Returns: the certificate with its parsed leaf
+func loadPair(certFile string, keyFile string) (*tls.Certificate, error) {
+
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if pair.Leaf, err = x509.ParseCertificate(pair.Certificate[0]); err != nil {
+		return nil, err
+	}
+
+	return &pair, nil
+}
+
+// Wants: directory of the certificates
+//
+// Returns: the local CA, created at the first call and kept since
+func loadOrCreateCA(certDir string) (*tls.Certificate, error) {
+
+	caFile := filepath.Join(certDir, C_CA_FILE)
+	caKeyFile := filepath.Join(certDir, C_CA_KEY_FILE)
+
+	if _, err := os.Stat(caFile); err == nil {
+		return loadPair(caFile, caKeyFile)
+	}
+
+	if err := os.MkdirAll(certDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create certificate directory: %w", err)
 	}
 
-	// Generate a private key
 	privateKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
 	}
 
-	// Create a certificate template
+	host, _ := os.Hostname()
 	template := x509.Certificate{
-		SerialNumber: big.NewInt(1),
+		SerialNumber: serial,
 		Subject: pkix.Name{
 			Organization: []string{"internal"},
+			CommonName:   "nodelocker CA " + host,
 		},
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().Add(365 * 24 * time.Hour), // Valid for 1 year
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(C_CA_VALID),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
 		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
 	}
 
-	// Create a self-signed certificate
 	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Save private key to a file
-	keyFile, err := os.Create(C_CERT_BASEPATH + "private-key.pem")
+	keyBytes, err := x509.MarshalECPrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// the key first, a CA without its key would be reused in vain
+	if err := writePEM(caKeyFile, "EC PRIVATE KEY", keyBytes, 0600); err != nil {
+		return nil, err
+	}
+	if err := writePEM(caFile, "CERTIFICATE", certDER, 0644); err != nil {
+		return nil, err
+	}
+
+	// not on the output, -export-ca prints the CA there
+	fmt.Fprintf(os.Stderr, "%s Local CA created in %s\n", C_SUCCESS, certDir)
+
+	return loadPair(caFile, caKeyFile)
+}
+
+// Wants: directory of the certificates, the local CA, SANs of the server
+//
+// Issues a new server certificate by the CA.
+func issueCertificate(certDir string, ca *tls.Certificate, sans string) error {
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		if err := keyFile.Close(); err != nil {
-			fmt.Printf("Error closing key file: %v\n", err)
-		}
-	}()
 
-	keyBytes, err := x509.MarshalECPrivateKey(privateKey)
+	serial, err := randomSerial()
 	if err != nil {
 		return err
 	}
 
-	err = pem.Encode(keyFile, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes})
+	names, ips := splitSANs(sans)
+	commonName := "nodelocker"
+	if len(names) > 0 {
+		commonName = names[0]
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"internal"},
+			CommonName:   commonName,
+		},
+		DNSNames:              names,
+		IPAddresses:           ips,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(C_CERT_VALID),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, ca.Leaf, &privateKey.PublicKey, ca.PrivateKey)
 	if err != nil {
 		return err
 	}
 
-	// Save certificate to a file
-	certFile, err := os.Create(C_CERT_BASEPATH + "certificate.pem")
+	keyBytes, err := x509.MarshalECPrivateKey(privateKey)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		if err := certFile.Close(); err != nil {
-			fmt.Printf("Error closing cert file: %v\n", err)
+
+	// the certificate is written after its key, the reloader waits for both
+	if err := writePEM(filepath.Join(certDir, C_KEY_FILE), "EC PRIVATE KEY", keyBytes, 0600); err != nil {
+		return err
+	}
+
+	return writePEM(filepath.Join(certDir, C_CERT_FILE), "CERTIFICATE", certDER, 0644)
+}
+
+// Wants: server certificate, the local CA, SANs of the server
+//
+// Returns: `true` if the certificate is issued by the CA for the SANs and
+// valid for C_CERT_RENEW at least
+func isCertificateCurrent(cert *tls.Certificate, ca *tls.Certificate, sans string) bool {
+
+	leaf := cert.Leaf
+	if leaf.CheckSignatureFrom(ca.Leaf) != nil {
+		return false
+	}
+
+	now := time.Now()
+	if now.Before(leaf.NotBefore) || now.Add(C_CERT_RENEW).After(leaf.NotAfter) {
+		return false
+	}
+
+	have := make([]string, 0)
+	have = append(have, leaf.DNSNames...)
+	for _, ip := range leaf.IPAddresses {
+		have = append(have, ip.String())
+	}
+
+	want := make([]string, 0)
+	names, ips := splitSANs(sans)
+	want = append(want, names...)
+	for _, ip := range ips {
+		want = append(want, ip.String())
+	}
+
+	slices.Sort(have)
+	slices.Sort(want)
+
+	return slices.Equal(have, want)
+}
+
+// Wants: directory of the certificates, SANs of the server
+//
+// Returns: `true` if a new server certificate got issued by the local CA,
+// the current one is kept while valid for the SANs
+func ensureCertificate(certDir string, sans string) (bool, error) {
+
+	ca, err := loadOrCreateCA(certDir)
+	if err != nil {
+		return false, fmt.Errorf("local CA: %w", err)
+	}
+
+	cert, err := loadPair(filepath.Join(certDir, C_CERT_FILE), filepath.Join(certDir, C_KEY_FILE))
+	if err == nil && isCertificateCurrent(cert, ca, sans) {
+		return false, nil
+	}
+
+	return true, issueCertificate(certDir, ca, sans)
+}
+
+// Wants: configuration with the cert-dir
+//
+// Returns: the PEM certificate of the local CA, created if missing, for the
+// clients to trust
+func ExportCA(c *Config) ([]byte, error) {
+
+	if _, err := loadOrCreateCA(c.CertDir); err != nil {
+		return nil, err
+	}
+
+	return os.ReadFile(filepath.Join(c.CertDir, C_CA_FILE))
+}
+
+// Wants: configuration
+//
+// Returns: the PEM certificate of the local CA, `false` if it's not in use
+func ReadCA(c *Config) ([]byte, bool) {
+
+	if !c.TLS || c.TLSCert != "" {
+		return nil, false
+	}
+
+	ca, err := os.ReadFile(filepath.Join(c.CertDir, C_CA_FILE))
+
+	return ca, err == nil
+}
+
+// Wants: handler, configuration with the address and the timeouts
+//
+// Returns: the server, not yet started
+func NewServer(h http.Handler, c *Config) *http.Server {
+
+	return &http.Server{
+		Addr:         c.Listen,
+		Handler:      h,
+		ReadTimeout:  c.ReadTimeout,
+		WriteTimeout: c.WriteTimeout,
+	}
+}
+
+// certReloader serves the current certificate, reloaded from its files on
+// SIGHUP or when they change.
+type certReloader struct {
+	certFile  string
+	keyFile   string
+	chainFile string               // optional, appended to the certificate
+	renew     func() (bool, error) // optional, renews the certificate files
+	cert      atomic.Pointer[tls.Certificate]
+	stamp     string // sizes and modification times of the files loaded
+}
+
+// Returns: the sizes and modification times of the files, changes when a
+// file gets replaced
+func (cr *certReloader) fileStamp() string {
+
+	stamp := ""
+	for _, name := range []string{cr.certFile, cr.keyFile, cr.chainFile} {
+		if name == "" {
+			continue
 		}
-	}()
+		if fi, err := os.Stat(name); err == nil {
+			stamp += fmt.Sprintf("%d:%d;", fi.Size(), fi.ModTime().UnixNano())
+		}
+	}
+
+	return stamp
+}
 
-	err = pem.Encode(certFile, &pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+// Loads the certificate, the served one stays on error, till the files
+// change again.
+func (cr *certReloader) load() error {
+
+	cr.stamp = cr.fileStamp()
+
+	pair, err := loadPair(cr.certFile, cr.keyFile)
 	if err != nil {
 		return err
 	}
 
+	if cr.chainFile != "" {
+		chain, err := os.ReadFile(cr.chainFile)
+		if err != nil {
+			return err
+		}
+		for block, rest := pem.Decode(chain); block != nil; block, rest = pem.Decode(rest) {
+			if block.Type == "CERTIFICATE" {
+				pair.Certificate = append(pair.Certificate, block.Bytes)
+			}
+		}
+	}
+
+	cr.cert.Store(pair)
+
 	return nil
 }
 
-func ServeTLS(r *chi.Mux) {
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
 
-	err := generateCertificate()
-	if err != nil {
-		fmt.Printf("%s Error generating certificate: %s\n", C_FAILED, err)
-		return
-	} else {
-		fmt.Printf("%s Certificate and private key generated successfully.\n", C_SUCCESS)
+	return cr.cert.Load(), nil
+}
+
+// Wants: time between two checks of the files, channel closed to stop
+//
+// Reloads the certificate on SIGHUP or when its files change, the open
+// connections keep theirs.
+func (cr *certReloader) watch(interval time.Duration, stop <-chan struct{}) {
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	renewal := time.NewTicker(C_RENEW_PERIOD)
+	defer renewal.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-hup:
+		case <-ticker.C:
+			if cr.fileStamp() == cr.stamp {
+				continue
+			}
+		case <-renewal.C:
+			if cr.renew == nil {
+				continue
+			}
+			if renewed, err := cr.renew(); err != nil {
+				fmt.Printf("%s Cannot renew the certificate: %s\n", C_FAILED, err)
+				continue
+			} else if !renewed {
+				continue
+			}
+		}
+
+		if err := cr.load(); err != nil {
+			fmt.Printf("%s Cannot reload the certificate, keeping the old one: %s\n", C_FAILED, err)
+			continue
+		}
+		fmt.Printf("%s Certificate reloaded, valid until %s\n", C_SUCCESS, cr.cert.Load().Leaf.NotAfter.Format(time.RFC3339))
 	}
+}
 
-	// Load the private key and certificate
-	privateKey, err := os.ReadFile(C_CERT_BASEPATH + "private-key.pem")
-	if err != nil {
-		fmt.Println("Error reading private key:", err)
-		return
+// Wants: router, configuration, channel closed to stop reloading the
+// certificate, the runners waited for after the server stopped
+//
+// Returns: the HTTPS server with the configured certificate or the one of
+// the local CA, not yet started, see Serve
+func NewTLSServer(r *chi.Mux, c *Config, stop <-chan struct{}, runners *sync.WaitGroup) (*http.Server, error) {
+
+	cr := &certReloader{certFile: c.TLSCert, keyFile: c.TLSKey, chainFile: c.TLSChain}
+
+	// the certificate of the local CA is the fallback, kept while valid
+	if c.TLSCert == "" {
+		cr.certFile = filepath.Join(c.CertDir, C_CERT_FILE)
+		cr.keyFile = filepath.Join(c.CertDir, C_KEY_FILE)
+		cr.renew = func() (bool, error) { return ensureCertificate(c.CertDir, c.TLSSANs) }
+
+		if renewed, err := cr.renew(); err != nil {
+			return nil, fmt.Errorf("generating certificate: %w", err)
+		} else if renewed {
+			fmt.Printf("%s Certificate and private key generated successfully.\n", C_SUCCESS)
+		} else {
+			fmt.Printf("%s Reusing the certificate in %s\n", C_SUCCESS, c.CertDir)
+		}
 	}
 
-	cert, err := os.ReadFile(C_CERT_BASEPATH + "certificate.pem")
-	if err != nil {
-		fmt.Println("Error reading certificate:", err)
-		return
+	if err := cr.load(); err != nil {
+		return nil, fmt.Errorf("loading certificate: %w", err)
 	}
 
-	// Create a TLS certificate
-	tlsCert, err := tls.X509KeyPair(cert, privateKey)
+	// the client certificates, if enabled
+	tlsConfig, err := clientAuthConfig(c)
 	if err != nil {
-		fmt.Println("Error creating TLS certificate:", err)
-		return
+		return nil, fmt.Errorf("loading the client CA: %w", err)
+	} else if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
 	}
+	tlsConfig.GetCertificate = cr.GetCertificate
+
+	runners.Add(1)
+	go func() {
+		defer runners.Done()
+		cr.watch(C_CERT_POLL, stop)
+	}()
 
 	// Configure the Chi router
 	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
@@ -130,18 +466,8 @@ func ServeTLS(r *chi.Mux) {
 	})
 
 	// Create a server with TLS configuration
-	server := &http.Server{
-		Addr:         "0.0.0.0:3000",
-		Handler:      r,
-		TLSConfig:    &tls.Config{Certificates: []tls.Certificate{tlsCert}},
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 5 * time.Second,
-	}
+	server := NewServer(r, c)
+	server.TLSConfig = tlsConfig
 
-	// Start the server
-	fmt.Printf("%s Server is accepting connections on %s\n", C_STARTED, server.Addr)
-	err = server.ListenAndServeTLS("", "")
-	if err != nil {
-		fmt.Printf("%s Error starting server: %s\n", C_FAILED, err.Error())
-	}
+	return server, nil
 }
@@ -0,0 +1,196 @@
+package x
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// writeSelfSigned writes a new self-signed certificate of `cn` and its key.
+func writeSelfSigned(t *testing.T, certFile string, keyFile string, cn string) {
+
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writePEM(keyFile, "EC PRIVATE KEY", keyDER, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := writePEM(certFile, "CERTIFICATE", der, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// served is the leaf certificate the server at addr presents.
+func served(t *testing.T, addr string, roots *x509.CertPool) *x509.Certificate {
+
+	t.Helper()
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots, InsecureSkipVerify: roots == nil, ServerName: "localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	return conn.ConnectionState().PeerCertificates[0]
+}
+
+// serveTLS starts the server of NewTLSServer on a free port till the end of
+// the test.
+func serveTLS(t *testing.T, c *Config) string {
+
+	t.Helper()
+
+	stop := make(chan struct{})
+	var runners sync.WaitGroup
+	server, err := NewTLSServer(chi.NewRouter(), c, stop, &runners)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeTLS(ln, "", "")
+	t.Cleanup(func() {
+		close(stop)
+		server.Close()
+		runners.Wait() // the certificate watcher is gone too
+	})
+
+	return ln.Addr().String()
+}
+
+// eventually retries the check for a few seconds.
+func eventually(t *testing.T, what string, check func() bool) {
+
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); !check(); time.Sleep(20 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: timed out", what)
+		}
+	}
+}
+
+func TestCertReloaderFollowsFiles(t *testing.T) {
+
+	dir := t.TempDir()
+	cr := &certReloader{certFile: filepath.Join(dir, "cert.pem"), keyFile: filepath.Join(dir, "key.pem")}
+	writeSelfSigned(t, cr.certFile, cr.keyFile, "first")
+	if err := cr.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go cr.watch(10*time.Millisecond, stop)
+
+	cn := func() string {
+		cert, _ := cr.GetCertificate(nil)
+		return cert.Leaf.Subject.CommonName
+	}
+
+	writeSelfSigned(t, cr.certFile, cr.keyFile, "second")
+	future := time.Now().Add(time.Minute) // a new stamp even on coarse clocks
+	os.Chtimes(cr.certFile, future, future)
+	eventually(t, "swapped files", func() bool { return cn() == "second" })
+
+	// a broken certificate leaves the served one in place
+	os.WriteFile(cr.certFile, []byte("broken"), 0644)
+	time.Sleep(100 * time.Millisecond)
+	if got := cn(); got != "second" {
+		t.Errorf("served %q after a broken file, want second", got)
+	}
+}
+
+func TestTLSServerReloadsOnSIGHUP(t *testing.T) {
+
+	// SIGHUP would stop the test binary until the watcher catches it
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	dir := t.TempDir()
+	c := DefaultConfig()
+	c.TLSCert = filepath.Join(dir, "cert.pem")
+	c.TLSKey = filepath.Join(dir, "key.pem")
+	writeSelfSigned(t, c.TLSCert, c.TLSKey, "first")
+
+	addr := serveTLS(t, c)
+	if cn := served(t, addr, nil).Subject.CommonName; cn != "first" {
+		t.Fatalf("served %q, want first", cn)
+	}
+
+	// the files are polled every C_CERT_POLL, the signal reloads at once
+	writeSelfSigned(t, c.TLSCert, c.TLSKey, "second")
+	eventually(t, "SIGHUP", func() bool {
+		syscall.Kill(os.Getpid(), syscall.SIGHUP)
+		return served(t, addr, nil).Subject.CommonName == "second"
+	})
+}
+
+func TestTLSServerFallsBackToLocalCA(t *testing.T) {
+
+	c := DefaultConfig()
+	c.CertDir = t.TempDir()
+	c.TLSSANs = "localhost,127.0.0.1"
+
+	addr := serveTLS(t, c)
+
+	ca, ok := ReadCA(c)
+	if !ok {
+		t.Fatal("no local CA in use")
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(ca) {
+		t.Fatal("cannot parse the local CA")
+	}
+	leaf := served(t, addr, roots) // verified against the local CA
+	if leaf.Subject.CommonName != "localhost" {
+		t.Errorf("served %q, want localhost", leaf.Subject.CommonName)
+	}
+
+	// kept while valid for the SANs, issued again for new ones
+	if renewed, err := ensureCertificate(c.CertDir, c.TLSSANs); err != nil || renewed {
+		t.Errorf("same SANs: renewed %t, %v", renewed, err)
+	}
+	if renewed, err := ensureCertificate(c.CertDir, "nodelocker.example,localhost"); err != nil || !renewed {
+		t.Errorf("new SANs: renewed %t, %v", renewed, err)
+	}
+}
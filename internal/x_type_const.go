@@ -1,33 +1,137 @@
 package x
 
 type LockData struct {
-	Type    string `json:"type"`
-	Name    string `json:"name"`
-	Parent  string `json:"parent"`
-	State   string `json:"state"`
-	LastDay string `json:"lastday"`
-	User    string `json:"user"`
-	Token   string `json:"token"`
-	HttpErr int    `json:"httperr"`
+	Type     string `json:"type"`
+	Name     string `json:"name"`
+	Parent   string `json:"parent"`
+	State    string `json:"state"`
+	FirstDay string `json:"firstday"`
+	LastDay  string `json:"lastday"`
+	Expire   string `json:"expire"`
+	For      string `json:"for,omitempty"` // duration of a queued lock, counted from the hand-over
+	User     string `json:"user"`
+	Token    string `json:"token"`
+	IP       string `json:"ip"`
+	HttpErr  int    `json:"httperr"`
 }
 
 type WebResponse struct {
-	Success  bool     `json:"success"`
-	Messages []string `json:"messages"`
-	Type     string   `json:"type"`
-	Name     string   `json:"name"`
-	Parent   string   `json:"parent"`
-	State    string   `json:"state"`
-	LastDay  string   `json:"lastday"`
-	User     string   `json:"user"`
+	Success      bool          `json:"success"`
+	Messages     []string      `json:"messages"`
+	Type         string        `json:"type"`
+	Name         string        `json:"name"`
+	Parent       string        `json:"parent"`
+	State        string        `json:"state"`
+	FirstDay     string        `json:"firstday,omitempty"`
+	LastDay      string        `json:"lastday"`
+	Expire       string        `json:"expire,omitempty"`
+	PrevExpire   string        `json:"prevexpire,omitempty"`
+	TZ           string        `json:"tz,omitempty"`
+	User         string        `json:"user"`
+	Position     int           `json:"position,omitempty"`
+	Queue        []QueueEntry  `json:"queue,omitempty"`
+	Reservations []Reservation `json:"reservations,omitempty"`
+	History      []Event       `json:"history,omitempty"`
+	Webhooks     []Webhook     `json:"webhooks,omitempty"`
+}
+
+type QueueEntry struct {
+	User    string `json:"user"`
+	LastDay string `json:"lastday"`
+	Expire  string `json:"expire,omitempty"`
+	For     string `json:"for,omitempty"`
+}
+
+type Reservation struct {
+	User     string `json:"user"`
+	FirstDay string `json:"firstday"`
+	LastDay  string `json:"lastday"`
+	Expire   string `json:"expire,omitempty"`
+}
+
+// Lease is the owner and expiry of a lock, kept after the lock's key has
+// expired until its expiry gets recorded.
+type Lease struct {
+	Key      string `json:"key"`
+	User     string `json:"user"`
+	Expire   string `json:"expire"`
+	ExpireAt int64  `json:"expireat"`
+}
+
+// Event is one entry of the append-only history.
+type Event struct {
+	ID         int64  `json:"id"`
+	Time       string `json:"time"`
+	Action     string `json:"action"`
+	Type       string `json:"type"`
+	Name       string `json:"name"`
+	Actor      string `json:"actor"`
+	IP         string `json:"ip"`
+	User       string `json:"user"`
+	PrevState  string `json:"prevstate"`
+	NewState   string `json:"newstate"`
+	Expire     string `json:"expire,omitempty"`
+	PrevExpire string `json:"prevexpire,omitempty"`
+}
+
+// EventFilter selects events of the history, the empty lists match every
+// event.
+type EventFilter struct {
+	Events []string `json:"events,omitempty"`
+	Envs   []string `json:"envs,omitempty"`
+	Hosts  []string `json:"hosts,omitempty"`
+	Users  []string `json:"users,omitempty"`
+}
+
+// Webhook is an outgoing notification of the events.
+type Webhook struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	Secret string `json:"secret,omitempty"`
+	EventFilter
+}
+
+// Delivery is an event waiting to be sent to a webhook.
+type Delivery struct {
+	ID        string `json:"id"`
+	Hook      string `json:"hook"`
+	Event     Event  `json:"event"`
+	Attempts  int    `json:"attempts"`
+	NextAt    int64  `json:"nextat"`
+	LastError string `json:"lasterror,omitempty"`
 }
 
 type Stats struct {
-	ValidEnvs   []string `json:"validenvs"`
-	LockedEnvs  []string `json:"lockedenvs"`
-	MaintEnvs   []string `json:"maintenvs"`
-	TermdEnvs   []string `json:"termdenvs"`
-	LockedHosts []string `json:"lockedhosts"`
+	ValidEnvs     []string `json:"validenvs" yaml:"validenvs"`
+	LockedEnvs    []string `json:"lockedenvs" yaml:"lockedenvs"`
+	MaintEnvs     []string `json:"maintenvs" yaml:"maintenvs"`
+	TermdEnvs     []string `json:"termdenvs" yaml:"termdenvs"`
+	LockedHosts   []string `json:"lockedhosts" yaml:"lockedhosts"`
+	ReservedEnvs  []string `json:"reservedenvs" yaml:"reservedenvs"`
+	ReservedHosts []string `json:"reservedhosts" yaml:"reservedhosts"`
+}
+
+// EntityStatus is an env or a host in the v2 status.
+type EntityStatus struct {
+	Name         string         `json:"name"`
+	Type         string         `json:"type"`
+	State        string         `json:"state"`
+	Parent       string         `json:"parent,omitempty"`
+	Owner        string         `json:"owner,omitempty"`
+	LastDay      string         `json:"lastday,omitempty"`
+	Expire       string         `json:"expire,omitempty"`
+	TTL          int64          `json:"ttl"` // seconds left of the lock, 0 if not locked
+	Reservations []Reservation  `json:"reservations,omitempty"`
+	Hosts        []EntityStatus `json:"hosts,omitempty"` // locked hosts of an env, see EntityLookup
+}
+
+// StatusV2 is the overview of all entities, /v2/status.
+type StatusV2 struct {
+	Version int            `json:"version"`
+	Time    string         `json:"time"`
+	Total   int            `json:"total"` // entities matching the query
+	Envs    []EntityStatus `json:"envs"`
+	Hosts   []EntityStatus `json:"hosts"`
 }
 
 type RichErrorStatus struct {
@@ -36,50 +140,110 @@ type RichErrorStatus struct {
 	ErrorMessage string
 }
 
-const (
-	DEBUG bool = false
+// DEBUG prints the checks of the users, see Config
+var DEBUG = false
 
+const (
 	C_ADMIN     string = "admin"
 	C_ENV_LIST  string = "envlist"
 	C_TYPE_ENV  string = "env"
 	C_TYPE_HOST string = "host"
 	C_PARENT    string = "parent"
+	C_ENV_HOSTS string = "envhosts"  // set of locked hosts per env
+	C_IDX_STATE string = "bystate"   // set of entities per state
+	C_IDX_USER  string = "byuser"    // set of entities per owner
+	C_META      string = "meta"      // hash of data model metadata
+	C_QUEUE     string = "queue"     // list of waiting users per entity
+	C_QUEUES    string = "queues"    // set of entities with a queue
+	C_CALENDAR  string = "calendar"  // list of reservations per entity
+	C_CALENDARS string = "calendars" // set of entities with reservations
+	C_USER_TZ   string = "usertz"    // hash of the users' own timezones
+	C_MAX_LOCK  string = "maxlock"   // hash of the maximum lock durations per env
+	C_LEASES    string = "leases"    // hash of the lock expiries to record
+	C_HISTORY   string = "history"   // the append-only history
+	C_TYPE_USER string = "user"      // type of the user events in the history
+
+	C_WEBHOOKS   string = "webhooks"   // hash of the outgoing webhooks
+	C_DELIVERIES string = "deliveries" // hash of the pending webhook deliveries
+	C_REMINDED   string = "reminded"   // hash of the expiry reminders sent
+
+	C_INDEX_VERSION string = "2" // bump to rebuild the indexes on start
 
-	C_SUCCESS string = "✅"
-	C_FAILED  string = "❌"
-	C_STARTED string = "🌐"
+	C_SUCCESS  string = "✅"
+	C_FAILED   string = "❌"
+	C_STARTED  string = "🌐"
+	C_STOPPING string = "🛑"
 
 	C_STATE_VALID       string = "valid"
 	C_STATE_LOCKED      string = "locked"
 	C_STATE_TERMINATED  string = "termnd"
 	C_STATE_MAINTENANCE string = "maint"
 
+	C_STORE_REDIS  string = "redis"
+	C_STORE_MEMORY string = "memory"
+	C_STORE_BOLT   string = "bolt"
+
+	C_DEFAULT_TZ string = "UTC" // server default timezone of lastday
+
 	C_RespHeader string = "application/json"
 	C_Secret     string = "XXXXXXX"
 
-	ERR_JsonConvertData      string = "ERR: Error converting LockData to JSON."
-	ERR_NoNameSpecified      string = "ERR: No 'name' parameter specified."
-	ERR_NoTypeSpecified      string = "ERR: No 'type' parameter specified."
-	ERR_NoUserSpecified      string = "ERR: No 'user' parameter specified."
-	ERR_NoTokenSpecified     string = "ERR: No 'token' parameter specified."
-	ERR_WrongTypeSpecified   string = "ERR: Wrong 'type' specified, must be 'env' or 'host'."
-	ERR_IllegalUser          string = "ERR: Illegal user."
-	ERR_CannotDeleteUser     string = "ERR: User setup failed."
-	ERR_EnvLockFail          string = "ERR: Environment lock unsuccesful."
-	ERR_EnvCreationFail      string = "ERR: Creating a new enviromnent failed."
-	ERR_EnvUnlockFail        string = "ERR: Environment unlock failed."
-	ERR_EnvSetMaintFailFail  string = "ERR: Environment maintenance set failed."
-	ERR_EnvSetTermFail       string = "ERR: Environment termination failed."
-	ERR_ParentEnvNil         string = "ERR: Parent env not defined, admin can add it."
-	ERR_HostLockFail         string = "ERR: Host lock unsuccesful."
-	ERR_ParentEnvLockFail    string = "ERR: Parent environment is locked, cannot lock host."
-	ERR_HostUnlockFail       string = "ERR: Host unlock failed."
-	ERR_InvalidDateSpecified string = "ERR: Invalid 'lastday' specified, format is: YYYYMMDD."
-	ERR_NoAdminPresent       string = "ERR: No 'admin' user present, cannot continue."
-	ERR_LockedHostsInEnv     string = "ERR: Locked hosts in env, it cannot be locked."
-	ERR_UserExists           string = "ERR: User already exists."
-	ERR_UserSetupFailed      string = "ERR: Cannot setup user."
-	ERR_LockedByAnotherUser  string = "ERR: This entity is locked by another user !!!"
+	ERR_JsonConvertData       string = "ERR: Error converting LockData to JSON."
+	ERR_NoNameSpecified       string = "ERR: No 'name' parameter specified."
+	ERR_NoTypeSpecified       string = "ERR: No 'type' parameter specified."
+	ERR_NoUserSpecified       string = "ERR: No 'user' parameter specified."
+	ERR_NoTokenSpecified      string = "ERR: No 'token' parameter specified."
+	ERR_WrongTypeSpecified    string = "ERR: Wrong 'type' specified, must be 'env' or 'host'."
+	ERR_IllegalUser           string = "ERR: Illegal user."
+	ERR_CannotDeleteUser      string = "ERR: User setup failed."
+	ERR_EnvLockFail           string = "ERR: Environment lock unsuccesful."
+	ERR_EnvCreationFail       string = "ERR: Creating a new enviromnent failed."
+	ERR_EnvUnlockFail         string = "ERR: Environment unlock failed."
+	ERR_EnvSetMaintFailFail   string = "ERR: Environment maintenance set failed."
+	ERR_EnvSetTermFail        string = "ERR: Environment termination failed."
+	ERR_ParentEnvNil          string = "ERR: Parent env not defined, admin can add it."
+	ERR_HostLockFail          string = "ERR: Host lock unsuccesful."
+	ERR_ParentEnvLockFail     string = "ERR: Parent environment is locked, cannot lock host."
+	ERR_EnvUnavailable        string = "ERR: Environment is in maintenance or terminated, cannot lock."
+	ERR_HostUnlockFail        string = "ERR: Host unlock failed."
+	ERR_InvalidDateSpecified  string = "ERR: Invalid 'lastday' specified, format is: YYYYMMDD or RFC 3339."
+	ERR_InvalidForSpecified   string = "ERR: Invalid 'for' specified, format is a duration like 2h30m."
+	ERR_InvalidTZSpecified    string = "ERR: Invalid 'tz' specified, format is an IANA timezone like Europe/Budapest."
+	ERR_NoAdminPresent        string = "ERR: No 'admin' user present, cannot continue."
+	ERR_LockedHostsInEnv      string = "ERR: Locked hosts in env, it cannot be locked."
+	ERR_UserExists            string = "ERR: User already exists."
+	ERR_InvalidUserName       string = "ERR: Invalid 'user' specified, letters, digits, '.', '_' and '-' only, at most 64."
+	ERR_UserSetupFailed       string = "ERR: Cannot setup user."
+	ERR_LockedByAnotherUser   string = "ERR: This entity is locked by another user !!!"
+	ERR_EntityNotLocked       string = "ERR: This entity is not locked."
+	ERR_ReservedForQueue      string = "ERR: This entity is reserved for the next user in its queue."
+	ERR_AlreadyOwner          string = "ERR: This entity is already locked by you."
+	ERR_NotInQueue            string = "ERR: You are not in the queue of this entity."
+	ERR_QueueFail             string = "ERR: Queue operation failed."
+	ERR_IllegalAction         string = "ERR: Illegal 'action' parameter"
+	ERR_InvalidFirstDay       string = "ERR: Invalid 'firstday' specified, format is: YYYYMMDD, not after 'lastday'."
+	ERR_BookedByAnotherUser   string = "ERR: This entity is booked by another user for these days."
+	ERR_NoSuchReservation     string = "ERR: No reservation of yours starts on 'firstday'."
+	ERR_ReservationFail       string = "ERR: Reservation operation failed."
+	ERR_ExtendFail            string = "ERR: Lock extension failed."
+	ERR_ExtendNotLater        string = "ERR: The new expiry must be later than the current one."
+	ERR_LockTooLong           string = "ERR: The lock would be longer than the maximum of the env."
+	ERR_InvalidMaxLock        string = "ERR: Invalid 'max' specified, format is a duration like 72h, 0 for no limit."
+	ERR_EnvSetMaxLockFail     string = "ERR: Setting the maximum lock duration failed."
+	ERR_InvalidSince          string = "ERR: Invalid 'since' specified, format is: YYYYMMDD or RFC 3339."
+	ERR_InvalidWebhookURL     string = "ERR: Invalid 'url' specified, must be an http or https URL."
+	ERR_NoSuchEntity          string = "ERR: No such entity."
+	ERR_InvalidStateFilter    string = "ERR: Invalid 'state' specified, must be valid, locked, maint or termnd."
+	ERR_InvalidNameFilter     string = "ERR: Invalid 'name' glob or 'regex' specified."
+	ERR_InvalidExpiringFilter string = "ERR: Invalid 'expiring' specified, format is hours or a duration like 90m."
+	ERR_InvalidSort           string = "ERR: Invalid 'sort' specified, must be name, type, state, owner, expire or ttl, '-' first for descending."
+	ERR_InvalidPaging         string = "ERR: Invalid 'offset' or 'limit' specified, must be a non-negative number."
+	ERR_InvalidLastEventID    string = "ERR: Invalid 'Last-Event-ID' or 'lastid' specified, must be an event ID."
+	ERR_InvalidEvents         string = "ERR: Invalid 'events' specified, see the actions of the history."
+	ERR_NoSuchWebhook         string = "ERR: No webhook with this 'name'."
+	ERR_WebhookFail           string = "ERR: Webhook operation failed."
+	ERR_InvalidFormat         string = "ERR: Invalid 'format' specified, must be json, yaml, csv, text or prometheus."
+	ERR_NoLocalCA             string = "ERR: No local CA, the server has a configured certificate."
 
 	OK_UserPurged          string = "OK: User purged."
 	OK_EnvCreated          string = "OK: Environment created."
@@ -89,8 +253,33 @@ const (
 	OK_EnvSetToTerminate   string = "OK: Environment terminated."
 	OK_HostUnlocked        string = "OK: Host has been unlocked succesfully."
 	OK_HostLocked          string = "OK: Host has been locked succesfully."
+	OK_Queued              string = "OK: Entity is busy, you have been put in its queue."
+	OK_QueueLeft           string = "OK: You have left the queue."
+	OK_QueuePosition       string = "OK: Queue of the entity."
+	OK_Reserved            string = "OK: Reservation has been booked."
+	OK_ReservationCanceled string = "OK: Reservation has been canceled."
+	OK_UserTZSet           string = "OK: Timezone of the user has been set."
+	OK_EnvSetMaxLock       string = "OK: Maximum lock duration of the environment set."
+	OK_EnvExtended         string = "OK: Environment lock extended."
+	OK_HostExtended        string = "OK: Host lock extended."
+	OK_History             string = "OK: History of the entities."
+	OK_WebhookSet          string = "OK: Webhook has been set."
+	OK_WebhookDeleted      string = "OK: Webhook has been deleted."
+	OK_Webhooks            string = "OK: Webhooks."
+	OK_LoggedIn            string = "OK: Valid user and token."
+
+	C_EV_LOCK        string = "lock"
+	C_EV_UNLOCK      string = "unlock"
+	C_EV_EXTEND      string = "extend"
+	C_EV_EXPIRE      string = "expire"
+	C_EV_USER_PURGE  string = "user-purge"
+	C_EV_ENV_CREATE  string = "env-create"
+	C_EV_ENV_MAXLOCK string = "env-maxlock"
+	C_EV_ENV_UNLOCK  string = "env-unlock"
+	C_EV_ENV_MAINT   string = "env-maintenance"
+	C_EV_ENV_TERM    string = "env-terminate"
+	C_EV_HOST_UNLOCK string = "host-unlock"
 
-	C_HTTP_OK          = 0    // default no-error state
-	C_TLS_ENABLED bool = true // serve TLS with self-signed cert?
+	C_HTTP_OK = 0 // default no-error state
 
 )
@@ -0,0 +1,71 @@
+package x
+
+import (
+	"net/http"
+	"time"
+)
+
+var (
+	DefaultTZ *time.Location = time.UTC // midnight of a lastday is taken here
+
+)
+
+// Wants: IANA timezone name, e.g. 'Europe/Budapest'
+//
+// Returns: error if the timezone is unknown
+func SetDefaultTZ(name string) error {
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return err
+	}
+
+	DefaultTZ = loc
+	return nil
+}
+
+// Wants: user name, timezone name of the request ("" if not given)
+//
+// Returns: the timezone of the request, else the user's own one, else the
+// default, `false` if the given one is unknown
+func ResolveTZ(userName string, tz string) (*time.Location, bool) {
+
+	if tz == "" {
+		tz, _ = DB.GetSingle(C_USER_TZ, userName).(string)
+	}
+
+	if tz == "" {
+		return DefaultTZ, true
+	}
+
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, false
+	}
+
+	return loc, true
+}
+
+// Wants: filled LockData of a valid user, timezone name, "" resets to the
+// server default
+//
+// Returns: `true` if the user's timezone has been set
+func UserSetTZ(c *LockData, tz string, res *WebResponse) bool {
+
+	if _, err := time.LoadLocation(tz); tz != "" && err != nil {
+		res.Messages = append(res.Messages, ERR_InvalidTZSpecified)
+		c.HttpErr = http.StatusBadRequest
+		return false
+	}
+
+	if !DB.SetSingle(C_USER_TZ, c.User, tz) {
+		res.Messages = append(res.Messages, ERR_UserSetupFailed)
+		c.HttpErr = http.StatusInternalServerError
+		return false
+	}
+
+	res.TZ = tz
+	res.Messages = append(res.Messages, OK_UserTZSet)
+	c.HttpErr = http.StatusOK
+	return true
+}
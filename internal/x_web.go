@@ -0,0 +1,42 @@
+package x
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// webAssets is the dashboard, index.html with its script and style.
+//
+//go:embed web
+var webAssets embed.FS
+
+// Returns: the handler of the dashboard assets, to be mounted under a
+// prefix stripped off
+func WebAssets() http.Handler {
+
+	sub, err := fs.Sub(webAssets, "web")
+	if err != nil {
+		panic(err) // the embedded tree is fixed at build time
+	}
+
+	return http.FileServer(http.FS(sub))
+}
+
+// Wants: response writer
+//
+// Writes the dashboard page.
+func ServeDashboard(w http.ResponseWriter) error {
+
+	page, err := webAssets.ReadFile("web/index.html")
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	_, err = w.Write(page)
+	return err
+}
@@ -0,0 +1,317 @@
+package x
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	C_WEBHOOK_INTERVAL time.Duration = 5 * time.Second  // webhook dispatcher period
+	C_WEBHOOK_TIMEOUT  time.Duration = 10 * time.Second // time to answer a delivery
+	C_WEBHOOK_BACKOFF  time.Duration = 10 * time.Second // delay of the first retry, doubled by each
+	C_WEBHOOK_MAX_WAIT time.Duration = time.Hour        // longest delay between two attempts
+	C_WEBHOOK_ATTEMPTS int           = 10               // a delivery is dropped after this many
+	C_WEBHOOK_MAX_AGE  time.Duration = 5 * time.Minute  // receivers refuse the signatures older than this
+
+	C_HDR_EVENT     string = "X-Nodelocker-Event"
+	C_HDR_DELIVERY  string = "X-Nodelocker-Delivery"
+	C_HDR_SIGNATURE string = "X-Nodelocker-Signature"
+	C_HDR_TIMESTAMP string = "X-Nodelocker-Timestamp" // unix seconds of the attempt, signed with the body
+)
+
+// webhookWake makes the dispatcher send the new deliveries right away.
+var webhookWake = make(chan struct{}, 1)
+
+var webhookClient = &http.Client{Timeout: C_WEBHOOK_TIMEOUT}
+
+// Wants: comma separated list, e.g. a filter of a webhook
+//
+// Returns: the non-empty items
+func SplitList(list string) []string {
+
+	items := make([]string, 0)
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// Wants: URL of a webhook
+//
+// Returns: `true` if it's an absolute http or https URL
+func IsValidWebhookURL(hookURL string) bool {
+
+	u, err := url.Parse(hookURL)
+
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// Wants: valid Webhook, see IsValidWebhookURL and IsValidActions
+//
+// Returns: `true` if the webhook got added or replaced
+func WebhookSet(h Webhook) bool {
+
+	item, err := json.Marshal(h)
+	if err != nil {
+		return false
+	}
+
+	return DB.SetSingle(C_WEBHOOKS, h.Name, string(item))
+}
+
+// Wants: name of the webhook
+//
+// Returns: `true` if it existed and got deleted, its pending deliveries are
+// dropped by the dispatcher
+func WebhookDelete(name string) bool {
+
+	if DB.GetSingle(C_WEBHOOKS, name) == nil {
+		return false
+	}
+
+	return DB.EntityDelete(C_WEBHOOKS, name)
+}
+
+// Returns: the webhooks ordered by name, with their secrets
+func WebhookList() []Webhook {
+
+	hooks := make([]Webhook, 0)
+	for _, item := range DB.GetAll(C_WEBHOOKS) {
+		var h Webhook
+		if json.Unmarshal([]byte(item), &h) == nil {
+			hooks = append(hooks, h)
+		}
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].Name < hooks[j].Name })
+
+	return hooks
+}
+
+// Wants: recorded event, see OnEvent
+//
+// Stores a delivery of the event for every matching webhook. An event not
+// recorded in the history has no ID of its own to name the deliveries, it
+// is not sent.
+func QueueWebhooks(e Event) {
+
+	if e.ID == 0 {
+		fmt.Printf("%s '%s' of %s:%s not recorded, not sent to the webhooks\n", C_FAILED, e.Action, e.Type, e.Name)
+		return
+	}
+
+	queued := false
+
+	for _, h := range WebhookList() {
+		if !h.Matches(e) {
+			continue
+		}
+
+		d := Delivery{
+			ID:     fmt.Sprintf("%020d-%s", e.ID, h.Name),
+			Hook:   h.Name,
+			Event:  e,
+			NextAt: time.Now().Unix(),
+		}
+		if !saveDelivery(d) {
+			fmt.Printf("%s Cannot queue '%s' of %s:%s for webhook '%s'\n", C_FAILED, e.Action, e.Type, e.Name, h.Name)
+			continue
+		}
+		queued = true
+	}
+
+	if queued {
+		select {
+		case webhookWake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func saveDelivery(d Delivery) bool {
+
+	item, err := json.Marshal(d)
+	if err != nil {
+		return false
+	}
+
+	return DB.SetSingle(C_DELIVERIES, d.ID, string(item))
+}
+
+// Wants: secret of the webhook, timestamp header, request body
+//
+// Returns: the value of the signature header, the hex HMAC-SHA256 of the
+// timestamp, a '.' and the body
+func WebhookSignature(secret string, timestamp string, body []byte) string {
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Wants: secret of the webhook, the timestamp and signature headers and the
+// body of a delivery, current time
+//
+// Returns: `true` if the signature is right and the timestamp is within
+// C_WEBHOOK_MAX_AGE of now, what the receivers should check
+func VerifyWebhookSignature(secret string, timestamp string, signature string, body []byte, now time.Time) bool {
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := now.Sub(time.Unix(ts, 0)); age > C_WEBHOOK_MAX_AGE || age < -C_WEBHOOK_MAX_AGE {
+		return false
+	}
+
+	return hmac.Equal([]byte(signature), []byte(WebhookSignature(secret, timestamp, body)))
+}
+
+// Wants: request of a delivery or reminder, secret, body
+//
+// Sets the timestamp and, with a secret, the signature headers.
+func signWebhook(req *http.Request, secret string, body []byte) {
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(C_HDR_TIMESTAMP, timestamp)
+	if secret != "" {
+		req.Header.Set(C_HDR_SIGNATURE, WebhookSignature(secret, timestamp, body))
+	}
+}
+
+// Wants: context of the request, webhook, its delivery
+//
+// Returns: error if the webhook didn't answer with 2xx
+func sendWebhook(ctx context.Context, h Webhook, d Delivery) error {
+
+	body, err := json.Marshal(d.Event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", C_RespHeader)
+	req.Header.Set("User-Agent", "nodelocker")
+	req.Header.Set(C_HDR_EVENT, d.Event.Action)
+	req.Header.Set(C_HDR_DELIVERY, d.ID)
+	signWebhook(req, h.Secret, body)
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// Wants: number of failed attempts so far
+//
+// Returns: the delay before the next attempt
+func webhookBackoff(attempts int) time.Duration {
+
+	wait := C_WEBHOOK_BACKOFF
+	for i := 1; i < attempts && wait < C_WEBHOOK_MAX_WAIT; i++ {
+		wait *= 2
+	}
+
+	return min(wait, C_WEBHOOK_MAX_WAIT)
+}
+
+// Wants: context cancelled to stop, current time
+//
+// Sends the deliveries due, oldest event first, and reschedules the failed
+// ones until they run out of attempts. The deliveries cut off by the context
+// stay due, without counting as an attempt.
+func DeliverWebhooks(ctx context.Context, now time.Time) {
+
+	hooks := make(map[string]Webhook)
+	for _, h := range WebhookList() {
+		hooks[h.Name] = h
+	}
+
+	deliveries := make([]Delivery, 0)
+	for _, item := range DB.GetAll(C_DELIVERIES) {
+		var d Delivery
+		if json.Unmarshal([]byte(item), &d) == nil && d.NextAt <= now.Unix() {
+			deliveries = append(deliveries, d)
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].ID < deliveries[j].ID })
+
+	for _, d := range deliveries {
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		h, ok := hooks[d.Hook]
+		if !ok { // deleted meanwhile
+			DB.EntityDelete(C_DELIVERIES, d.ID)
+			continue
+		}
+
+		err := sendWebhook(ctx, h, d)
+		if err == nil {
+			DB.EntityDelete(C_DELIVERIES, d.ID)
+			continue
+		} else if ctx.Err() != nil {
+			return
+		}
+
+		d.Attempts++
+		d.LastError = err.Error()
+		if d.Attempts >= C_WEBHOOK_ATTEMPTS {
+			fmt.Printf("%s Webhook '%s' dropped delivery %s after %d attempts: %s\n", C_FAILED, h.Name, d.ID, d.Attempts, err)
+			DB.EntityDelete(C_DELIVERIES, d.ID)
+			continue
+		}
+
+		d.NextAt = now.Add(webhookBackoff(d.Attempts)).Unix()
+		saveDelivery(d)
+	}
+}
+
+// Wants: time between two runs, channel closed to stop
+//
+// Sends the webhook deliveries, the new ones right away.
+func RunWebhookDispatcher(interval time.Duration, stop <-chan struct{}) {
+
+	ctx, cancel := stopContext(stop)
+	defer cancel()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		case <-webhookWake:
+		}
+		DeliverWebhooks(ctx, time.Now())
+	}
+}
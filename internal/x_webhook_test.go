@@ -0,0 +1,99 @@
+package x
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVerifyWebhookSignature(t *testing.T) {
+
+	now := time.Now()
+	body := []byte(`{"action":"lock"}`)
+	at := func(d time.Duration) string { return strconv.FormatInt(now.Add(d).Unix(), 10) }
+
+	for _, tc := range []struct {
+		name      string
+		timestamp string // signed
+		sent      string // timestamp header received
+		body      string // body received
+		want      bool
+	}{
+		{"fresh", at(0), at(0), string(body), true},
+		{"within the window", at(-4 * time.Minute), at(-4 * time.Minute), string(body), true},
+		{"replayed later", at(-10 * time.Minute), at(-10 * time.Minute), string(body), false},
+		{"from the future", at(10 * time.Minute), at(10 * time.Minute), string(body), false},
+		{"timestamp changed", at(-10 * time.Minute), at(0), string(body), false},
+		{"body changed", at(0), at(0), `{"action":"unlock"}`, false},
+		{"no timestamp", at(0), "", string(body), false},
+	} {
+		signature := WebhookSignature("s3cr3t", tc.timestamp, body)
+		if got := VerifyWebhookSignature("s3cr3t", tc.sent, signature, []byte(tc.body), now); got != tc.want {
+			t.Errorf("%s: %t, want %t", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestDeliveriesSigned(t *testing.T) {
+
+	received := make(chan bool, 2)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- VerifyWebhookSignature("s3cr3t", r.Header.Get(C_HDR_TIMESTAMP), r.Header.Get(C_HDR_SIGNATURE), body, time.Now())
+	}))
+	defer hook.Close()
+
+	h := Webhook{Name: "signed", URL: hook.URL, Secret: "s3cr3t"}
+	if err := sendWebhook(context.Background(), h, Delivery{ID: "1-signed", Event: Event{ID: 1, Action: C_EV_LOCK}}); err != nil {
+		t.Fatal(err)
+	}
+	if !<-received {
+		t.Error("webhook delivery: wrong signature")
+	}
+
+	n := WebhookNotifier{URL: hook.URL, Secret: "s3cr3t"}
+	if err := n.Notify(context.Background(), Reminder{Type: C_TYPE_HOST, Name: "env1-host1", User: "user1"}); err != nil {
+		t.Fatal(err)
+	}
+	if !<-received {
+		t.Error("reminder: wrong signature")
+	}
+}
+
+// historyDown is a store failing to record the history.
+type historyDown struct{ Store }
+
+func (historyDown) HistoryAdd(e *Event) error { return errors.New("history down") }
+
+func TestUnrecordedEventsNotDelivered(t *testing.T) {
+
+	useMemStore(t)
+	recorded := recordEvents(t)
+	eventHooks = append(eventHooks, QueueWebhooks)
+
+	if !WebhookSet(Webhook{Name: "all", URL: "http://127.0.0.1:1/"}) {
+		t.Fatal("cannot add the webhook")
+	}
+
+	store := DB
+	DB = historyDown{store}
+	Emit(&Event{ID: 7, Action: C_EV_LOCK, Type: C_TYPE_ENV, Name: "env1"})
+	DB = store
+
+	if e := recorded(); len(e) != 1 || e[0].ID != 0 {
+		t.Errorf("unrecorded events are %+v, want one without ID", e)
+	}
+	if d := DB.GetAll(C_DELIVERIES); len(d) != 0 {
+		t.Errorf("deliveries are %v, want none", d)
+	}
+
+	Emit(&Event{Action: C_EV_LOCK, Type: C_TYPE_ENV, Name: "env1"})
+	if d := DB.GetAll(C_DELIVERIES); len(d) != 1 {
+		t.Errorf("deliveries are %v, want one", d)
+	}
+}
@@ -39,6 +39,13 @@ Describe 'User existence and modification'
             The output should include "ERR: User already exists."
         End
     End
+    Context 'add a user with a line break'
+        It 'should fail'
+            When call tests/helpers/user_add.sh 'evil%0D%0ABcc:x@y' passx
+            The output should include '"success": false'
+            The output should include "ERR: Invalid 'user' specified"
+        End
+    End
     Context 'add user2'
         It 'should pass'
             When call tests/helpers/user_add.sh user2 pass2
@@ -53,6 +60,20 @@ Describe 'User existence and modification'
             The output should include "OK: User 'user3' created."
         End
     End
+    Context 'add user4'
+        It 'should pass'
+            When call tests/helpers/user_add.sh user4 pass4
+            The output should include '"success": true' # Created
+            The output should include "OK: User 'user4' created."
+        End
+    End
+    Context 'add user5'
+        It 'should pass'
+            When call tests/helpers/user_add.sh user5 pass5
+            The output should include '"success": true' # Created
+            The output should include "OK: User 'user5' created."
+        End
+    End
     Context 'admin purge user3 with bad admin password'
         It 'should fail with unauthenticated'
             When call tests/helpers/admin_user_purge.sh user3 adminBADpass
@@ -105,6 +126,13 @@ Describe 'Environment and host handling'
             The output should include "OK: Environment created."
         End
     End
+    Context 'lock env1 with a past lastday'
+        It 'should fail, env1 kept'
+            When call tests/helpers/env_lock.sh env1 user1 pass1 20200101
+            The output should include '"success": false'
+            The output should include "ERR: Invalid 'lastday' specified"
+        End
+    End
     Context 'lock env1'
         It 'should pass'
             When call tests/helpers/env_lock.sh env1 user1 pass1 20310101
@@ -161,6 +189,126 @@ Describe 'Environment and host handling'
             The output should include "OK: Host has been locked succesfully."
         End
     End
+    Context 'wait for env5-host1-a by user2'
+        It 'should pass, queued'
+            When call tests/helpers/host_lock_wait.sh env5-host1-a user2 pass2 20320202
+            The output should include '"success": true'
+            The output should include "OK: Entity is busy, you have been put in its queue."
+            The output should include '"position": 1'
+        End
+    End
+    Context 'wait for env5-host1-a by user4'
+        It 'should pass, queued behind user2'
+            When call tests/helpers/host_lock_wait.sh env5-host1-a user4 pass4 20320202
+            The output should include '"success": true'
+            The output should include '"position": 2'
+        End
+    End
+    Context 'leave queue of env5-host1-a by user4'
+        It 'should pass'
+            When call tests/helpers/host_queue.sh env5-host1-a user4 pass4 leave
+            The output should include '"success": true'
+            The output should include "OK: You have left the queue."
+        End
+    End
+    Context 'unlock env5-host1-a by user1'
+        It 'should pass'
+            When call tests/helpers/host_unlock.sh env5-host1-a user1 pass1
+            The output should include '"success": true'
+            The output should include "OK: Host has been unlocked succesfully."
+        End
+    End
+    Context 'unlock env5-host1-a by user2'
+        It 'should pass, handed over from the queue'
+            When call tests/helpers/host_unlock.sh env5-host1-a user2 pass2
+            The output should include '"success": true'
+            The output should include "OK: Host has been unlocked succesfully."
+        End
+    End
+    Context 'lock env5-host2 for 2h30m'
+        It 'should pass with an exact expiry'
+            When call tests/helpers/host_lock_for.sh env5-host2 user1 pass1 2h30m
+            The output should include '"success": true'
+            The output should include '"expire": "'
+        End
+    End
+    Context 'extend env5-host2 by user2'
+        It 'should fail, locked by user1'
+            When call tests/helpers/host_extend.sh env5-host2 user2 pass2 3h
+            The output should include '"success": false'
+            The output should include "ERR: This entity is locked by another user !!!"
+        End
+    End
+    Context 'extend env5-host2 by user1'
+        It 'should pass'
+            When call tests/helpers/host_extend.sh env5-host2 user1 pass1 3h
+            The output should include '"success": true'
+            The output should include "OK: Host lock extended."
+            The output should include '"prevexpire": "'
+        End
+    End
+    Context 'lock env5-host3 for a bad duration'
+        It 'should fail'
+            When call tests/helpers/host_lock_for.sh env5-host3 user1 pass1 2days
+            The output should include '"success": false'
+            The output should include "ERR: Invalid 'for' specified"
+        End
+    End
+    Context 'lock env5-host4 till midnight in New York'
+        It 'should pass with the expiry in that timezone'
+            When call tests/helpers/host_lock_tz.sh env5-host4 user1 pass1 20320202 America/New_York
+            The output should include '"success": true'
+            The output should include '"expire": "2032-02-03T00:00:00-05:00"'
+        End
+    End
+    Context 'set timezone of user4'
+        It 'should fail, unknown timezone'
+            When call tests/helpers/user_tz.sh user4 pass4 Mars/Olympus_Mons
+            The output should include '"success": false'
+            The output should include "ERR: Invalid 'tz' specified"
+        End
+    End
+    Context 'lock env5-host9 by four users at the same time'
+        It 'should pass for exactly one of them'
+            When call tests/helpers/host_lock_race.sh env5-host9 20320202 user1:pass1 user2:pass2 user4:pass4 user5:pass5
+            The output should eq "winners: 1"
+        End
+    End
+    Context 'lock env2'
+        It 'should fail, env2 contains locked hosts'
+            When call tests/helpers/env_lock.sh env2 user1 pass1 20320202
+            The output should include '"success": false'
+            The output should include "ERR: Locked hosts in env, it cannot be locked."
+        End
+    End
+    Context 'unlock env2-host2 by user2'
+        It 'should fail, locked by user1'
+            When call tests/helpers/host_unlock.sh env2-host2 user2 pass2
+            The output should include '"success": false'
+            The output should include "ERR: This entity is locked by another user !!!"
+        End
+    End
+    Context 'unlock env2-host2 by user1'
+        It 'should pass'
+            When call tests/helpers/host_unlock.sh env2-host2 user1 pass1
+            The output should include '"success": true'
+            The output should include "OK: Host has been unlocked succesfully."
+        End
+    End
+    Context 'admin unlock env2-host3'
+        It 'should pass'
+            When call tests/helpers/admin_host_unlock.sh env2-host3 adminpass
+            The output should include '"success": true'
+            The output should include "OK: Host has been unlocked succesfully."
+        End
+    End
+    Context 'lock env2'
+        It 'should pass, no more locked hosts in env2'
+            When call tests/helpers/env_lock.sh env2 user2 pass2 20320202
+            The output should include '"success": true'
+            The output should include "OK: Environment locked successfully."
+        End
+    End
     Context 'lock env6-host4'
         It 'should fail, no such env'
             When call tests/helpers/host_lock.sh env6-host4 user1 pass1 20320202
@@ -175,6 +323,27 @@ Describe 'Environment and host handling'
             The output should include "OK: Environment unlocked."
         End
     End
+    Context 'reserve env5 by user1'
+        It 'should pass'
+            When call tests/helpers/env_reserve.sh env5 user1 pass1 20320301 20320310
+            The output should include '"success": true'
+            The output should include "OK: Reservation has been booked."
+        End
+    End
+    Context 'reserve env5 by user2'
+        It 'should fail, overlaps with user1'
+            When call tests/helpers/env_reserve.sh env5 user2 pass2 20320305 20320312
+            The output should include '"success": false'
+            The output should include "ERR: This entity is booked by another user for these days."
+        End
+    End
+    Context 'cancel reservation of env5 by user1'
+        It 'should pass'
+            When call tests/helpers/env_reserve_cancel.sh env5 user1 pass1 20320301
+            The output should include '"success": true'
+            The output should include "OK: Reservation has been canceled."
+        End
+    End
     Context 'admin terminate env3'
         It 'should pass'
             When call tests/helpers/admin_env_terminate.sh env3 adminpass
@@ -189,4 +358,185 @@ Describe 'Environment and host handling'
             The output should include "OK: Environment is in maintenance mode now."
         End
     End
+    Context 'rate limit window'
+        It 'waits for a new one'
+            When call tests/helpers/RATE_WAIT.sh
+            The output should include "OK"
+        End
+    End
+    Context 'history of env2-host2'
+        It 'should pass, with the unlock by user1'
+            When call tests/helpers/history.sh host env2-host2 user1
+            The output should include '"success": true'
+            The output should include '"action": "unlock"'
+            The output should include '"actor": "user1"'
+        End
+    End
+    Context 'history since a wrong date'
+        It 'should fail'
+            When call tests/helpers/history.sh env env4 "" 2032
+            The output should include '"success": false'
+            The output should include "ERR: Invalid 'since' specified"
+        End
+    End
+    Context 'admin webhook with a wrong url'
+        It 'should fail'
+            When call tests/helpers/admin_webhook_set.sh standin ftp://localhost adminpass
+            The output should include '"success": false'
+            The output should include "ERR: Invalid 'url' specified"
+        End
+    End
+    Context 'webhook delivery of locking env5-host7 to a local stand-in'
+        It 'should pass, signed'
+            When call tests/helpers/webhook_delivery.sh adminpass env5-host7 user1 pass1 20320202
+            The output should include 'POST /hook'
+            The output should include 'X-Nodelocker-Event: lock'
+            The output should include 'X-Nodelocker-Signature: sha256='
+            The output should include 'X-Nodelocker-Timestamp: '
+            The output should include 'signature verified'
+            The output should include '"name":"env5-host7"'
+        End
+    End
+    Context 'admin delete webhook'
+        It 'should pass'
+            When call tests/helpers/admin_webhook_delete.sh standin adminpass
+            The output should include '"success": true'
+            The output should include "OK: Webhook has been deleted."
+        End
+    End
+    Context 'event stream of env2-host2 from the beginning'
+        It 'should replay the unlock by user1'
+            When call tests/helpers/events.sh 1 host env2-host2
+            The output should include 'event: unlock'
+            The output should include '"name":"env2-host2"'
+            The output should not include '"name":"env2-host3"'
+        End
+    End
+    Context 'v2 status'
+        It 'should list the entities as objects'
+            When call tests/helpers/status_v2.sh
+            The output should include '"version": 2'
+            The output should include '"name": "env3"'
+            The output should include '"state": "termnd"'
+            The output should include '"owner": "user1"'
+        End
+    End
+    Context 'status of the hosts locked by user1'
+        It 'should list them only'
+            When call tests/helpers/status_json.sh "owner=user1&type=host&name=env5-host%5B2-7%5D&sort=-name"
+            The output should include 'x-total-count: 3'
+            The output should include 'env5-host7'
+            The output should not include 'env1 ('
+            The output should not include 'user2'
+        End
+    End
+    Context 'status with a wrong state filter'
+        It 'should fail'
+            When call tests/helpers/status_json.sh "state=free"
+            The output should include '"success": false'
+            The output should include "ERR: Invalid 'state' specified"
+        End
+    End
+    Context 'lookup env5'
+        It 'should pass, with its locked hosts'
+            When call tests/helpers/entity.sh env env5
+            The output should include '"name": "env5"'
+            The output should include '"name": "env5-host7"'
+            The output should include '"owner": "user1"'
+        End
+    End
+    Context 'lookup env6-host4'
+        It 'should fail, no such env'
+            When call tests/helpers/entity.sh host env6-host4
+            The output should include 'HTTP/2 404'
+            The output should include "ERR: No such entity."
+        End
+    End
+    Context 'status as yaml'
+        It 'should list the same as the json'
+            When call tests/helpers/status_format.sh status/yaml
+            The output should include 'content-type: application/yaml'
+            The output should include 'termdenvs:'
+            The output should include '- env3'
+        End
+    End
+    Context 'status as csv by the accept header'
+        It 'should list one row per entity'
+            When call tests/helpers/status_format.sh "status?type=host&owner=user1" text/csv
+            The output should include 'type,name,state,parent,owner,lastday,expire,ttl,reservations'
+            The output should include 'host,env5-host7,locked,env5,user1,'
+        End
+    End
+    Context 'status as prometheus metrics'
+        It 'should count the terminated envs'
+            When call tests/helpers/status_format.sh metrics
+            The output should include 'nodelocker_entities{type="env",state="termnd"} 1'
+            The output should include 'nodelocker_lock_ttl_seconds{type="host",name="env5-host7",owner="user1"}'
+        End
+    End
+    Context 'status in a wrong format'
+        It 'should fail'
+            When call tests/helpers/status_format.sh "status?format=xml"
+            The output should include 'HTTP/2 400'
+            The output should include "ERR: Invalid 'format' specified"
+        End
+    End
+    Context 'dashboard'
+        It 'should serve the page'
+            When call tests/helpers/status_format.sh status/web
+            The output should include 'content-type: text/html'
+            The output should include '<script src="/ui/app.js" defer></script>'
+        End
+    End
+    Context 'dashboard script'
+        It 'should be embedded'
+            When call tests/helpers/status_format.sh ui/app.js
+            The output should include 'HTTP/2 200'
+            The output should include 'new EventSource("/events")'
+        End
+    End
+    Context 'dashboard login of user1'
+        It 'should pass'
+            When call tests/helpers/login.sh user1 pass1
+            The output should include '"success": true'
+            The output should include "OK: Valid user and token."
+        End
+    End
+    Context 'dashboard login of user1 with a wrong token'
+        It 'should fail'
+            When call tests/helpers/login.sh user1 wrong
+            The output should include 'HTTP/2 403'
+            The output should include "ERR: Illegal user."
+        End
+    End
+    Context 'export the local CA'
+        It 'should pass'
+            When call tests/helpers/ca_export.sh
+            The output should include 'HTTP/2 200'
+            The output should include '-----BEGIN CERTIFICATE-----'
+        End
+    End
+End
+
+Describe 'Configuration precedence'
+    Context 'config file only'
+        It 'should take the file'
+            When call tests/helpers/config_print.sh 10 ''
+            The output should include 'rate-limit: 10'
+        End
+    End
+    Context 'environment variable over the config file'
+        It 'should take the environment variable'
+            When call tests/helpers/config_print.sh 10 20
+            The output should include 'rate-limit: 20'
+            The output should not include 'rate-limit: 10'
+        End
+    End
+    Context 'flag over the environment variable'
+        It 'should take the flag'
+            When call tests/helpers/config_print.sh 10 20 -rate-limit 30
+            The output should include 'rate-limit: 30'
+            The output should not include 'rate-limit: 20'
+        End
+    End
 End
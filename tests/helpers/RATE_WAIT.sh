@@ -0,0 +1,6 @@
+#!/usr/bin/env bash
+
+# The server allows 60 requests a minute from one client, waits for a new
+# window before the rest of the tests
+sleep 61
+echo "OK"
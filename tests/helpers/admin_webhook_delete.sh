@@ -0,0 +1,8 @@
+#!/usr/bin/env bash
+
+# required fields:
+#   action: webhook-delete: Remove an outgoing webhook
+#   name: The name of the webhook
+#   token: Admin token
+
+curl -ski "https://localhost:3000/admin?action=webhook-delete&name=$1&token=$2"
@@ -0,0 +1,12 @@
+#!/usr/bin/env bash
+
+# required fields:
+#   action: webhook-set: Add or replace an outgoing webhook
+#   name: The name of the webhook
+#   url: Where the events are posted to
+#   token: Admin token
+# optional fields:
+#   secret: Key of the HMAC signature
+#   events: Comma separated actions to post, all if empty
+
+curl -ski "https://localhost:3000/admin?action=webhook-set&name=$1&url=$2&token=$3&secret=$4&events=$5"
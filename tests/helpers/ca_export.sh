@@ -0,0 +1,5 @@
+#!/usr/bin/env bash
+
+# usage: ca_export.sh
+
+curl -ski "https://localhost:3000/ca.pem"
@@ -0,0 +1,14 @@
+#!/usr/bin/env bash
+
+# usage: config_print.sh <rate-limit in the config file> <NODELOCKER_RATE_LIMIT, '' for none> [flags]
+
+config=$(mktemp --suffix=.yaml)
+trap 'rm -f "$config"' EXIT
+echo "rate-limit: $1" > "$config"
+
+unset NODELOCKER_RATE_LIMIT
+if [ -n "$2" ]; then
+    export NODELOCKER_RATE_LIMIT="$2"
+fi
+
+go run ./bin/nodelocker -config "$config" -print-config "${@:3}"
@@ -0,0 +1,5 @@
+#!/usr/bin/env bash
+
+# usage: entity.sh <type> <name>
+
+curl -ski "https://localhost:3000/entity?type=$1&name=$2"
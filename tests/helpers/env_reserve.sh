@@ -0,0 +1,5 @@
+#!/usr/bin/env bash
+
+# usage: env_reserve.sh <envname> <user> <token> <firstday> <lastday>
+
+curl -ski "https://localhost:3000/lock?type=env&name=$1&user=$2&token=$3&firstday=$4&lastday=$5"
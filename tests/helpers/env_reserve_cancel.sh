@@ -0,0 +1,5 @@
+#!/usr/bin/env bash
+
+# usage: env_reserve_cancel.sh <envname> <user> <token> <firstday>
+
+curl -ski "https://localhost:3000/unlock?type=env&name=$1&user=$2&token=$3&firstday=$4"
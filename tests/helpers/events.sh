@@ -0,0 +1,9 @@
+#!/usr/bin/env bash
+
+# Listens to the event stream for 2 seconds, replaying the events after
+# <lastid> first.
+#
+# usage: events.sh <lastid> <filter_param> <filter_value>
+
+timeout 2 curl -skN "https://localhost:3000/events?lastid=$1&$2=$3"
+exit 0
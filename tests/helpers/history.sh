@@ -0,0 +1,5 @@
+#!/usr/bin/env bash
+
+# usage: history.sh <type> <name> <user> [since]
+
+curl -ski "https://localhost:3000/history?type=$1&name=$2&user=$3&since=$4"
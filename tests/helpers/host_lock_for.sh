@@ -0,0 +1,5 @@
+#!/usr/bin/env bash
+
+# usage: host_lock_for.sh <hostname> <user> <token> <duration>
+
+curl -ski "https://localhost:3000/lock?type=host&name=$1&user=$2&token=$3&for=$4"
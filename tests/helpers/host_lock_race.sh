@@ -0,0 +1,20 @@
+#!/usr/bin/env bash
+
+# Locks the same host with every given user at the same time,
+# then prints how many of the requests succeeded.
+#
+# usage: host_lock_race.sh <hostname> <lastday> <user:token>...
+
+HOST=$1
+LASTDAY=$2
+shift 2
+
+OUT=$(mktemp -d)
+
+for CRED in "$@"; do
+    curl -ski "https://localhost:3000/lock?type=host&name=$HOST&user=${CRED%%:*}&token=${CRED#*:}&lastday=$LASTDAY" >"$OUT/${CRED%%:*}" &
+done
+wait
+
+echo "winners: $(cat "$OUT"/* | grep -c '"success": true')"
+rm -rf "$OUT"
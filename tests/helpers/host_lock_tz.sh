@@ -0,0 +1,5 @@
+#!/usr/bin/env bash
+
+# usage: host_lock_tz.sh <hostname> <user> <token> <lastday> <tz>
+
+curl -ski "https://localhost:3000/lock?type=host&name=$1&user=$2&token=$3&lastday=$4&tz=$5"
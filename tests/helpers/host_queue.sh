@@ -0,0 +1,5 @@
+#!/usr/bin/env bash
+
+# usage: host_queue.sh <hostname> <user> <token> <action> [lastday]
+
+curl -ski "https://localhost:3000/queue?action=$4&type=host&name=$1&user=$2&token=$3&lastday=$5"
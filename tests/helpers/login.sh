@@ -0,0 +1,5 @@
+#!/usr/bin/env bash
+
+# usage: login.sh <user> <token>
+
+curl -ski "https://localhost:3000/login?user=$1&token=$2"
@@ -0,0 +1,5 @@
+#!/usr/bin/env bash
+
+# usage: status_format.sh <path> [accept]
+
+curl -ski -H "Accept: ${2:-*/*}" "https://localhost:3000/$1"
@@ -0,0 +1,5 @@
+#!/usr/bin/env bash
+
+# usage: status_json.sh <query_string>
+
+curl -ski "https://localhost:3000/status/json?$1"
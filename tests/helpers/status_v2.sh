@@ -0,0 +1,5 @@
+#!/usr/bin/env bash
+
+# usage: status_v2.sh
+
+curl -ski "https://localhost:3000/v2/status"
@@ -0,0 +1,5 @@
+#!/usr/bin/env bash
+
+# usage: user_tz.sh <user> <token> <tz>
+
+curl -ski "https://localhost:3000/timezone?user=$1&token=$2&tz=$3"
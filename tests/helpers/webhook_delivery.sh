@@ -0,0 +1,21 @@
+#!/usr/bin/env bash
+
+# Sets a webhook of the lock events pointing to a local stand-in, locks a
+# host, then prints what the stand-in received.
+#
+# usage: webhook_delivery.sh <admin_token> <hostname> <user> <token> <lastday>
+
+PORT=3999
+OUT=$(mktemp)
+
+python3 tests/helpers/webhook_standin.py $PORT s3cr3t >"$OUT" &
+STANDIN=$!
+sleep 1
+
+curl -sk "https://localhost:3000/admin?action=webhook-set&name=standin&url=http://localhost:$PORT/hook&secret=s3cr3t&events=lock&token=$1" >/dev/null
+curl -sk "https://localhost:3000/lock?type=host&name=$2&user=$3&token=$4&lastday=$5" >/dev/null
+sleep 2
+
+kill $STANDIN
+cat "$OUT"
+rm -f "$OUT"
@@ -0,0 +1,43 @@
+#!/usr/bin/env python3
+
+# A local stand-in of a webhook receiver, prints the headers and the body of
+# every delivery and answers 200. With the secret of the webhook it checks
+# the signature and the age of its timestamp too, like a receiver should.
+#
+# usage: webhook_standin.py <port> [secret]
+
+import hashlib
+import hmac
+import sys
+import time
+from http.server import BaseHTTPRequestHandler, HTTPServer
+
+MAX_AGE = 300  # seconds, the tolerance window of the timestamps
+
+
+class StandIn(BaseHTTPRequestHandler):
+
+    def do_POST(self):
+        body = self.rfile.read(int(self.headers.get("Content-Length", 0)))
+        print(f"{self.command} {self.path}")
+        for name, value in self.headers.items():
+            print(f"{name}: {value}")
+        print(body.decode())
+        if len(sys.argv) > 2:
+            print("signature " + ("verified" if self.verify(sys.argv[2], body) else "rejected"))
+        sys.stdout.flush()
+        self.send_response(200)
+        self.end_headers()
+
+    def verify(self, secret, body):
+        timestamp = self.headers.get("X-Nodelocker-Timestamp", "")
+        if not timestamp.isdigit() or abs(time.time() - int(timestamp)) > MAX_AGE:
+            return False
+        mac = hmac.new(secret.encode(), timestamp.encode() + b"." + body, hashlib.sha256)
+        return hmac.compare_digest("sha256=" + mac.hexdigest(), self.headers.get("X-Nodelocker-Signature", ""))
+
+    def log_message(self, format, *args):
+        pass
+
+
+HTTPServer(("localhost", int(sys.argv[1])), StandIn).serve_forever()